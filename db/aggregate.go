@@ -0,0 +1,428 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+type AggregateFunction int
+
+const (
+	AGG_COUNT AggregateFunction = iota
+	AGG_COUNT_DISTINCT
+	AGG_SUM
+	AGG_AVG
+	AGG_MIN
+	AGG_MAX
+	// a function of UserAggregates
+	AGG_USER
+)
+
+var aggregateFunctionNames = map[AggregateFunction]string {
+	AGG_COUNT: "COUNT",
+	AGG_COUNT_DISTINCT: "COUNT_DISTINCT",
+	AGG_SUM: "SUM",
+	AGG_AVG: "AVG",
+	AGG_MIN: "MIN",
+	AGG_MAX: "MAX",
+}
+
+// COUNT(*) is named Count, the column COUNT adds to its records
+const count_column = "Count"
+
+// count_all is the column of a COUNT of every record
+const count_all = "*"
+
+type Aggregate struct {
+	function AggregateFunction
+	column string
+	as string
+	// the name of an AGG_USER function
+	user string
+}
+
+// aggregateName is the column an aggregate without an alias is returned in:
+// Count for COUNT(*), otherwise the call, such as SUM(Rating) or
+// COUNT(DISTINCT Year).
+func aggregateName(function AggregateFunction, column string) string {
+	switch {
+		case function == AGG_COUNT && column == count_all:
+			return count_column
+		case function == AGG_COUNT_DISTINCT:
+			return fmt.Sprintf("COUNT(DISTINCT %s)", column)
+	}
+	return fmt.Sprintf("%s(%s)", aggregateFunctionNames[function], column)
+}
+
+func parseAggregateFunction(name string) (AggregateFunction, bool) {
+	for f, f_name := range(aggregateFunctionNames) {
+		if f_name == name {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+func (a Aggregate) functionName() string {
+	if a.function == AGG_USER {
+		return a.user
+	}
+	return aggregateFunctionNames[a.function]
+}
+
+func (a Aggregate) name() string {
+	if a.as != "" {
+		return a.as
+	}
+	if a.function == AGG_USER {
+		return fmt.Sprintf("%s(%s)", a.user, a.column)
+	}
+	return aggregateName(a.function, a.column)
+}
+
+/*
+aggregateState accumulates an aggregate over the records of a group. NULLs are
+skipped by every function but COUNT(*), so SUM, AVG, MIN and MAX are NULL for a
+group without values.
+*/
+type aggregateState struct {
+	count int64
+	sum_i int64
+	sum_f float64
+	float bool
+	value Value
+	distinct map[string]bool
+	// the function and state of an AGG_USER
+	user *UserAggregate
+	state any
+}
+
+func initAggregateState() *aggregateState {
+	return &aggregateState{ value: NullValue(), distinct: make(map[string]bool) }
+}
+
+// numericValue returns v as an int or a float. Strings, which is how tables
+// written without types store numbers, are parsed.
+func numericValue(v Value) (Value, error) {
+	if isNumeric(v.typ) {
+		return v, nil
+	}
+	if v.typ == TYPE_STRING {
+		if i, err := parseValue(v.s, TYPE_INT); err == nil {
+			return i, nil
+		}
+		if f, err := parseValue(v.s, TYPE_FLOAT); err == nil {
+			return f, nil
+		}
+	}
+	return Value{}, fmt.Errorf("%w: %v %s is not a number", ErrTypeMismatch, v.typ, v)
+}
+
+func (s *aggregateState) add(a Aggregate, r *Record) error {
+	if a.function == AGG_COUNT && a.column == count_all {
+		s.count += 1
+		return nil
+	}
+	v := r.getColumn(a.column)
+	if v.IsNull() {
+		return nil
+	}
+	switch a.function {
+		case AGG_COUNT_DISTINCT:
+			key := string(v.encode())
+			if s.distinct[key] {
+				return nil
+			}
+			s.distinct[key] = true
+		case AGG_SUM, AGG_AVG:
+			n, err := numericValue(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", a.name(), err)
+			}
+			if n.typ == TYPE_FLOAT {
+				s.float = true
+			}
+			// an int SUM that no longer fits an int64 is an error, not a wrapped sum
+			if a.function == AGG_SUM && !s.float {
+				sum, err := intArithmetic(EXPR_ADD, s.sum_i, n.i)
+				if err != nil {
+					return fmt.Errorf("%s: %w", a.name(), err)
+				}
+				s.sum_i = sum.i
+			}
+			s.sum_f += n.asFloat()
+		case AGG_MIN, AGG_MAX:
+			if !s.value.IsNull() {
+				c, err := compareValues(v, s.value)
+				if err != nil {
+					return fmt.Errorf("%s: %w", a.name(), err)
+				}
+				if (a.function == AGG_MIN && c >= 0) || (a.function == AGG_MAX && c <= 0) {
+					break
+				}
+			}
+			s.value = v
+		case AGG_USER:
+			var err error
+			if s.state, err = s.user.step(s.state, v); err != nil {
+				return fmt.Errorf("%s: %w", a.name(), err)
+			}
+	}
+	s.count += 1
+	return nil
+}
+
+func (s *aggregateState) result(a Aggregate) (Value, error) {
+	switch a.function {
+		case AGG_COUNT, AGG_COUNT_DISTINCT:
+			return IntValue(s.count), nil
+		case AGG_MIN, AGG_MAX:
+			return s.value, nil
+		case AGG_USER:
+			v, err := s.user.final(s.state)
+			if err != nil {
+				return Value{}, fmt.Errorf("%s: %w", a.name(), err)
+			}
+			return v, nil
+	}
+	if s.count == 0 {
+		return NullValue(), nil
+	}
+	if a.function == AGG_AVG {
+		return FloatValue(s.sum_f / float64(s.count)), nil
+	}
+	if s.float {
+		return FloatValue(s.sum_f), nil
+	}
+	return IntValue(s.sum_i), nil
+}
+
+/*
+AggregateNode groups the records of its child by the values of the group
+columns and returns a record per group with the group columns and the result of
+every aggregate, in the order the groups are first seen. Records whose group
+columns are NULL are in the same group. Without group columns the whole input
+is a single group, so COUNT(*) of no records is 0.
+
+Groups whose record does not satisfy having are left out.
+*/
+type AggregateNode struct {
+	output []*Record
+	i int
+	child *Iterator
+	group []string
+	aggregates []Aggregate
+	having *predicateTree
+	done bool
+}
+
+func initAggregateNode(child Iterator, group []string, aggregates []Aggregate,
+	having *predicateTree) *AggregateNode {
+	return &AggregateNode{ nil, 0, &child, group, aggregates, having, false }
+}
+
+func (a *AggregateNode) Open(ctx context.Context) error {
+	a.output = nil
+	a.i = 0
+	a.done = false
+	return (*a.child).Open(ctx)
+}
+
+func (a *AggregateNode) Close() error {
+	a.output = nil
+	return (*a.child).Close()
+}
+
+// groupKey encodes the group values of r. Every value is quoted, so distinct
+// groups never share a key whatever their values hold.
+func (a *AggregateNode) groupKey(r *Record) string {
+	key := ""
+	for _, col := range(a.group) {
+		key += strconv.Quote(string(r.getColumn(col).encode()))
+	}
+	return key
+}
+
+func (a *AggregateNode) Next() (*Record, error) {
+	if a.done {
+		if a.i >= len(a.output) {
+			return nil, nil
+		}
+		a.i += 1
+		return a.output[a.i - 1], nil
+	}
+	keys := make([]string, 0)
+	groups := make(map[string]*Record)
+	states := make(map[string][]*aggregateState)
+	if len(a.group) == 0 {
+		keys = append(keys, "")
+		groups[""] = &Record{ values: make(map[string]Value) }
+		var err error
+		if states[""], err = a.initStates(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		r, err := (*a.child).Next()
+		if err != nil {
+			return nil, err
+		}
+		if r == nil { break }
+		key := a.groupKey(r)
+		if _, ok := groups[key]; !ok {
+			group := &Record{ values: make(map[string]Value) }
+			for _, col := range(a.group) {
+				group.values[col] = r.getColumn(col)
+			}
+			keys = append(keys, key)
+			groups[key] = group
+			if states[key], err = a.initStates(); err != nil {
+				return nil, err
+			}
+		}
+		for i, agg := range(a.aggregates) {
+			if err := states[key][i].add(agg, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	a.output = make([]*Record, 0, len(keys))
+	for _, key := range(keys) {
+		r := groups[key]
+		for i, agg := range(a.aggregates) {
+			v, err := states[key][i].result(agg)
+			if err != nil {
+				return nil, err
+			}
+			r.values[agg.name()] = v
+		}
+		if a.having != nil {
+			truth, err := evaluatePredicates(a.having, r)
+			if err != nil {
+				return nil, err
+			}
+			if truth != TRUE {
+				continue
+			}
+		}
+		a.output = append(a.output, r)
+	}
+	a.done = true
+	return a.Next()
+}
+
+// initStates returns the states of a new group, an ErrInvalidPlan if a user
+// aggregate is no longer registered.
+func (a *AggregateNode) initStates() ([]*aggregateState, error) {
+	states := make([]*aggregateState, len(a.aggregates))
+	for i, agg := range(a.aggregates) {
+		states[i] = initAggregateState()
+		if agg.function == AGG_USER {
+			u, ok := lookupUserAggregate(agg.user)
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown aggregate function %s", ErrInvalidPlan, agg.user)
+			}
+			states[i].user, states[i].state = &u, u.Init()
+		}
+	}
+	return states, nil
+}
+
+func aggregateNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	group, aggregates, having, err := parseAggregateNodeArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	return initAggregateNode(c, group, aggregates, having), nil
+}
+
+/*
+AGGREGATE args are the columns to group by, the aggregates and an optional
+condition on the results, in the format of SELECTION args. An aggregate is
+returned in the column as, or in the column named by aggregateName:
+
+{
+	"group": ["Name"],
+	"aggregates": [
+		{ "function": "COUNT", "column": "*" },
+		{ "function": "AVG", "column": "Rating", "as": "Rating" },
+		{ "function": "COUNT_DISTINCT", "column": "Year" }
+	],
+	"having": { "AND": [{ "GT": ["Count", 1] }, { "GT_E": ["Rating", 3] }] }
+}
+
+The functions are COUNT, COUNT_DISTINCT, SUM, AVG, MIN and MAX, or one of
+UserAggregates; COUNT of the column * counts every record.
+*/
+func parseAggregateNodeArgs(args interface{}) ([]string, []Aggregate, *predicateTree, error) {
+	margs, ok := args.(map[string]interface{})
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: aggregate %v is not an object", ErrInvalidPlan, args)
+	}
+	group := make([]string, 0)
+	if margs["group"] != nil {
+		var err error
+		if group, err = parseColumnArgs("AGGREGATE", margs["group"]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	list, ok := margs["aggregates"].([]interface{})
+	if !ok && margs["aggregates"] != nil {
+		return nil, nil, nil, fmt.Errorf("%w: AGGREGATE expects a list of aggregates", ErrInvalidPlan)
+	}
+	aggregates := make([]Aggregate, 0)
+	names := append([]string{}, group...)
+	for _, v := range(list) {
+		a, err := parseAggregate(v)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, name := range(names) {
+			if name == a.name() {
+				return nil, nil, nil, fmt.Errorf("%w: AGGREGATE column %s is not unique",
+					ErrInvalidPlan, name)
+			}
+		}
+		names = append(names, a.name())
+		aggregates = append(aggregates, a)
+	}
+	var having *predicateTree
+	if margs["having"] != nil {
+		var err error
+		if having, err = parseSelectionNodeArgs(margs["having"]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return group, aggregates, having, nil
+}
+
+func parseAggregate(arg interface{}) (Aggregate, error) {
+	m, ok := arg.(map[string]interface{})
+	if !ok {
+		return Aggregate{}, fmt.Errorf("%w: aggregate %v is not an object", ErrInvalidPlan, arg)
+	}
+	name, _ := m["function"].(string)
+	function, ok := parseAggregateFunction(name)
+	user := ""
+	if _, user_ok := lookupUserAggregate(name); !ok && user_ok {
+		function, user, ok = AGG_USER, name, true
+	}
+	if !ok {
+		return Aggregate{}, fmt.Errorf("%w: unknown aggregate function %v", ErrInvalidPlan, m["function"])
+	}
+	column, ok := m["column"].(string)
+	if !ok || column == "" || (column == count_all && function != AGG_COUNT) {
+		return Aggregate{}, fmt.Errorf("%w: %s column %v is not a column", ErrInvalidPlan, name,
+			m["column"])
+	}
+	as, ok := m["as"].(string)
+	if !ok && m["as"] != nil {
+		return Aggregate{}, fmt.Errorf("%w: %s alias %v is not a string", ErrInvalidPlan, name, m["as"])
+	}
+	return Aggregate{ function, column, as, user }, nil
+}
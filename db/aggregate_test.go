@@ -0,0 +1,148 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"reflect"
+	"math"
+)
+
+func TestAggregateNode(t *testing.T) {
+	movies := []Record{
+		makeRecord("1", "a,b", "1", "2000"),
+		makeRecord("2", "a", "2", "2001"),
+		makeRecord("3", "a,b", "3", "2000"),
+		makeRecord("4", "a", "4", "2003"),
+		makeRecord("5", "a", "5", "2003"),
+	}
+	movies[4].values["Year"] = NullValue()
+	aggregates := []Aggregate{
+		{ AGG_COUNT, count_all, "", "" },
+		{ AGG_COUNT, "Year", "", "" },
+		{ AGG_COUNT_DISTINCT, "Year", "Years", "" },
+		{ AGG_SUM, "Id", "", "" },
+		{ AGG_AVG, "Year", "", "" },
+		{ AGG_MIN, "Year", "", "" },
+		{ AGG_MAX, "Id", "", "" },
+	}
+	agg := initAggregateNode(initStaticScan(movies), []string{ "Name" }, aggregates, nil)
+	expected := []Record{
+		{ values: map[string]Value{ "Name": StringValue("a,b"), "Count": IntValue(2),
+			"COUNT(Year)": IntValue(2), "Years": IntValue(1), "SUM(Id)": IntValue(4),
+			"AVG(Year)": FloatValue(2000), "MIN(Year)": StringValue("2000"), "MAX(Id)": StringValue("3") } },
+		{ values: map[string]Value{ "Name": StringValue("a"), "Count": IntValue(3),
+			"COUNT(Year)": IntValue(2), "Years": IntValue(2), "SUM(Id)": IntValue(11),
+			"AVG(Year)": FloatValue(2002), "MIN(Year)": StringValue("2001"), "MAX(Id)": StringValue("5") } },
+	}
+	actual := make([]Record, 0)
+	for r, err := agg.Next(); r != nil || err != nil; r, err = agg.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, *r)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+
+	having, _ := parseSelectionNodeArgs(map[string]interface{}{ "AND": map[string]interface{}{
+		"GT": []interface{}{ "Count", 2.0 } } })
+	agg = initAggregateNode(initStaticScan(movies), []string{ "Name" }, aggregates[:1], having)
+	if r, _ := agg.Next(); r == nil || r.values["Name"] != StringValue("a") {
+		t.Errorf("Expected group a. Actual %v", r)
+	}
+	if r, _ := agg.Next(); r != nil {
+		t.Errorf("Expected no record. Actual %v", r)
+	}
+
+	// without groups there is a single record, even for no input
+	agg = initAggregateNode(initStaticScan([]Record{}), nil, aggregates, nil)
+	r, err := agg.Next()
+	if err != nil || r == nil || r.values["Count"] != IntValue(0) || !r.values["SUM(Id)"].IsNull() {
+		t.Errorf("Expected Count 0 and a NULL sum. Actual %v %v", r, err)
+	}
+
+	movies[0].values["Id"] = BoolValue(true)
+	agg = initAggregateNode(initStaticScan(movies), nil, aggregates, nil)
+	if _, err := agg.Next(); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected %v. Actual %v", ErrTypeMismatch, err)
+	}
+
+	// an int sum past the range of int64 is an error, an average is not
+	movies[0].values["Id"] = IntValue(math.MaxInt64)
+	agg = initAggregateNode(initStaticScan(movies), nil, aggregates[3:4], nil)
+	if _, err := agg.Next(); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Expected %v. Actual %v", ErrOverflow, err)
+	}
+	agg = initAggregateNode(initStaticScan(movies), nil, []Aggregate{ { AGG_AVG, "Id", "", "" } }, nil)
+	if _, err := agg.Next(); err != nil {
+		t.Errorf("Expected no error. Actual %v", err)
+	}
+}
+
+func TestParseAggregateNodeArgs(t *testing.T) {
+	b := `{"head": { "name": "AGGREGATE", "args": {
+		"group": ["Name"],
+		"aggregates": [ { "function": "AVG", "column": "Rating", "as": "Rating" } ],
+		"having": { "AND": { "GT": ["Rating", 3] } }
+	}, "child": null } }`
+	a_t, _ := generateTree(b)
+	group, aggregates, having, err := parseAggregateNodeArgs(a_t.Head.Args)
+	if err != nil || !reflect.DeepEqual([]string{ "Name" }, group) ||
+		!reflect.DeepEqual([]Aggregate{ { AGG_AVG, "Rating", "Rating", "" } }, aggregates) || having == nil {
+		t.Errorf("Expected AVG(Rating) AS Rating by Name. Actual %v %v %v %v", group, aggregates, having, err)
+	}
+	for _, args := range([]interface{}{
+		[]interface{}{ "Name" },
+		map[string]interface{}{ "aggregates": []interface{}{ map[string]interface{}{ "function": "MEDIAN", "column": "Id" } } },
+		map[string]interface{}{ "aggregates": []interface{}{ map[string]interface{}{ "function": "SUM", "column": "*" } } },
+		map[string]interface{}{ "group": []interface{}{ "Count" },
+			"aggregates": []interface{}{ map[string]interface{}{ "function": "COUNT", "column": "*" } } },
+	}) {
+		if _, _, _, err := parseAggregateNodeArgs(args); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%v: Expected %v. Actual %v", args, ErrInvalidPlan, err)
+		}
+	}
+}
+
+func TestQueryAggregates(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Genre TEXT, Rating FLOAT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, genre := range([]string{ "drama", "comedy", "drama", "drama", "comedy", "horror" }) {
+		if err := db.Put("movies", map[string]any{ "Id": i, "Genre": genre, "Rating": float64(i) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.Query(`SELECT Genre, COUNT(*) AS Movies, AVG(Rating) FROM movies WHERE Id > 0
+		GROUP BY Genre HAVING COUNT(*) > 1 ORDER BY AVG(Rating) DESC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	expected := [][]Value{
+		{ StringValue("comedy"), IntValue(2), FloatValue(2.5) },
+		{ StringValue("drama"), IntValue(2), FloatValue(2.5) },
+	}
+	actual := make([][]Value, 0)
+	for rows.Next() {
+		r := rows.Record()
+		row := make([]Value, 0)
+		for _, col := range([]string{ "Genre", "Movies", "AVG(Rating)" }) {
+			v, _ := r.Value(col)
+			row = append(row, v)
+		}
+		actual = append(actual, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+}
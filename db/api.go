@@ -0,0 +1,346 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+/*
+Options of the tables of a DB opened with Open. The zero value of a field
+means its default.
+
+PageSize: rows never straddle a page of this many bytes.
+MaxFileSize: size of each data and index file of the table.
+IndexFanOut: order of the B-tree index of each file.
+NoSync: do not fsync the write-ahead log on every write. A crash may lose the
+last writes, never corrupt the table.
+SortMemory: bytes of records a SORT holds in memory before spilling sorted runs
+to temporary files, 64MB by default. A negative value never spills.
+
+The layout options only apply when the table is created; an existing table
+keeps the layout it was written with.
+*/
+type Options struct {
+	PageSize uint32
+	MaxFileSize uint32
+	IndexFanOut int
+	NoSync bool
+	SortMemory int
+}
+
+func (o *Options) sortMemory() int {
+	if o == nil {
+		return 0
+	}
+	return o.SortMemory
+}
+
+func (o *Options) storageOptions() *StorageOptions {
+	opts := defaultStorageOptions()
+	if o == nil {
+		return opts
+	}
+	if o.PageSize != 0 {
+		opts.page_size = o.PageSize
+	}
+	if o.MaxFileSize != 0 {
+		opts.max_file_size = o.MaxFileSize
+	}
+	if o.IndexFanOut != 0 {
+		opts.index_fan_out = o.IndexFanOut
+	}
+	if o.NoSync {
+		opts.wal_sync = WAL_SYNC_NONE
+	}
+	return opts
+}
+
+/*
+DB is a data directory holding tables, listed with their schema in its
+catalog. A DB is not safe for concurrent use and a directory must only be
+opened by one DB at a time.
+*/
+type DB struct {
+	dir string
+	opts *Options
+	catalog *Catalog
+	writers map[string]*StorageWriter
+}
+
+// Open opens the data directory dir, creating it if it does not exist. nil
+// opts means the default options.
+func Open(dir string, opts *Options) (*DB, error) {
+	if err := os.MkdirAll(dir, permission); err != nil {
+		return nil, err
+	}
+	catalog, err := openCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{ dir, opts, catalog, make(map[string]*StorageWriter) }, nil
+}
+
+// Close flushes the tables to disk and closes their files.
+func (db *DB) Close() error {
+	var errs []error
+	for name, w := range(db.writers) {
+		errs = append(errs, w.Flush())
+		delete(db.writers, name)
+	}
+	return errors.Join(errs...)
+}
+
+// Exec runs a CREATE TABLE or a DROP TABLE statement.
+func (db *DB) Exec(statement string) error {
+	s, err := parseStatement(statement)
+	if err != nil {
+		return err
+	}
+	if s.create != nil {
+		return db.CreateTable(*s.create)
+	}
+	if s.drop != "" {
+		return db.DropTable(s.drop)
+	}
+	return fmt.Errorf("%w: Exec does not run queries, use Query", ErrSyntax)
+}
+
+// CreateTable adds the table t to the catalog, or returns ErrTableExists.
+func (db *DB) CreateTable(t TableSchema) error {
+	w, err := db.catalog.create(&t, db.opts.storageOptions())
+	if err != nil {
+		return err
+	}
+	db.writers[t.Name] = w
+	return nil
+}
+
+// DropTable deletes the table name and its rows.
+func (db *DB) DropTable(name string) error {
+	if w, ok := db.writers[name]; ok {
+		delete(db.writers, name)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return db.catalog.drop(name)
+}
+
+// schema returns the schema of the table name and its writer, which is opened
+// on first use.
+func (db *DB) schema(name string) (*TableSchema, *StorageWriter, error) {
+	t, ok := db.catalog.table(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	if w, ok := db.writers[name]; ok {
+		return t, w, nil
+	}
+	w, err := openStorageWriter(db.catalog.tableDir(name), true, db.opts.storageOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+	db.writers[name] = w
+	return t, w, nil
+}
+
+// Put writes the row of the table with the given columns, replacing the row
+// with the same primary key if there is one. Omitted columns are NULL, so only
+// the primary key and NOT NULL columns need a value. Values are converted to
+// the type of their column. A value is a Value or a string, []byte, bool, int,
+// int32, int64, uint32, float32, float64 or time.Time. Rows that do not match the schema are an ErrColumnNotFound,
+// ErrTypeMismatch or ErrSchema.
+func (db *DB) Put(table string, values map[string]any) error {
+	t, w, err := db.schema(table)
+	if err != nil {
+		return err
+	}
+	row := make(map[string]Value, len(values))
+	for name, v := range(values) {
+		if row[name], err = toValue(v); err != nil {
+			return fmt.Errorf("column %s: %w", name, err)
+		}
+	}
+	d, err := t.row(row)
+	if err != nil {
+		return err
+	}
+	return w.Write(d)
+}
+
+// Get returns the row of the table with the given primary key, or
+// ErrKeyNotFound.
+func (db *DB) Get(table string, key any) (*Record, error) {
+	k, w, err := db.key(table, key)
+	if err != nil {
+		return nil, err
+	}
+	seg, start, ok, err := w.locate(k)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, k)
+	}
+	d, _, _, _, err := seg.readRowAt(start)
+	if err != nil {
+		return nil, err
+	}
+	return dataToRecord(d), nil
+}
+
+// Delete deletes the row of the table with the given primary key, or returns
+// ErrKeyNotFound.
+func (db *DB) Delete(table string, key any) error {
+	k, w, err := db.key(table, key)
+	if err != nil {
+		return err
+	}
+	return w.Delete(k)
+}
+
+func (db *DB) key(table string, key any) (string, *StorageWriter, error) {
+	t, w, err := db.schema(table)
+	if err != nil {
+		return "", nil, err
+	}
+	v, err := toValue(key)
+	if err != nil {
+		return "", nil, err
+	}
+	k, err := t.key(v)
+	return k, w, err
+}
+
+// Scan returns the rows of the table with lo <= key < hi in key order. Keys
+// are compared as strings and an empty bound is open.
+func (db *DB) Scan(table string, lo string, hi string) (*Rows, error) {
+	source, err := db.catalog.source(table)
+	if err != nil {
+		return nil, err
+	}
+	return db.run(context.Background(), &IndexScan{ source: source, lo: lo, hi: hi })
+}
+
+// Query runs a SQL query or a JSON plan. Tables are looked up in the catalog.
+func (db *DB) Query(plan string) (*Rows, error) {
+	return db.QueryContext(context.Background(), plan)
+}
+
+// QueryContext is Query whose execution stops once ctx is done.
+func (db *DB) QueryContext(ctx context.Context, plan string) (*Rows, error) {
+	var t *Tree
+	plan = strings.TrimSpace(plan)
+	if strings.HasPrefix(plan, "{") {
+		var err error
+		if t, err = generateTree(plan); err != nil {
+			return nil, err
+		}
+	} else {
+		s, err := parseStatement(plan)
+		if err != nil {
+			return nil, err
+		}
+		if s.query == nil {
+			return nil, fmt.Errorf("%w: Query only runs queries, use Exec", ErrSyntax)
+		}
+		t = s.query
+	}
+	it, err := Engine{ Registry, db.catalog, db.opts.sortMemory() }.Compile(t)
+	if err != nil {
+		return nil, err
+	}
+	return db.run(ctx, it)
+}
+
+func (db *DB) run(ctx context.Context, it Iterator) (*Rows, error) {
+	if err := it.Open(ctx); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return &Rows{ it: it }, nil
+}
+
+/*
+Rows is a cursor over the result of a query:
+
+	rows, err := db.Query("SELECT * FROM movies;")
+	...
+	defer rows.Close()
+	for rows.Next() {
+		r := rows.Record()
+		...
+	}
+	if err := rows.Err(); err != nil {
+		...
+	}
+*/
+type Rows struct {
+	it Iterator
+	record *Record
+	err error
+	closed bool
+}
+
+// Next moves to the next record. It returns false at the end of the result or
+// on an error, after which the rows are closed.
+func (r *Rows) Next() bool {
+	if r.closed {
+		return false
+	}
+	r.record, r.err = r.it.Next()
+	if r.record == nil || r.err != nil {
+		r.record = nil
+		if err := r.Close(); r.err == nil {
+			r.err = err
+		}
+		return false
+	}
+	return true
+}
+
+// Record returns the current record.
+func (r *Rows) Record() *Record {
+	return r.record
+}
+
+// Err returns the error that stopped Next, if any.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close releases the files read by the query. It can be called more than once.
+func (r *Rows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.it.Close()
+}
+
+// Key returns the row key of the record, empty for a record a PROJECTION or a
+// COUNT made.
+func (r *Record) Key() string {
+	return r.key
+}
+
+// Value returns the value of the given column of the record and whether the
+// record has the column. A missing column is NULL.
+func (r *Record) Value(column string) (Value, bool) {
+	_, ok := r.values[column]
+	return r.getColumn(column), ok || column == row_key_column
+}
+
+// Columns returns the names of the columns of the record in alphabetical order.
+func (r *Record) Columns() []string {
+	cols := make([]string, 0, len(r.values))
+	for name := range(r.values) {
+		cols = append(cols, name)
+	}
+	slices.Sort(cols)
+	return cols
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+func TestOpenPutGetDelete(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Name STRING, Year INT);"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := db.Put("movies", map[string]any{ "Id": i, "Name": fmt.Sprintf("Movie %d", i), "Year": 2000 + i }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("movies", map[string]any{ "Id": "2", "Name": "Movie Two", "Year": 2002 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("movies", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("movies", 4); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected %v. Actual %v", ErrKeyNotFound, err)
+	}
+	if _, err := db.Get("movies", 4); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected %v. Actual %v", ErrKeyNotFound, err)
+	}
+	r, err := db.Get("movies", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.Value("Name"); r.Key() != "2" || v != StringValue("Movie Two") {
+		t.Errorf("Expected Movie Two. Actual %v", r)
+	}
+	if cols := r.Columns(); !slices.Equal([]string{ "Id", "Name", "Year" }, cols) {
+		t.Errorf("Expected [Id Name Year]. Actual %v", cols)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen and read through the cursors
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Scan("movies", "2", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := rowKeys(t, rows); !slices.Equal([]string{ "2", "3" }, keys) {
+		t.Errorf("Expected [2 3]. Actual %v", keys)
+	}
+	rows, err = db.Query("SELECT * FROM movies WHERE Year >= '2003';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := rowKeys(t, rows); !slices.Equal([]string{ "3", "5" }, keys) {
+		t.Errorf("Expected [3 5]. Actual %v", keys)
+	}
+	if _, err := db.Query("SELECT * FROM"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected %v. Actual %v", ErrSyntax, err)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Name TEXT NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		values map[string]any
+		expected error
+	}{
+		{ map[string]any{ "Id": 1, "Name": "Movie", "Year": 2000 }, ErrColumnNotFound },
+		{ map[string]any{ "Id": "one", "Name": "Movie" }, ErrTypeMismatch },
+		{ map[string]any{ "Id": 1, "Name": true }, ErrTypeMismatch },
+		{ map[string]any{ "Id": 1 }, ErrSchema },
+		{ map[string]any{ "Id": 1, "Name": nil }, ErrSchema },
+		{ map[string]any{ "Name": "Movie" }, ErrSchema },
+	}
+	for _, c := range(cases) {
+		if err := db.Put("movies", c.values); !errors.Is(err, c.expected) {
+			t.Errorf("%v: Expected %v. Actual %v", c.values, c.expected, err)
+		}
+	}
+	if err := db.Put("shows", map[string]any{ "Id": 1 }); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Expected %v. Actual %v", ErrTableNotFound, err)
+	}
+	for statement, expected := range(map[string]error{
+		"CREATE TABLE movies (Id INT PRIMARY KEY)": ErrTableExists,
+		"CREATE TABLE shows (Id INT, Name TEXT)": ErrSchema,
+		"CREATE TABLE shows (Id INT PRIMARY KEY, Id TEXT)": ErrSchema,
+		"CREATE TABLE shows (Id UUID PRIMARY KEY)": ErrSyntax,
+		"DROP TABLE shows": ErrTableNotFound,
+		"SELECT * FROM movies": ErrSyntax,
+	}) {
+		if err := db.Exec(statement); !errors.Is(err, expected) {
+			t.Errorf("%s: Expected %v. Actual %v", statement, expected, err)
+		}
+	}
+	if err := db.Exec("DROP TABLE movies"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Query("SELECT * FROM movies"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Expected %v. Actual %v", ErrTableNotFound, err)
+	}
+}
+
+func rowKeys(t *testing.T, rows *Rows) []string {
+	t.Helper()
+	defer rows.Close()
+	keys := make([]string, 0)
+	for rows.Next() {
+		keys = append(keys, rows.Record().Key())
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -2,7 +2,7 @@ package db
 
 import (
 	"fmt"
-	//"slices"
+	"slices"
 	"strings"
 	"iter"
 )
@@ -22,6 +22,7 @@ type IndexRecord struct {
 type TreeNode interface {
 	Insert(k string, v string) bool
 	Find(k string) (string, error)
+	Delete(k string) bool
 	Balance() bool
 	SetParent(p TreeNode)
 	SetSibling(p TreeNode)
@@ -35,6 +36,7 @@ type TreeNode interface {
 	NeedBalance() bool
 	IsRootNode() bool
 	All() iter.Seq[TreeNode]
+	Range(lo string, hi string) iter.Seq2[string, string]
 	GetIndexRecord() []*IndexRecord
 }
 
@@ -278,6 +280,9 @@ func (n *RootNode) Balance() bool {
 }
 
 func (n *RootNode) Find(k string) (string, error) {
+	if n.child == nil {
+		return "", &NotFoundError{ fmt.Sprintf("No record found for %s",k) }
+	}
 	return n.child.Find(k)
 }
 
@@ -315,9 +320,9 @@ func (n *LeafNode) Balance() bool {
 		internal_node.AddChild(n)
 		n.SetParent(internal_node)
 	}
-	internal_node.AddKey(mid_key)
-	internal_node.AddChild(right_node)
+	internal_node.(*InternalNode).insertChild(n, mid_key, right_node)
 	right_node.SetParent(internal_node)
+	right_node.SetSibling(n.sibling)
 	n.sibling = right_node
 
 	if n.parent != nil && n.parent.NeedBalance() {
@@ -356,8 +361,7 @@ func (n *InternalNode) Balance() bool {
 		internal_node.AddChild(n)
 		n.SetParent(internal_node)
 	}
-	internal_node.AddKey(mid_key)
-	internal_node.AddChild(right_node)
+	internal_node.(*InternalNode).insertChild(n, mid_key, right_node)
 	right_node.SetParent(internal_node)
 
 	if n.parent != nil && n.parent.NeedBalance() {
@@ -366,12 +370,25 @@ func (n *InternalNode) Balance() bool {
 	return true
 }
 
+// insertChild adds k and the child c right after the existing child left, so
+// keys and children stay ordered.
+func (n *InternalNode) insertChild(left TreeNode, k string, c TreeNode) {
+	i := slices.Index(n.children, left)
+	n.keys = slices.Insert(n.keys, i, k)
+	n.children = slices.Insert(n.children, i + 1, c)
+}
+
 func (n *InternalNode) Insert(k string, v string) bool {
 	i, _ := BinarySearch(n.keys, k, 0, len(n.keys), CHILDREN)
 	return n.children[i].Insert(k, v)
 }
 
+// Insert adds k to the leaf, or replaces its value if k is already there.
 func (n *LeafNode) Insert(k string, v string) bool {
+	if i := slices.Index(n.keys, k); i >= 0 {
+		n.values[i] = v
+		return true
+	}
 	if (len(n.keys) + 1) >= n.m {
 		n.keys = append(n.keys, k)
 		n.values = append(n.values, v)
@@ -390,6 +407,9 @@ func (n *InternalNode) Find(k string) (string, error) {
 }
 
 func (n *LeafNode) Find(k string) (string, error) {
+	if len(n.keys) == 0 {
+		return "", &NotFoundError{ fmt.Sprintf("No record found for %s",k) }
+	}
 	i, found := BinarySearch(n.keys, k, 0, len(n.keys), VALUE)
 	if !found {
 		return "", &NotFoundError{ fmt.Sprintf("No record found for %s",k) }
@@ -397,10 +417,160 @@ func (n *LeafNode) Find(k string) (string, error) {
 	return n.values[i], nil
 }
 
+func (n *RootNode) Delete(k string) bool {
+	if n.child == nil { return false }
+	return n.child.Delete(k)
+}
+
+func (n *InternalNode) Delete(k string) bool {
+	i, _ := BinarySearch(n.keys, k, 0, len(n.keys), CHILDREN)
+	return n.children[i].Delete(k)
+}
+
+// Delete removes k from the leaf. A leaf left with fewer than minKeys keys
+// borrows a key from a sibling or is merged with it.
+func (n *LeafNode) Delete(k string) bool {
+	if len(n.keys) == 0 { return false }
+	i, found := BinarySearch(n.keys, k, 0, len(n.keys), VALUE)
+	if !found { return false }
+	n.keys = slices.Delete(n.keys, i, i + 1)
+	n.values = slices.Delete(n.values, i, i + 1)
+	n.underflow()
+	return true
+}
+
+// minKeys is the fewest keys a node other than the top one can hold. Two
+// siblings at or below it always fit in a single node.
+func minKeys(m int) int {
+	return (m - 1) / 2
+}
+
+func (n *LeafNode) underflow() {
+	if root, ok := n.parent.(*RootNode); ok {
+		if len(n.keys) == 0 {
+			root.child = nil
+		}
+		return
+	}
+	if len(n.keys) >= minKeys(n.m) { return }
+	parent := n.parent.(*InternalNode)
+	i := slices.Index(parent.children, TreeNode(n))
+	if i > 0 {
+		left := parent.children[i - 1].(*LeafNode)
+		if len(left.keys) > minKeys(n.m) {
+			last := len(left.keys) - 1
+			n.keys = slices.Insert(n.keys, 0, left.keys[last])
+			n.values = slices.Insert(n.values, 0, left.values[last])
+			left.keys = left.keys[:last]
+			left.values = left.values[:last]
+			parent.keys[i - 1] = n.keys[0]
+			return
+		}
+	}
+	if i < len(parent.children) - 1 {
+		right := parent.children[i + 1].(*LeafNode)
+		if len(right.keys) > minKeys(n.m) {
+			n.keys = append(n.keys, right.keys[0])
+			n.values = append(n.values, right.values[0])
+			right.keys = slices.Delete(right.keys, 0, 1)
+			right.values = slices.Delete(right.values, 0, 1)
+			parent.keys[i] = right.keys[0]
+			return
+		}
+	}
+	if i > 0 {
+		left := parent.children[i - 1].(*LeafNode)
+		left.merge(n)
+		parent.removeChild(i)
+	} else {
+		right := parent.children[i + 1].(*LeafNode)
+		n.merge(right)
+		parent.removeChild(i + 1)
+	}
+	parent.underflow()
+}
+
+// merge moves every key of the right sibling r into n.
+func (n *LeafNode) merge(r *LeafNode) {
+	n.keys = append(n.keys, r.keys...)
+	n.values = append(n.values, r.values...)
+	n.sibling = r.sibling
+}
+
+// removeChild drops the i-th child together with the key separating it from
+// its left sibling.
+func (n *InternalNode) removeChild(i int) {
+	n.keys = slices.Delete(n.keys, i - 1, i)
+	n.children = slices.Delete(n.children, i, i + 1)
+}
+
+func (n *InternalNode) underflow() {
+	if root, ok := n.parent.(*RootNode); ok {
+		// the top node has a single child left, which becomes the top node
+		if len(n.keys) == 0 {
+			root.child = n.children[0]
+			root.child.SetParent(root)
+		}
+		return
+	}
+	if len(n.keys) >= minKeys(n.m) { return }
+	parent := n.parent.(*InternalNode)
+	i := slices.Index(parent.children, TreeNode(n))
+	if i > 0 {
+		left := parent.children[i - 1].(*InternalNode)
+		if len(left.keys) > minKeys(n.m) {
+			last := len(left.keys) - 1
+			child := left.children[last + 1]
+			n.keys = slices.Insert(n.keys, 0, parent.keys[i - 1])
+			n.children = slices.Insert(n.children, 0, child)
+			child.SetParent(n)
+			parent.keys[i - 1] = left.keys[last]
+			left.keys = left.keys[:last]
+			left.children = left.children[:last + 1]
+			return
+		}
+	}
+	if i < len(parent.children) - 1 {
+		right := parent.children[i + 1].(*InternalNode)
+		if len(right.keys) > minKeys(n.m) {
+			child := right.children[0]
+			n.keys = append(n.keys, parent.keys[i])
+			n.children = append(n.children, child)
+			child.SetParent(n)
+			parent.keys[i] = right.keys[0]
+			right.keys = slices.Delete(right.keys, 0, 1)
+			right.children = slices.Delete(right.children, 0, 1)
+			return
+		}
+	}
+	if i > 0 {
+		left := parent.children[i - 1].(*InternalNode)
+		left.merge(parent.keys[i - 1], n)
+		parent.removeChild(i)
+	} else {
+		right := parent.children[i + 1].(*InternalNode)
+		n.merge(parent.keys[i], right)
+		parent.removeChild(i + 1)
+	}
+	parent.underflow()
+}
+
+// merge pulls the separator k down from the parent and moves every key and
+// child of the right sibling r into n.
+func (n *InternalNode) merge(k string, r *InternalNode) {
+	n.keys = append(n.keys, k)
+	n.keys = append(n.keys, r.keys...)
+	for _, c := range(r.children) {
+		c.SetParent(n)
+	}
+	n.children = append(n.children, r.children...)
+}
+
 func (root *RootNode) All() iter.Seq[TreeNode]{
 	return func(yield func(TreeNode) bool) {
+		if root.child == nil { return }
 		for n := range root.child.All() {
-			yield(n)
+			if !yield(n) { return }
 		}
 	}
 }
@@ -408,7 +578,9 @@ func (root *RootNode) All() iter.Seq[TreeNode]{
 func (n *InternalNode) All() iter.Seq[TreeNode]{
 	return func(yield func(TreeNode) bool) {
 		for _, c := range n.children {
-			yield(c)
+			for l := range c.All() {
+				if !yield(l) { return }
+			}
 		}
 	}
 }
@@ -418,3 +590,37 @@ func (n *LeafNode) All() iter.Seq[TreeNode]{
 		yield(n)
 	}
 }
+
+/*
+Range yields the keys k, and their values, with lo <= k < hi in order. An
+empty lo or hi leaves that end of the range open. It descends to the leaf
+holding lo once and then follows the sibling links of the leaves.
+*/
+func (root *RootNode) Range(lo string, hi string) iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if root.child == nil { return }
+		for k, v := range root.child.Range(lo, hi) {
+			if !yield(k, v) { return }
+		}
+	}
+}
+
+func (n *InternalNode) Range(lo string, hi string) iter.Seq2[string, string] {
+	i := 0
+	if lo != "" {
+		i, _ = BinarySearch(n.keys, lo, 0, len(n.keys), CHILDREN)
+	}
+	return n.children[i].Range(lo, hi)
+}
+
+func (n *LeafNode) Range(lo string, hi string) iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for leaf := n; leaf != nil; leaf, _ = leaf.sibling.(*LeafNode) {
+			for i, k := range(leaf.keys) {
+				if k < lo { continue }
+				if hi != "" && k >= hi { return }
+				if !yield(k, leaf.values[i]) { return }
+			}
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"math/rand"
 	"time"
 	"reflect"
-	//"fmt"
+	"fmt"
 )
 
 func TestIterator(t *testing.T) {
@@ -250,3 +250,188 @@ func generateStringArrays(m int, n int) []string {
 	return vals
 }
 
+
+func TestDeleteFromLeaf(t *testing.T) {
+	root := newRootNode(3)
+	root.Insert("1", "1")
+	root.Insert("2", "2")
+	root.Insert("3", "3")
+
+	if !root.Delete("2") {
+		t.Errorf("Expected 2 to be deleted")
+	}
+	if root.Delete("4") {
+		t.Errorf("Expected 4 to not be found")
+	}
+	if _, err := root.Find("2"); err == nil {
+		t.Errorf("Expected 2 to not be found after delete")
+	}
+	if actual, _ := root.Find("3"); actual != "3" {
+		t.Errorf("Expected %v. Actual %v", 3, actual)
+	}
+}
+
+// checkTree verifies the B+tree invariants: ordered keys bounded by their
+// separators, occupancy between minKeys and m - 1 outside of the top node,
+// consistent parent pointers, leaves at the same depth and a sibling chain
+// visiting every leaf in order.
+func checkTree(t *testing.T, root TreeNode, m int) []string {
+	t.Helper()
+	r := root.(*RootNode)
+	if r.child == nil { return []string{} }
+	leaves := make([]*LeafNode, 0)
+	depth := -1
+	var check func(n TreeNode, parent TreeNode, lo string, hi string, level int)
+	check = func(n TreeNode, parent TreeNode, lo string, hi string, level int) {
+		var keys []string
+		switch node := n.(type) {
+		case *LeafNode:
+			keys = node.keys
+			if node.parent != parent {
+				t.Errorf("Leaf %v has the wrong parent", node)
+			}
+			if depth == -1 { depth = level }
+			if depth != level {
+				t.Errorf("Leaf %v at depth %d. Expected %d", node, level, depth)
+			}
+			leaves = append(leaves, node)
+		case *InternalNode:
+			keys = node.keys
+			if node.parent != parent {
+				t.Errorf("Internal node %v has the wrong parent", node)
+			}
+			if len(node.children) != len(node.keys) + 1 {
+				t.Errorf("Internal node %v has %d keys and %d children", node,
+					len(node.keys), len(node.children))
+				return
+			}
+			for i, c := range(node.children) {
+				c_lo, c_hi := lo, hi
+				if i > 0 { c_lo = node.keys[i - 1] }
+				if i < len(node.keys) { c_hi = node.keys[i] }
+				check(c, node, c_lo, c_hi, level + 1)
+			}
+		}
+		if !slices.IsSorted(keys) {
+			t.Errorf("Keys %v are not sorted", keys)
+		}
+		if len(keys) > m - 1 {
+			t.Errorf("Node %v has more than %d keys", n, m - 1)
+		}
+		if level > 0 && len(keys) < minKeys(m) {
+			t.Errorf("Node %v has fewer than %d keys", n, minKeys(m))
+		}
+		for _, k := range(keys) {
+			if (lo != "" && k < lo) || (hi != "" && k >= hi) {
+				t.Errorf("Key %s of %v is outside of [%s, %s)", k, n, lo, hi)
+			}
+		}
+	}
+	check(r.child, r, "", "", 0)
+
+	all := make([]string, 0)
+	for i, l := range(leaves) {
+		all = append(all, l.keys...)
+		var expected TreeNode
+		if i < len(leaves) - 1 { expected = leaves[i + 1] }
+		if l.sibling != expected {
+			t.Errorf("Leaf %v has sibling %v. Expected %v", l, l.sibling, expected)
+		}
+	}
+	return all
+}
+
+func TestDeleteRebalances(t *testing.T) {
+	for _, m := range([]int{ 3, 4, 5, 8 }) {
+		root := newRootNode(m)
+		keys := make([]string, 0)
+		for _, i := range(rand.Perm(200)) {
+			k := fmt.Sprintf("%04d", i)
+			keys = append(keys, k)
+			root.Insert(k, k)
+		}
+		expected := slices.Clone(keys)
+		slices.Sort(expected)
+		if actual := checkTree(t, root, m); !slices.Equal(expected, actual) {
+			t.Fatalf("m=%d: Expected %v. Actual %v", m, expected, actual)
+		}
+
+		deleted := make(map[string]bool)
+		for _, i := range(rand.Perm(len(keys))) {
+			k := keys[i]
+			if !root.Delete(k) {
+				t.Fatalf("m=%d: Failed to delete %s", m, k)
+			}
+			deleted[k] = true
+			expected = slices.DeleteFunc(expected, func(e string) bool { return e == k })
+			if actual := checkTree(t, root, m); !slices.Equal(expected, actual) {
+				t.Fatalf("m=%d: Expected %v. Actual %v", m, expected, actual)
+			}
+			if len(expected) % 25 == 0 {
+				for _, key := range(keys) {
+					v, err := root.Find(key)
+					if deleted[key] && err == nil {
+						t.Errorf("m=%d: Expected %s to be deleted", m, key)
+					}
+					if !deleted[key] && v != key {
+						t.Errorf("m=%d: Expected %s. Actual %s", m, key, v)
+					}
+				}
+			}
+		}
+		if root.(*RootNode).child != nil {
+			t.Errorf("m=%d: Expected an empty tree. Actual %v", m, root)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	root := newRootNode(3)
+	keys := make([]string, 0)
+	for _, i := range(rand.Perm(50)) {
+		k := fmt.Sprintf("%02d", i)
+		root.Insert(k, "v" + k)
+	}
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("%02d", i))
+	}
+
+	cases := []struct {
+		lo string
+		hi string
+		expected []string
+	}{
+		{ "10", "20", keys[10:20] },
+		{ "", "05", keys[:5] },
+		{ "45", "", keys[45:] },
+		{ "", "", keys },
+		{ "105", "13", keys[11:13] },
+		{ "20", "20", []string{} },
+	}
+	for _, c := range(cases) {
+		actual := make([]string, 0)
+		for k, v := range root.Range(c.lo, c.hi) {
+			if v != "v" + k {
+				t.Errorf("Expected value v%s. Actual %s", k, v)
+			}
+			actual = append(actual, k)
+		}
+		if !slices.Equal(c.expected, actual) {
+			t.Errorf("Range [%s, %s). Expected %v. Actual %v", c.lo, c.hi, c.expected, actual)
+		}
+	}
+
+	// stopping early
+	n := 0
+	for range root.Range("", "") {
+		n++
+		if n == 3 { break }
+	}
+	if n != 3 {
+		t.Errorf("Expected 3. Actual %d", n)
+	}
+
+	for k := range newRootNode(3).Range("", "") {
+		t.Errorf("Expected an empty range. Actual %s", k)
+	}
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+The catalog lists the tables of a data directory with their schema. It is
+stored as JSON in the file catalog of the directory:
+
+{
+	"tables": [
+		{
+			"name": "movies",
+			"columns": [
+				{ "name": "Id", "type": "int", "not_null": true },
+				{ "name": "Name", "type": "string" }
+			],
+			"primary_key": "Id"
+		}
+	]
+}
+
+The rows of a table are stored in the subdirectory of the same name, whose
+manifest lists the segments of the table. The row key is the value of the
+primary key column as a string, so rows are indexed in string order.
+
+Subdirectories holding a table that is not in the catalog are tables without a
+schema: they can be queried by name but not written.
+*/
+type Catalog struct {
+	dir string
+	Tables []*TableSchema `json:"tables"`
+}
+
+type TableSchema struct {
+	Name string `json:"name"`
+	Columns []ColumnSchema `json:"columns"`
+	PrimaryKey string `json:"primary_key"`
+}
+
+type ColumnSchema struct {
+	Name string `json:"name"`
+	Type ValueType `json:"type"`
+	NotNull bool `json:"not_null,omitempty"`
+}
+
+func catalogPath(dir string) string {
+	return filepath.Join(dir, "catalog")
+}
+
+func openCatalog(dir string) (*Catalog, error) {
+	c := &Catalog{ dir, make([]*TableSchema, 0) }
+	data, err := os.ReadFile(catalogPath(dir))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptFile, catalogPath(dir), err)
+	}
+	return c, nil
+}
+
+// save replaces the catalog file, through a temporary file so that a crash
+// leaves either the old or the new catalog.
+func (c *Catalog) save() error {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := catalogPath(c.dir) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, permission)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err = errors.Join(err, f.Close()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, catalogPath(c.dir))
+}
+
+func (c *Catalog) table(name string) (*TableSchema, bool) {
+	for _, t := range(c.Tables) {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func (c *Catalog) tableDir(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(c.dir, name)
+}
+
+// names returns the tables of the catalog followed by the tables without a
+// schema, in alphabetical order.
+func (c *Catalog) names() ([]string, error) {
+	names := make([]string, 0)
+	for _, t := range(c.Tables) {
+		names = append(names, t.Name)
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range(entries) {
+		if e.IsDir() && !slices.Contains(names, e.Name()) && isTableDir(c.tableDir(e.Name())) {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// source returns the files to scan for the table name.
+func (c *Catalog) source(name string) (*tableSource, error) {
+	dir := c.tableDir(name)
+	if _, ok := c.table(name); !ok && !isTableDir(dir) {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	return &tableSource{ dir, 0 }, nil
+}
+
+// isTableDir reports whether dir holds the files of a table.
+func isTableDir(dir string) bool {
+	for _, name := range([]string{ manifestPath(dir), dataPath(dir, 0) }) {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// create adds the table t to the catalog and creates its first segment with
+// opts. The returned writer writes to the table.
+func (c *Catalog) create(t *TableSchema, opts *StorageOptions) (*StorageWriter, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	dir := c.tableDir(t.Name)
+	if _, ok := c.table(t.Name); ok || isTableDir(dir) {
+		return nil, fmt.Errorf("%w: %s", ErrTableExists, t.Name)
+	}
+	if err := os.MkdirAll(dir, permission); err != nil {
+		return nil, err
+	}
+	w, err := openStorageWriter(dir, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.Tables = append(c.Tables, t)
+	if err := c.save(); err != nil {
+		c.Tables = c.Tables[:len(c.Tables) - 1]
+		return nil, errors.Join(err, w.Flush())
+	}
+	return w, nil
+}
+
+// drop removes the table name from the catalog and deletes its files.
+func (c *Catalog) drop(name string) error {
+	i := slices.IndexFunc(c.Tables, func(t *TableSchema) bool { return t.Name == name })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	c.Tables = slices.Delete(c.Tables, i, i + 1)
+	if err := c.save(); err != nil {
+		return err
+	}
+	return os.RemoveAll(c.tableDir(name))
+}
+
+func (t *TableSchema) validate() error {
+	if t.Name == "" || strings.ContainsAny(t.Name, `/\`) || t.Name == "." || t.Name == ".." {
+		return fmt.Errorf("%w: invalid table name %q", ErrSchema, t.Name)
+	}
+	if len(t.Columns) == 0 {
+		return fmt.Errorf("%w: table %s has no columns", ErrSchema, t.Name)
+	}
+	seen := make([]string, 0)
+	for _, col := range(t.Columns) {
+		if col.Name == "" || col.Name == row_key_column || slices.Contains(seen, col.Name) {
+			return fmt.Errorf("%w: invalid or duplicate column %q in table %s", ErrSchema,
+				col.Name, t.Name)
+		}
+		if _, ok := value_type_names[col.Type]; !ok || col.Type == TYPE_NULL {
+			return fmt.Errorf("%w: column %s has an unknown type", ErrSchema, col.Name)
+		}
+		seen = append(seen, col.Name)
+	}
+	if !slices.Contains(seen, t.PrimaryKey) {
+		return fmt.Errorf("%w: table %s has no primary key column", ErrSchema, t.Name)
+	}
+	return nil
+}
+
+func (t *TableSchema) column(name string) (ColumnSchema, bool) {
+	for _, col := range(t.Columns) {
+		if col.Name == name {
+			return col, true
+		}
+	}
+	return ColumnSchema{}, false
+}
+
+// key returns the row key of the primary key value v.
+func (t *TableSchema) key(v Value) (string, error) {
+	col, _ := t.column(t.PrimaryKey)
+	if v.IsNull() {
+		return "", fmt.Errorf("%w: primary key %s is NULL", ErrSchema, col.Name)
+	}
+	v, err := coerceValue(v, col.Type)
+	if err != nil {
+		return "", fmt.Errorf("primary key %s: %w", col.Name, err)
+	}
+	return v.String(), nil
+}
+
+// row validates values against the schema and returns them as a row in the
+// order of the columns. Values are converted to the type of their column and
+// missing ones are NULL, which the primary key and NOT NULL columns cannot be.
+func (t *TableSchema) row(values map[string]Value) (*Data, error) {
+	for name := range(values) {
+		if _, ok := t.column(name); !ok {
+			return nil, fmt.Errorf("%w: %s in table %s", ErrColumnNotFound, name, t.Name)
+		}
+	}
+	cols := make([]Column, 0, len(t.Columns))
+	for _, col := range(t.Columns) {
+		v, ok := values[col.Name]
+		if !ok {
+			v = NullValue()
+		}
+		if v.IsNull() && (col.NotNull || col.Name == t.PrimaryKey) {
+			return nil, fmt.Errorf("%w: column %s of table %s is NOT NULL", ErrSchema, col.Name, t.Name)
+		}
+		v, err := coerceValue(v, col.Type)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		cols = append(cols, Column{ col.Name, v })
+	}
+	key, err := t.key(values[t.PrimaryKey])
+	if err != nil {
+		return nil, err
+	}
+	return newData(key, cols), nil
+}
+
+func (t *TableSchema) String() string {
+	cols := make([]string, len(t.Columns))
+	for i, col := range(t.Columns) {
+		cols[i] = fmt.Sprintf("%s %v", col.Name, col.Type)
+		if col.NotNull && col.Name != t.PrimaryKey {
+			cols[i] += " NOT NULL"
+		}
+		if col.Name == t.PrimaryKey {
+			cols[i] += " PRIMARY KEY"
+		}
+	}
+	return fmt.Sprintf("%s (%s)", t.Name, strings.Join(cols, ", "))
+}
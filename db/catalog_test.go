@@ -0,0 +1,50 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"os"
+	"reflect"
+)
+
+func TestCatalogPersists(t *testing.T) {
+	dir := t.TempDir()
+	c, err := openCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := &TableSchema{ "movies", []ColumnSchema{
+		{ "Id", TYPE_INT, true }, { "Name", TYPE_STRING, true }, { "Released", TYPE_TIMESTAMP, false },
+	}, "Id" }
+	w, err := c.create(schema, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, ok := reopened.table("movies"); !ok || !reflect.DeepEqual(schema, actual) {
+		t.Errorf("Expected %v. Actual %v", schema, actual)
+	}
+	if segments, err := readManifest(reopened.tableDir("movies"), 0); err != nil || len(segments) != 1 {
+		t.Errorf("Expected 1 segment. Actual %v %v", segments, err)
+	}
+	if err := reopened.drop("movies"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.source("movies"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Expected %v. Actual %v", ErrTableNotFound, err)
+	}
+
+	if err := os.WriteFile(catalogPath(dir), []byte(`{"tables": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openCatalog(dir); !errors.Is(err, ErrCorruptFile) {
+		t.Errorf("Expected %v. Actual %v", ErrCorruptFile, err)
+	}
+}
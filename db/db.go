@@ -1,18 +1,21 @@
 package db
 
 import (
+	"container/heap"
+	"context"
+	"errors"
 	"fmt"
+	"regexp"
 	"slices"
 	"encoding/json"
 	"strconv"
 	"strings"
-	"log"
 )
 
 
 type Record struct {
 	key string
-	values map[string]string
+	values map[string]Value
 }
 
 func (r Record) String() string {
@@ -23,24 +26,32 @@ func (r Record) String() string {
 	return output
 }
 
-func (r Record) getColumn(column string) (string, error) {
+// row_key_column names the row key in predicates, e.g. ["_key", "5"].
+const row_key_column = "_key"
+
+// getColumn returns the value of column, NULL if the record does not have it.
+func (r Record) getColumn(column string) Value {
+	if column == row_key_column {
+		return StringValue(r.key)
+	}
 	v, ok := r.values[column]
 	if !ok {
-		return "", fmt.Errorf("No column %s for record", column)
+		return NullValue()
 	}
-	return v, nil
-}
-
-func makeRecord(row_key string, name string, id string, year string) Record {
-	return Record{ key: row_key, values: map[string]string {
-		"Name": name,
-		"Id": id,
-		"Year": year,
-	}}
+	return v
 }
 
+/*
+Every node of a query plan is an Iterator. A plan is driven from its root:
+Open prepares the node and its children, Next returns one record at a time,
+nil once the node is exhausted, and Close releases the files held by the node
+and its children. Close can be called whether or not Open succeeded. A
+cancelled ctx makes Next return the error of ctx.
+*/
 type Iterator interface {
-	next() *Record
+	Open(ctx context.Context) error
+	Next() (*Record, error)
+	Close() error
 }
 
 type ScanNode struct {
@@ -51,8 +62,16 @@ func initScanNode(scanner Iterator) *ScanNode {
  return &ScanNode{ &scanner }
 }
 
-func (s *ScanNode) next() *Record {
-	return (*s.child).next()
+func (s *ScanNode) Open(ctx context.Context) error {
+	return (*s.child).Open(ctx)
+}
+
+func (s *ScanNode) Next() (*Record, error) {
+	return (*s.child).Next()
+}
+
+func (s *ScanNode) Close() error {
+	return (*s.child).Close()
 }
 
 type LimitNode struct {
@@ -66,11 +85,23 @@ func initLimitNode(limit uint32, child Iterator) *LimitNode {
 	return &LimitNode{ limit, 0, &child}
 }
 
-func (l *LimitNode) next() *Record {
-	if (*l).i == (*l).limit { return nil }
-	r := (*l.child).next()
+func (l *LimitNode) Open(ctx context.Context) error {
+	(*l).i = 0
+	return (*l.child).Open(ctx)
+}
+
+func (l *LimitNode) Close() error {
+	return (*l.child).Close()
+}
+
+func (l *LimitNode) Next() (*Record, error) {
+	if (*l).i == (*l).limit { return nil, nil }
+	r, err := (*l.child).Next()
+	if err != nil {
+		return nil, err
+	}
 	(*l).i += 1
-	return r
+	return r, nil
 }
 
 type Op int
@@ -79,6 +110,7 @@ type CompOp int
 const (
 	OR Op = iota
 	AND
+	NOT
 )
 
 const (
@@ -87,104 +119,394 @@ const (
 	GT
 	LT_E
 	GT_E
+	IS_NULL
+	IS_NOT_NULL
+	NE
+	IN
+	NOT_IN
+	BETWEEN
+	LIKE
+	STARTS_WITH
+	REGEXP
 )
 
+/*
+Truth is the value of a predicate under three-valued logic. A comparison with
+NULL is UNKNOWN, NOT UNKNOWN is UNKNOWN, FALSE AND UNKNOWN is FALSE and TRUE
+OR UNKNOWN is TRUE. SELECTION only keeps the records whose predicates are TRUE.
+*/
+type Truth int
+
+const (
+	FALSE Truth = iota
+	TRUE
+	UNKNOWN
+)
+
+func truthAnd(a Truth, b Truth) Truth {
+	if a == FALSE || b == FALSE {
+		return FALSE
+	}
+	if a == UNKNOWN || b == UNKNOWN {
+		return UNKNOWN
+	}
+	return TRUE
+}
+
+func truthOr(a Truth, b Truth) Truth {
+	if a == TRUE || b == TRUE {
+		return TRUE
+	}
+	if a == UNKNOWN || b == UNKNOWN {
+		return UNKNOWN
+	}
+	return FALSE
+}
+
+func truthOf(b bool) Truth {
+	if b {
+		return TRUE
+	}
+	return FALSE
+}
+
+/*
+predicateExpression compares the column left with right, or with the values of
+IN, NOT_IN and BETWEEN, whose bounds are values[0] and values[1]. pattern is the
+compiled pattern of LIKE and REGEXP. The expression lhs, when set, is compared
+instead of left, and rhs instead of right.
+*/
 type predicateExpression struct {
 	left string
 	compOp CompOp
-	right string
+	right Value
+	values []Value
+	pattern *regexp.Regexp
+	lhs *expression
+	rhs *expression
 }
 
-type predicateExpressions struct {
-	left *predicateExpression
+/*
+predicateTree is a boolean expression over a record: a comparison when leaf is
+set, otherwise AND or OR of its children, or NOT of its single child.
+*/
+type predicateTree struct {
+	leaf *predicateExpression
 	op Op
-	right *predicateExpressions
+	children []*predicateTree
 }
 
 type SelectionNode struct {
-	predicate *predicateExpressions
+	predicate *predicateTree
 	child *Iterator
 }
 
-func initSelectionNode(predicate *predicateExpressions, child Iterator) *SelectionNode {
+func initSelectionNode(predicate *predicateTree, child Iterator) *SelectionNode {
 	return &SelectionNode { predicate, &child}
 }
 
-func evaluatePredicate(p *predicateExpression, r *Record) bool {
-	v, err := r.getColumn(p.left)
-	if err != nil {
-		panic(err)
+func evaluatePredicate(p *predicateExpression, r *Record) (Truth, error) {
+	v := r.getColumn(p.left)
+	if p.lhs != nil {
+		var err error
+		if v, err = p.lhs.evaluate(r); err != nil {
+			return FALSE, err
+		}
+	}
+	switch p.compOp {
+		case IS_NULL:
+			return truthOf(v.IsNull()), nil
+		case IS_NOT_NULL:
+			return truthOf(!v.IsNull()), nil
+	}
+	if v.IsNull() {
+		return UNKNOWN, nil
 	}
 	switch p.compOp {
+		case IN, NOT_IN:
+			truth := FALSE
+			for _, value := range(p.values) {
+				eq, err := compareTruth(v, EQ, value)
+				if err != nil {
+					return FALSE, err
+				}
+				if truth = truthOr(truth, eq); truth == TRUE {
+					break
+				}
+			}
+			if p.compOp == NOT_IN && truth != UNKNOWN {
+				return truthOf(truth == FALSE), nil
+			}
+			return truth, nil
+		case BETWEEN:
+			lo, err := compareTruth(v, GT_E, p.values[0])
+			if err != nil || lo == FALSE {
+				return lo, err
+			}
+			hi, err := compareTruth(v, LT_E, p.values[1])
+			return truthAnd(lo, hi), err
+		case LIKE, STARTS_WITH, REGEXP:
+			if v.typ != TYPE_STRING {
+				return FALSE, fmt.Errorf("%w: %s of %v %s", ErrTypeMismatch, compOpNames[p.compOp],
+					v.typ, v)
+			}
+			if p.compOp == STARTS_WITH {
+				return truthOf(strings.HasPrefix(v.s, p.right.s)), nil
+			}
+			return truthOf(p.pattern.MatchString(v.s)), nil
+	}
+	if p.rhs != nil {
+		right, err := p.rhs.evaluate(r)
+		if err != nil {
+			return FALSE, err
+		}
+		return compareTruth(v, p.compOp, right)
+	}
+	return compareTruth(v, p.compOp, p.right)
+}
+
+// compareTruth compares the value v with right, the comparison with NULL being
+// UNKNOWN.
+func compareTruth(v Value, op CompOp, right Value) (Truth, error) {
+	if v.IsNull() || right.IsNull() {
+		return UNKNOWN, nil
+	}
+	c, err := compareValues(v, right)
+	if err != nil {
+		return FALSE, err
+	}
+	switch op {
 		case EQ:
-			return v == p.right
+			return truthOf(c == 0), nil
+		case NE:
+			return truthOf(c != 0), nil
 		case LT:
-			return v < p.right
+			return truthOf(c < 0), nil
 		case GT:
-			return v > p.right
+			return truthOf(c > 0), nil
 		case LT_E:
-			return v <= p.right
+			return truthOf(c <= 0), nil
 		case GT_E:
-			return v >= p.right
+			return truthOf(c >= 0), nil
 	}
-	return false
+	return FALSE, nil
 }
 
-func evaluatePredicates(p *predicateExpressions, r *Record) bool {
-	left := evaluatePredicate(p.left, r)
-	var right bool
-	if p.right == nil {
-		right = true
-	} else {
-		right = evaluatePredicates(p.right, r)
+/*
+likePattern compiles the LIKE pattern into a regular expression matching the
+whole string: % matches any run of characters, _ a single character and a
+backslash makes the character after it literal.
+*/
+func likePattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^(?s)")
+	escaped := false
+	for _, c := range(pattern) {
+		switch {
+			case escaped:
+				expr.WriteString(regexp.QuoteMeta(string(c)))
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '%':
+				expr.WriteString(".*")
+			case c == '_':
+				expr.WriteString(".")
+			default:
+				expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
 	}
-	if p.op == OR {
-		return left || right
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// likePrefix returns the literal text the LIKE pattern starts with and whether
+// the pattern is only that prefix followed by %.
+func likePrefix(pattern string) (string, bool) {
+	var prefix strings.Builder
+	escaped := false
+	for i, c := range(pattern) {
+		switch {
+			case escaped:
+				prefix.WriteRune(c)
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '%' || c == '_':
+				return prefix.String(), c == '%' && i == len(pattern) - 1
+			default:
+				prefix.WriteRune(c)
+		}
 	}
-	return left && right
+	return prefix.String(), false
 }
 
-func (p *SelectionNode) next() *Record {
-	for r := (*p.child).next(); r != nil; r = (*p.child).next() {
-		if (evaluatePredicates(p.predicate, r)) {
-			return r
+// evaluatePredicates evaluates p on r. AND stops at the first FALSE child and
+// OR at the first TRUE one, so the children after it are not evaluated.
+func evaluatePredicates(p *predicateTree, r *Record) (Truth, error) {
+	if p.leaf != nil {
+		return evaluatePredicate(p.leaf, r)
+	}
+	if p.op == NOT {
+		truth, err := evaluatePredicates(p.children[0], r)
+		if err != nil || truth == UNKNOWN {
+			return UNKNOWN, err
+		}
+		return truthOf(truth == FALSE), nil
+	}
+	result := truthOf(p.op == AND)
+	for _, child := range(p.children) {
+		truth, err := evaluatePredicates(child, r)
+		if err != nil {
+			return FALSE, err
+		}
+		if p.op == AND {
+			result = truthAnd(result, truth)
+		} else {
+			result = truthOr(result, truth)
+		}
+		if result == truthOf(p.op == OR) {
+			return result, nil
+		}
+	}
+	return result, nil
+}
+
+func (p *SelectionNode) Open(ctx context.Context) error {
+	return (*p.child).Open(ctx)
+}
+
+func (p *SelectionNode) Close() error {
+	return (*p.child).Close()
+}
+
+func (p *SelectionNode) Next() (*Record, error) {
+	for {
+		r, err := (*p.child).Next()
+		if r == nil || err != nil {
+			return nil, err
+		}
+		truth, err := evaluatePredicates(p.predicate, r)
+		if err != nil {
+			return nil, err
+		}
+		if truth == TRUE {
+			return r, nil
 		}
 	}
-	return nil
 }
 
-func initPredicateExpression(left string, compOp CompOp, right string) *predicateExpression {
-	return &predicateExpression{ left, compOp, right }
+func initPredicateExpression(left string, compOp CompOp, right Value) *predicateExpression {
+	return &predicateExpression{ left, compOp, right, nil, nil, nil, nil }
+}
+
+// initPredicateOperands returns the comparison of the expressions left and
+// right, written as a comparison of a column with a value when they are.
+func initPredicateOperands(left *expression, compOp CompOp, right *expression) *predicateExpression {
+	if left.op == EXPR_VALUE && right.op != EXPR_VALUE {
+		left, compOp, right = right, flipped_comp_ops[compOp], left
+	}
+	p := initPredicateExpression("", compOp, NullValue())
+	if right.op == EXPR_VALUE {
+		p.right = right.value
+	} else {
+		p.rhs = right
+	}
+	return p.withLeft(left)
+}
+
+// withLeft makes the expression left the left side of p.
+func (p *predicateExpression) withLeft(left *expression) *predicateExpression {
+	if left.op == EXPR_COLUMN {
+		p.left = left.column
+	} else {
+		p.lhs = left
+	}
+	return p
+}
+
+// initPredicateList returns the IN, NOT_IN or BETWEEN of left with values.
+func initPredicateList(left string, compOp CompOp, values []Value) *predicateExpression {
+	return &predicateExpression{ left, compOp, NullValue(), values, nil, nil, nil }
+}
+
+// initPredicatePattern returns the LIKE, STARTS_WITH or REGEXP of left with
+// pattern, or an ErrInvalidPlan for a regular expression that does not
+// compile.
+func initPredicatePattern(left string, compOp CompOp, pattern string) (*predicateExpression, error) {
+	p := &predicateExpression{ left, compOp, StringValue(pattern), nil, nil, nil, nil }
+	switch compOp {
+		case LIKE:
+			p.pattern = likePattern(pattern)
+		case REGEXP:
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%w: REGEXP %q: %w", ErrInvalidPlan, pattern, err)
+			}
+			p.pattern = re
+	}
+	return p, nil
 }
 
-func initPredicateExpressions(left *predicateExpression, op Op, right *predicateExpressions) *predicateExpressions {
-	return &predicateExpressions{left, op, right }
+func initPredicateLeaf(p *predicateExpression) *predicateTree {
+	return &predicateTree{ p, AND, nil }
 }
 
+func initPredicateTree(op Op, children ...*predicateTree) *predicateTree {
+	return &predicateTree{ nil, op, children }
+}
+
+// initPredicateExpressions returns left op right, the link of a chain of
+// comparisons. A link without right is left alone.
+func initPredicateExpressions(left *predicateExpression, op Op, right *predicateTree) *predicateTree {
+	if right == nil {
+		return initPredicateLeaf(left)
+	}
+	return initPredicateTree(op, initPredicateLeaf(left), right)
+}
+
+/*
+ProjectionNode returns the columns cols of the records of its child. exprs[i],
+when set, computes cols[i] instead of copying it.
+*/
 type ProjectionNode struct {
 	cols []string
+	exprs []*expression
 	child *Iterator
 }
 
 func initProjectionNode(cols []string, child Iterator) *ProjectionNode {
-	return &ProjectionNode{ cols, &child }
+	return initComputedProjectionNode(cols, make([]*expression, len(cols)), child)
 }
 
-func (p *ProjectionNode) next() *Record {
-	n := (*p.child).next()
-	if n == nil {
-		return n
+func initComputedProjectionNode(cols []string, exprs []*expression, child Iterator) *ProjectionNode {
+	return &ProjectionNode{ cols, exprs, &child }
+}
+
+func (p *ProjectionNode) Open(ctx context.Context) error {
+	return (*p.child).Open(ctx)
+}
+
+func (p *ProjectionNode) Close() error {
+	return (*p.child).Close()
+}
+
+func (p *ProjectionNode) Next() (*Record, error) {
+	n, err := (*p.child).Next()
+	if n == nil || err != nil {
+		return nil, err
 	}
-	r := &Record {values: make(map[string]string, 0)}
-	for _, col := range(p.cols) {
-		v, ok := n.values[col]
-		if ok {
-			r.values[col] = v
-		} else {
-			panic(fmt.Sprintf("There is no %s in record %s", col, n))
+	r := &Record {values: make(map[string]Value, 0)}
+	for i, col := range(p.cols) {
+		if p.exprs[i] == nil {
+			r.values[col] = n.getColumn(col)
+			continue
+		}
+		if r.values[col], err = p.exprs[i].evaluate(n); err != nil {
+			return nil, err
 		}
 	}
-	return r
+	return r, nil
 }
 
 type SortOrder int
@@ -194,115 +516,343 @@ const (
 	DESC
 )
 
+// NULLs sort after every value unless NULLS_FIRST
+type NullOrder int
+
+const (
+	NULLS_LAST NullOrder = iota
+	NULLS_FIRST
+)
+
 type SortPredicate func(*Record, *Record) int
 
+/*
+SortNode sorts the records of its child. Records are buffered until they take
+more than memory bytes, then sorted and spilled to a run file; once the child
+is exhausted, the runs are merged. A memory of 0 never spills.
+*/
 type SortNode struct {
 	sorted []*Record
 	i uint32
 	predicates []SortPredicate
 	child *Iterator
 	done bool
-}
-
-func generatePredicate(col string, order SortOrder) SortPredicate {
+	memory int
+	used int
+	runs []*sortRun
+	merge *runMerge
+}
+
+// generatePredicate compares records on col in the given order. NULLs are
+// placed by nulls whatever the order.
+func generatePredicate(col string, order SortOrder, nulls NullOrder) SortPredicate {
+	null_cmp := 1
+	if nulls == NULLS_FIRST {
+		null_cmp = -1
+	}
 	sort_func := func(a, b *Record) int {
-		a_v, _ := a.getColumn(col)
-		b_v, _ := b.getColumn(col)
-		return strings.Compare(a_v, b_v)
+		a_v := a.getColumn(col)
+		b_v := b.getColumn(col)
+		switch {
+			case a_v.IsNull() && b_v.IsNull():
+				return 0
+			case a_v.IsNull():
+				return null_cmp
+			case b_v.IsNull():
+				return -null_cmp
+		}
+		if order == DESC {
+			return compareForSort(b_v, a_v)
+		}
+		return compareForSort(a_v, b_v)
 	}
 	return sort_func
 }
 
+// compareRecords orders records by the first predicate that tells them apart.
+func compareRecords(predicates []SortPredicate, a, b *Record) int {
+	for _, predicate := range(predicates) {
+		if c := predicate(a, b); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (s *SortNode) compare(a, b *Record) int {
+	return compareRecords(s.predicates, a, b)
+}
 
 type SortTuple struct {
 	col string
 	order SortOrder
+	nulls NullOrder
 }
 
-func initSortNode(child Iterator, sortTuples []SortTuple) *SortNode {
-	records := make([]*Record, 0)
+func sortPredicates(sortTuples []SortTuple) []SortPredicate {
 	predicates := make([]SortPredicate, 0)
 	for _, v := range(sortTuples) {
-		predicates = append(predicates, generatePredicate(v.col, v.order))
+		predicates = append(predicates, generatePredicate(v.col, v.order, v.nulls))
 	}
-	return &SortNode{ records, 0, predicates, &child, false }
+	return predicates
+}
+
+func initSortNode(child Iterator, sortTuples []SortTuple) *SortNode {
+	records := make([]*Record, 0)
+	return &SortNode{ records, 0, sortPredicates(sortTuples), &child, false, 0, 0, nil, nil }
+}
+
+func (s *SortNode) Open(ctx context.Context) error {
+	s.sorted = make([]*Record, 0)
+	s.i = 0
+	s.done = false
+	s.used = 0
+	return (*s.child).Open(ctx)
+}
+
+func (s *SortNode) Close() error {
+	s.sorted = nil
+	s.merge = nil
+	err := removeRuns(s.runs)
+	s.runs = nil
+	return errors.Join(err, (*s.child).Close())
 }
 
-func (s *SortNode) next() *Record {
+func (s *SortNode) Next() (*Record, error) {
 	if s.done {
+		if s.merge != nil {
+			return s.merge.next()
+		}
 		i := s.i
 		records := s.sorted
 		if i >= uint32(len(records)) {
-			return nil
+			return nil, nil
 		}
 		s.i += 1
-		return records[i]
+		return records[i], nil
 	}
-	for r := (*s.child).next(); r != nil; r = (*s.child).next() {
+	for {
+		r, err := (*s.child).Next()
+		if err != nil {
+			return nil, err
+		}
+		if r == nil { break }
 		s.sorted = append(s.sorted, r)
+		if s.memory > 0 {
+			s.used += recordSize(r)
+			if s.used > s.memory {
+				if err := s.spill(); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
-	for _, predicates := range(s.predicates) {
-		slices.SortFunc(s.sorted, predicates)
+	if len(s.runs) > 0 && len(s.sorted) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	// records equal on every key keep the order of the child
+	slices.SortStableFunc(s.sorted, s.compare)
+	if len(s.runs) > 0 {
+		merge, err := initRunMerge(s.runs, s.compare)
+		if err != nil {
+			return nil, err
+		}
+		s.merge = merge
 	}
 	s.done = true
-	i := s.i
-	s.i += 1
-	return s.sorted[i]
+	return s.Next()
+}
+
+// spill writes the buffered records to a new run.
+func (s *SortNode) spill() error {
+	slices.SortStableFunc(s.sorted, s.compare)
+	run, err := writeRun(s.sorted)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.sorted = make([]*Record, 0)
+	s.used = 0
+	return nil
+}
+
+/*
+TopNNode returns the first limit records of its child in the order of a SORT
+on the same keys, as LIMIT over SORT would. It only keeps the limit smallest
+records seen so far, in a heap whose top is the largest of them.
+*/
+type TopNNode struct {
+	limit uint32
+	predicates []SortPredicate
+	child *Iterator
+	top []topNRecord
+	seen int
+	sorted []*Record
+	i uint32
+	done bool
+}
+
+// topNRecord is a record with its position in the input, which breaks ties so
+// that equal records keep their order.
+type topNRecord struct {
+	record *Record
+	seq int
+}
+
+func initTopNNode(limit uint32, sortTuples []SortTuple, child Iterator) *TopNNode {
+	return &TopNNode{ limit, sortPredicates(sortTuples), &child, nil, 0, nil, 0, false }
+}
+
+func (n *TopNNode) compare(a, b topNRecord) int {
+	if c := compareRecords(n.predicates, a.record, b.record); c != 0 {
+		return c
+	}
+	return a.seq - b.seq
+}
+
+func (n *TopNNode) Len() int {
+	return len(n.top)
+}
+
+// Less puts the largest record at the top of the heap.
+func (n *TopNNode) Less(i, j int) bool {
+	return n.compare(n.top[i], n.top[j]) > 0
+}
+
+func (n *TopNNode) Swap(i, j int) {
+	n.top[i], n.top[j] = n.top[j], n.top[i]
+}
+
+func (n *TopNNode) Push(x any) {
+	n.top = append(n.top, x.(topNRecord))
+}
+
+func (n *TopNNode) Pop() any {
+	last := n.top[len(n.top) - 1]
+	n.top = n.top[:len(n.top) - 1]
+	return last
+}
+
+func (n *TopNNode) Open(ctx context.Context) error {
+	n.top = make([]topNRecord, 0)
+	n.seen = 0
+	n.sorted = nil
+	n.i = 0
+	n.done = false
+	return (*n.child).Open(ctx)
+}
+
+func (n *TopNNode) Close() error {
+	n.top = nil
+	n.sorted = nil
+	return (*n.child).Close()
+}
+
+func (n *TopNNode) Next() (*Record, error) {
+	if n.done {
+		if n.i >= uint32(len(n.sorted)) {
+			return nil, nil
+		}
+		n.i += 1
+		return n.sorted[n.i - 1], nil
+	}
+	for n.limit > 0 {
+		r, err := (*n.child).Next()
+		if err != nil {
+			return nil, err
+		}
+		if r == nil { break }
+		t := topNRecord{ r, n.seen }
+		n.seen += 1
+		if uint32(len(n.top)) < n.limit {
+			heap.Push(n, t)
+		} else if n.compare(t, n.top[0]) < 0 {
+			n.top[0] = t
+			heap.Fix(n, 0)
+		}
+	}
+	slices.SortFunc(n.top, n.compare)
+	n.sorted = make([]*Record, len(n.top))
+	for i, t := range(n.top) {
+		n.sorted[i] = t.record
+	}
+	n.top = nil
+	n.done = true
+	return n.Next()
 }
 
+// CountNode counts the records of each group of values of cols. With a column,
+// it only counts the records where the column is not NULL. Records whose group
+// columns are NULL are counted in the same group.
 type CountNode struct {
 	agg_output []Record
 	i int
 	child *Iterator
 	cols []string
 	done bool
+	column string
 }
 
 func initCountNode(child Iterator, cols []string) *CountNode {
-	return &CountNode{ make([]Record, 0), 0, &child, cols, false }
+	return &CountNode{ make([]Record, 0), 0, &child, cols, false, "" }
 }
 
-func (c *CountNode) next() *Record {
+func (c *CountNode) Open(ctx context.Context) error {
+	c.agg_output = make([]Record, 0)
+	c.i = 0
+	c.done = false
+	return (*c.child).Open(ctx)
+}
+
+func (c *CountNode) Close() error {
+	c.agg_output = nil
+	return (*c.child).Close()
+}
+
+func (c *CountNode) Next() (*Record, error) {
 	if c.done {
 		if c.i >= len(c.agg_output) {
-			return nil
+			return nil, nil
 		}
 		r := c.agg_output[c.i]
 		c.i += 1
-		return &r
+		return &r, nil
 	}
+	// records are grouped by the encoding of their values, which keeps values
+	// of different types apart
 	count := make(map[string]int)
-	for v := (*c.child).next(); v != nil; v = (*c.child).next() {
+	groups := make(map[string]Record)
+	for {
+		v, err := (*c.child).Next()
+		if err != nil {
+			return nil, err
+		}
+		if v == nil { break }
 		c_key := ""
-		for i, col := range(c.cols) {
-			k, err := v.getColumn(col)
-			if err != nil {
-				panic(err)
-			}
-			if i > 0 {
-				c_key += ","
-			}
-			c_key += fmt.Sprintf("%s:%s", col, k)
+		group := Record{ values: make(map[string]Value) }
+		for _, col := range(c.cols) {
+			k := v.getColumn(col)
+			c_key += strconv.Quote(string(k.encode()))
+			group.values[col] = k
 		}
-		count[c_key] += 1
+		if _, ok := groups[c_key]; !ok {
+			groups[c_key] = group
+		}
+		n := 1
+		if c.column != "" && v.getColumn(c.column).IsNull() {
+			n = 0
+		}
+		count[c_key] += n
 	}
 	for k, v := range(count) {
-		r := Record{ values: make(map[string]string) }
-		parts := strings.Split(k, ",")
-		for _, part := range(parts) {
-			values := strings.Split(part, ":")
-			if len(values) != 2 {
-				panic(fmt.Sprintf("More than 2 entries for a single column, value pairt in %s", part))
-			}
-			r.values[values[0]] = values[1]
-		}
-		r.values["Count"] = fmt.Sprintf("%d", v)
+		r := groups[k]
+		r.values["Count"] = IntValue(int64(v))
 		c.agg_output = append(c.agg_output, r)
 	}
 	c.done = true
-	r := c.agg_output[c.i]
-	c.i += 1
-	return &r
+	return c.Next()
 }
 
 /*
@@ -334,7 +884,7 @@ args: {
 }
 
 name: "SORT",
-args: ["col:ASC", "col:DESC", ..."]
+args: ["col:ASC", "col:DESC:NULLS_FIRST", ..."]
 
 multiple
 
@@ -377,319 +927,1029 @@ func (n Node) String() string {
 	return "Node name: " + n.Name + n.Child.String()
 }
 
-func generateTree(input string) *Tree {
+func generateTree(input string) (*Tree, error) {
 	var t Tree
 	err := json.Unmarshal([]byte(input), &t)
 	if err != nil {
-		fmt.Printf("Error")
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPlan, err)
 	}
-	return &t
+	return &t, nil
 }
 
-type NodeConstructor func(p NodeParser, n *Node) Iterator
+type NodeConstructor func(p NodeParser, n *Node) (Iterator, error)
 
+// Engine builds the iterators of a plan. Tables named by a scan are looked up
+// in Catalog, or are directories relative to the working directory when
+// Catalog is nil. A SORT spills to disk past SortMemory bytes of records, 0
+// meaning the default and a negative value never spilling.
 type Engine struct {
 	Registry map[string]NodeConstructor
+	Catalog *Catalog
+	SortMemory int
 }
 
 type NodeParser interface {
-	Parse(n *Node) Iterator
+	Parse(n *Node) (Iterator, error)
+	table(name string) (*tableSource, error)
+	sortMemory() int
+}
+
+func (e Engine) sortMemory() int {
+	switch {
+		case e.SortMemory == 0:
+			return default_sort_memory
+		case e.SortMemory < 0:
+			return 0
+	}
+	return e.SortMemory
+}
+
+func (e Engine) table(name string) (*tableSource, error) {
+	if e.Catalog != nil {
+		return e.Catalog.source(name)
+	}
+	if !isTableDir(name) {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	return &tableSource{ name, 0 }, nil
 }
 
-func (e Engine) Parse(n *Node) Iterator {
-	if n == nil { return nil }
+func (e Engine) Parse(n *Node) (Iterator, error) {
+	if n == nil { return nil, nil }
 	c, ok := e.Registry[n.Name]
-	if !ok { return nil }
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown node %s", ErrInvalidPlan, n.Name)
+	}
 	return c(e, n)
 }
 
-func fileScanConstructor(p NodeParser, n *Node) Iterator {
-	return initFileScanNode(parseFileScanNodeArgs(n.Args))
+func fileScanConstructor(p NodeParser, n *Node) (Iterator, error) {
+	source, err := parseScanSource(p, n.Args)
+	if err != nil {
+		return nil, err
+	}
+	return &FileScan{ source: source }, nil
 }
 
-func scanNodeConstructor(p NodeParser, n *Node) Iterator {
-	c := p.Parse(n.Child)
-	return initScanNode(c)
+func scanNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	return initScanNode(c), nil
 }
 
-func projectionNodeConstructor(p NodeParser, n *Node) Iterator {
-	c := p.Parse(n.Child)
-	return initProjectionNode(parseProjectionNodeArgs(n.Args), c)
+func projectionNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	cols, exprs, err := parseProjectionNodeArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	return initComputedProjectionNode(cols, exprs, c), nil
 }
 
-func limitNodeConstructor(p NodeParser, n *Node) Iterator {
-	c := p.Parse(n.Child)
-	return initLimitNode(parseLimitNodeArg(n.Args), c)
+func limitNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	limit, err := parseLimitNodeArg(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	return initLimitNode(limit, c), nil
 }
 
-func selectionNodeConstructor(p NodeParser, n *Node) Iterator {
-	c := p.Parse(n.Child)
-	return initSelectionNode(parseSelectionNodeArgs(n.Args), c)
+func topNNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	limit, tuples, err := parseTopNNodeArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	return initTopNNode(limit, tuples, c), nil
 }
 
-func sortNodeConstructor(p NodeParser, n *Node) Iterator {
-	c := p.Parse(n.Child)
-	return initSortNode(c, parseSortNodeArgs(n.Args))
+func selectionNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	predicates, err := parseSelectionNodeArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	return initSelectionNode(predicates, c), nil
 }
 
-func countNodeConstructor(p NodeParser, n *Node) Iterator {
-	c := p.Parse(n.Child)
-	return initCountNode(c, parseCountNodeArgs(n.Args))
+func sortNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	tuples, err := parseSortNodeArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	sort := initSortNode(c, tuples)
+	sort.memory = p.sortMemory()
+	return sort, nil
+}
+
+func countNodeConstructor(p NodeParser, n *Node) (Iterator, error) {
+	cols, column, err := parseCountNodeArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Parse(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	count := initCountNode(c, cols)
+	count.column = column
+	return count, nil
+}
+
+func indexScanConstructor(p NodeParser, n *Node) (Iterator, error) {
+	lo, hi := parseIndexScanNodeArgs(n.Args)
+	source, err := parseScanSource(p, n.Args)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexScan{ source: source, lo: lo, hi: hi }, nil
 }
 
 var Registry = map[string]NodeConstructor {
 	"FILE_SCAN": fileScanConstructor,
+	"INDEX_SCAN": indexScanConstructor,
 	"SCAN": scanNodeConstructor,
 	"PROJECTION": projectionNodeConstructor,
 	"LIMIT": limitNodeConstructor,
 	"SELECTION": selectionNodeConstructor,
 	"SORT": sortNodeConstructor,
+	"TOP_N": topNNodeConstructor,
+	"AGGREGATE": aggregateNodeConstructor,
 	"COUNT": countNodeConstructor,
 }
 
-func transformToQueryTree(input *Tree) Iterator {
-	e := Engine{ Registry }
-	return e.Parse(input.Head)
+func transformToQueryTree(input *Tree) (Iterator, error) {
+	return Engine{ Registry, nil, 0 }.Compile(input)
 }
 
-func parseSortNodeArgs(args interface{}) []SortTuple {
+// Compile plans the query and builds its iterators.
+func (e Engine) Compile(input *Tree) (Iterator, error) {
+	head, err := planQuery(input.Head)
+	if err != nil {
+		return nil, err
+	}
+	return e.Parse(head)
+}
+
+/*
+planQuery rewrites the plan before it is executed. The comparisons on the row
+key that a SELECTION over a FILE_SCAN requires, those ANDed at the top of its
+predicate, are turned into the bounds of an INDEX_SCAN. The other predicates
+stay in a SELECTION over the INDEX_SCAN.
+
+SELECTION { AND: [{ GT_E: ["_key", "2"] }, { OR: [{ EQ: ["Year", "1"] }, ...] }] }
+  FILE_SCAN { table: "movies" }
+
+becomes
+
+SELECTION { OR: [{ EQ: ["Year", "1"] }, ...] }
+  INDEX_SCAN { table: "movies", lo: "2", hi: "" }
+
+A LIMIT over a SORT becomes a TOP_N, which only keeps the records it returns:
+
+LIMIT ["10"]
+  SORT ["Year:DESC"]
+
+becomes
+
+TOP_N { limit: "10", sort: ["Year:DESC"] }
+*/
+func planQuery(n *Node) (*Node, error) {
+	if n == nil { return nil, nil }
+	child, err := planQuery(n.Child)
+	if err != nil {
+		return nil, err
+	}
+	planned := &Node{ n.Name, n.Args, child }
+	if n.Name == "LIMIT" && child != nil && child.Name == "SORT" {
+		return planTopN(planned), nil
+	}
+	if n.Name != "SELECTION" || planned.Child == nil || planned.Child.Name != "FILE_SCAN" {
+		return planned, nil
+	}
+	scan_args, ok := planned.Child.Args.(map[string]interface{})
+	if !ok { return planned, nil }
+	predicates, err := parseSelectionNodeArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := "", ""
+	rest := make([]*predicateTree, 0)
+	pushed := false
+	for _, p := range(conjuncts(predicates)) {
+		if p.leaf != nil && isKeyRange(p.leaf) {
+			lo, hi = narrowKeyRange(lo, hi, p.leaf)
+			pushed = true
+			// a LIKE with more than a prefix still filters the keys of its range
+			if _, _, exact := keyRange(p.leaf); exact {
+				continue
+			}
+		}
+		rest = append(rest, p)
+	}
+	if !pushed { return planned, nil }
+	index_args := make(map[string]interface{})
+	for k, v := range(scan_args) {
+		index_args[k] = v
+	}
+	index_args["lo"] = lo
+	index_args["hi"] = hi
+	index_scan := &Node{ "INDEX_SCAN", index_args, nil }
+	switch len(rest) {
+		case 0:
+			return index_scan, nil
+		case 1:
+			return &Node{ "SELECTION", predicatesToArgs(rest[0]), index_scan }, nil
+	}
+	return &Node{ "SELECTION", predicatesToArgs(initPredicateTree(AND, rest...)), index_scan }, nil
+}
+
+// conjuncts returns the predicates ANDed together in p.
+func conjuncts(p *predicateTree) []*predicateTree {
+	if p.leaf != nil || p.op != AND {
+		return []*predicateTree{ p }
+	}
+	all := make([]*predicateTree, 0)
+	for _, child := range(p.children) {
+		all = append(all, conjuncts(child)...)
+	}
+	return all
+}
+
+// columns returns the columns p reads.
+func (p *predicateTree) columns() []string {
+	if p.leaf != nil {
+		cols := []string{ p.leaf.left }
+		if p.leaf.lhs != nil {
+			cols = p.leaf.lhs.columns()
+		}
+		if p.leaf.rhs != nil {
+			cols = append(cols, p.leaf.rhs.columns()...)
+		}
+		return cols
+	}
+	cols := make([]string, 0)
+	for _, child := range(p.children) {
+		cols = append(cols, child.columns()...)
+	}
+	return cols
+}
+
+// planTopN turns the LIMIT over a SORT n into a TOP_N. Plans whose arguments
+// do not parse are left for the constructors to reject.
+func planTopN(n *Node) *Node {
+	if _, err := parseLimitNodeArg(n.Args); err != nil {
+		return n
+	}
+	if _, err := parseSortNodeArgs(n.Child.Args); err != nil {
+		return n
+	}
+	args := map[string]interface{}{ "limit": n.Args.([]interface{})[0], "sort": n.Child.Args }
+	return &Node{ "TOP_N", args, n.Child.Child }
+}
+
+// narrowKeyRange intersects [lo, hi) with the keys matching p. Appending a
+// zero byte to a key gives the smallest key greater than it.
+func narrowKeyRange(lo string, hi string, p *predicateExpression) (string, string) {
+	p_lo, p_hi, _ := keyRange(p)
+	if p_lo > lo {
+		lo = p_lo
+	}
+	if p_hi != "" && (hi == "" || p_hi < hi) {
+		hi = p_hi
+	}
+	return lo, hi
+}
+
+// keyRange returns the range [lo, hi) of the keys the comparison p on the row
+// key can match, an empty hi having no bound, and whether every key of the
+// range matches p.
+func keyRange(p *predicateExpression) (string, string, bool) {
+	key := p.right.String()
+	switch p.compOp {
+		case EQ:
+			return key, key + "\x00", true
+		case LT:
+			return "", key, true
+		case LT_E:
+			return "", key + "\x00", true
+		case GT:
+			return key + "\x00", "", true
+		case GT_E:
+			return key, "", true
+		case BETWEEN:
+			return p.values[0].String(), p.values[1].String() + "\x00", true
+		case STARTS_WITH:
+			return key, prefixEnd(key), true
+		case LIKE:
+			prefix, exact := likePrefix(key)
+			return prefix, prefixEnd(prefix), exact
+	}
+	return "", "", false
+}
+
+// isKeyRange reports whether p is a comparison on the row key that bounds the
+// keys it matches. The index orders keys as strings, so a comparison with a
+// value of another type, which parses the key as that type, is left to the
+// SELECTION: 9 < 10 but "9" > "10".
+func isKeyRange(p *predicateExpression) bool {
+	if p.left != row_key_column || p.rhs != nil {
+		return false
+	}
+	switch p.compOp {
+		case EQ, LT, LT_E, GT, GT_E:
+			return p.right.typ == TYPE_STRING
+		case STARTS_WITH:
+			return !p.right.IsNull()
+		case BETWEEN:
+			return p.values[0].typ == TYPE_STRING && p.values[1].typ == TYPE_STRING
+		case LIKE:
+			prefix, _ := likePrefix(p.right.String())
+			return prefix != ""
+	}
+	return false
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] += 1
+			return string(end[:i + 1])
+		}
+	}
+	return ""
+}
+
+var compOpNames = map[CompOp]string {
+	EQ: "EQ",
+	LT: "LT",
+	GT: "GT",
+	LT_E: "LT_E",
+	GT_E: "GT_E",
+	IS_NULL: "IS_NULL",
+	IS_NOT_NULL: "IS_NOT_NULL",
+	NE: "NE",
+	IN: "IN",
+	NOT_IN: "NOT_IN",
+	BETWEEN: "BETWEEN",
+	LIKE: "LIKE",
+	STARTS_WITH: "STARTS_WITH",
+	REGEXP: "REGEXP",
+}
+
+var opNames = map[Op]string {
+	AND: "AND",
+	OR: "OR",
+	NOT: "NOT",
+}
+
+func valuesToArgs(values []Value) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range(values) {
+		args[i] = toArg(v)
+	}
+	return args
+}
+
+// predicatesToArgs is the inverse of parseSelectionNodeArgs.
+func predicatesToArgs(p *predicateTree) map[string]interface{} {
+	if p.leaf != nil {
+		var left interface{} = p.leaf.left
+		if p.leaf.lhs != nil {
+			left = expressionToArg(p.leaf.lhs)
+		}
+		args := []interface{}{ left, toArg(p.leaf.right) }
+		switch p.leaf.compOp {
+			case IS_NULL, IS_NOT_NULL:
+				args = args[:1]
+			case IN, NOT_IN:
+				args[1] = valuesToArgs(p.leaf.values)
+			case BETWEEN:
+				args = append(args[:1], valuesToArgs(p.leaf.values)...)
+		}
+		if p.leaf.rhs != nil {
+			args[1] = expressionToArg(p.leaf.rhs)
+		}
+		return map[string]interface{}{ compOpNames[p.leaf.compOp]: args }
+	}
+	if p.op == NOT {
+		return map[string]interface{}{ "NOT": predicatesToArgs(p.children[0]) }
+	}
+	children := make([]interface{}, len(p.children))
+	for i, child := range(p.children) {
+		children[i] = predicatesToArgs(child)
+	}
+	return map[string]interface{}{ opNames[p.op]: children }
+}
+
+// parseSortNodeArgs reads the keys of a SORT, a non-empty list of col:ORDER
+// strings, or returns an ErrInvalidPlan.
+func parseSortNodeArgs(args interface{}) ([]SortTuple, error) {
 	tuples, ok := args.([]interface{})
-	if !ok || len(tuples) == 0 {
-		return []SortTuple{}
+	if !ok {
+		return nil, fmt.Errorf("%w: sort keys %v are not a list", ErrInvalidPlan, args)
+	}
+	if len(tuples) == 0 {
+		return nil, fmt.Errorf("%w: no sort keys", ErrInvalidPlan)
 	}
 	sort_tuples := make([]SortTuple, 0)
 	for _, tuple := range(tuples) {
-		t := tuple.(string)
+		t, ok := tuple.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: sort key %v is not a string", ErrInvalidPlan, tuple)
+		}
 		splits := strings.Split(t, ":")
+		if len(splits) < 2 {
+			return nil, fmt.Errorf("%w: sort key %s is not col:ORDER", ErrInvalidPlan, t)
+		}
+		if len(splits) > 3 {
+			return nil, fmt.Errorf("%w: sort key %s is not col:ORDER[:NULLS]", ErrInvalidPlan, t)
+		}
 		col := splits[0]
+		if col == "" {
+			return nil, fmt.Errorf("%w: sort key %s has no column", ErrInvalidPlan, t)
+		}
 		var sort_order SortOrder
-		if splits[1] == "ASC" {
-			sort_order = ASC
-		} else if splits[2] == "DESC" {
-			sort_order = DESC
+		switch splits[1] {
+			case "ASC":
+				sort_order = ASC
+			case "DESC":
+				sort_order = DESC
+			default:
+				return nil, fmt.Errorf("%w: unknown sort order %s", ErrInvalidPlan, splits[1])
 		}
-		sort_tuples = append(sort_tuples, SortTuple{ col, sort_order })
+		nulls := NULLS_LAST
+		if len(splits) > 2 {
+			switch splits[2] {
+				case "NULLS_FIRST":
+					nulls = NULLS_FIRST
+				case "NULLS_LAST":
+				default:
+					return nil, fmt.Errorf("%w: unknown null order %s", ErrInvalidPlan, splits[2])
+			}
+		}
+		sort_tuples = append(sort_tuples, SortTuple{ col, sort_order, nulls })
 	}
-	return sort_tuples
+	return sort_tuples, nil
 }
 
-func parseLimitNodeArg(args interface{}) uint32 {
+func parseLimitNodeArg(args interface{}) (uint32, error) {
 	lim, ok := args.([]interface{})
-	if !ok {
-		return 0
-	}
-	if len(lim) > 1 {
-		return 0
+	if !ok || len(lim) != 1 {
+		return 0, fmt.Errorf("%w: limit %v is not a single value", ErrInvalidPlan, args)
 	}
 	lim_s, ok := lim[0].(string)
 	if !ok {
-		return 0
+		return 0, fmt.Errorf("%w: limit %v is not a string", ErrInvalidPlan, lim[0])
 	}
 	i, err := strconv.Atoi(lim_s)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%w: limit %s is not a count", ErrInvalidPlan, lim_s)
+	}
+	return uint32(i), nil
+}
+
+/*
+TOP_N args are the limit and the sort keys of a LIMIT over a SORT:
+
+{ "limit": "10", "sort": ["Year:DESC", "Name:ASC"] }
+*/
+func parseTopNNodeArgs(args interface{}) (uint32, []SortTuple, error) {
+	m, ok := args.(map[string]interface{})
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: top n %v is not limit and sort", ErrInvalidPlan, args)
+	}
+	limit, err := parseLimitNodeArg([]interface{}{ m["limit"] })
 	if err != nil {
-		return 0
+		return 0, nil, err
 	}
-	return uint32(i)
+	tuples, err := parseSortNodeArgs(m["sort"])
+	if err != nil {
+		return 0, nil, err
+	}
+	return limit, tuples, nil
 }
 
-func parseCountNodeArgs(args interface{}) []string {
-	cols := make([]string, 0)
+/*
+COUNT args are the columns to group by, or the columns to group by and the
+column whose values to count:
+
+["Name"]
+{ "group": ["Name"], "column": "Year" }
+*/
+func parseCountNodeArgs(args interface{}) ([]string, string, error) {
+	margs, ok := args.(map[string]interface{})
+	if !ok {
+		cols, err := parseColumnArgs("COUNT", args)
+		return cols, "", err
+	}
+	cols, err := parseColumnArgs("COUNT", margs["group"])
+	if err != nil {
+		return nil, "", err
+	}
+	column, ok := margs["column"].(string)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: COUNT column %v is not a string", ErrInvalidPlan,
+			margs["column"])
+	}
+	return cols, column, nil
+}
+
+/*
+PROJECTION args are the columns to return. A column is the name of a column of
+the records, or a column computed by an expression, in the format of
+parseExpression:
+
+["Name", { "as": "Age", "expression": { "SUB": [2024, { "COLUMN": "Year" }] } }]
+*/
+func parseProjectionNodeArgs(args interface{}) ([]string, []*expression, error) {
 	arr, ok := args.([]interface{})
 	if !ok {
-		return nil
+		return nil, nil, fmt.Errorf("%w: PROJECTION expects a list of columns", ErrInvalidPlan)
 	}
-	for _, v := range(arr) {
-		s, s_ok := v.(string)
-		if !s_ok {
-			return nil
+	cols := make([]string, len(arr))
+	exprs := make([]*expression, len(arr))
+	for i, v := range(arr) {
+		if s, ok := v.(string); ok {
+			cols[i] = s
+			continue
 		}
-		cols = append(cols, s)
+		m, _ := v.(map[string]interface{})
+		as, ok := m["as"].(string)
+		if !ok || as == "" || m["expression"] == nil {
+			return nil, nil, fmt.Errorf("%w: PROJECTION column %v is not a column", ErrInvalidPlan, v)
+		}
+		if slices.Contains(cols[:i], as) {
+			return nil, nil, fmt.Errorf("%w: PROJECTION column %s is not unique", ErrInvalidPlan, as)
+		}
+		e, err := parseExpression(m["expression"])
+		if err != nil {
+			return nil, nil, err
+		}
+		cols[i] = as
+		exprs[i] = e
 	}
-	return cols
+	return cols, exprs, nil
 }
 
-
-func parseProjectionNodeArgs(args interface{}) []string {
+func parseColumnArgs(name string, args interface{}) ([]string, error) {
 	cols := make([]string, 0)
 	arr, ok := args.([]interface{})
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("%w: %s expects a list of columns", ErrInvalidPlan, name)
 	}
 	for _, v := range(arr) {
 		s, s_ok := v.(string)
 		if !s_ok {
-			return nil
+			return nil, fmt.Errorf("%w: %s column %v is not a string", ErrInvalidPlan, name, v)
 		}
 		cols = append(cols, s)
 	}
-	return cols
-}
-
-func toStringSlice(a interface{}) []string {
-	pa, _ := a.([]interface{})
-	arr := make([]string, len(pa))
-	for i, v := range(pa) {
-		s, _ := v.(string)
-		arr[i] = s
-	}
-	return arr
+	return cols, nil
 }
 
 /*
-EQUALS: ["id", "5"]
+A comparison is an operator with the column and the values it compares the
+column with:
+
+EQ: ["id", 5]               also NE, LT, GT, LT_E and GT_E
+IS_NULL: ["id"]             also IS_NOT_NULL
+IN: ["id", [1, 2, 3]]       also NOT_IN
+BETWEEN: ["id", 1, 10]      both bounds included
+LIKE: ["name", "Movie_%"]   % matches any text and _ any character
+STARTS_WITH: ["name", "Movie"]
+REGEXP: ["name", "^Movie [0-9]+$"]
+
+A value is a string, a number, a boolean or null. Numbers without a fraction
+are integers. The column can be an expression in the format of parseExpression
+instead, and so can the value of EQ to GT_E, which compares two columns:
+
+GT: ["EndYear", { "COLUMN": "Year" }]
+LT: [{ "SUB": [{ "COLUMN": "EndYear" }, { "COLUMN": "Year" }] }, 5]
 */
-func parsePredicate(v map[string]interface{}) *predicateExpression {
-	eq_args, ok := v["EQ"]
-	if ok {
-		peq_args := toStringSlice(eq_args)
-		return &predicateExpression{ peq_args[0], EQ, peq_args[1] }
-	}
-
-	lt_args, ok := v["LT"]
-	if ok {
-		plt_args := toStringSlice(lt_args)
-		return &predicateExpression{ plt_args[0], LT, plt_args[1] }
-	}
-
-	gt_args, ok := v["GT"]
-	if ok {
-		pgt_args := toStringSlice(gt_args)
-		return &predicateExpression{ pgt_args[0], GT, pgt_args[1] }
+func parsePredicate(v map[string]interface{}) (*predicateExpression, error) {
+	for _, op := range([]CompOp{ EQ, NE, LT, GT, LT_E, GT_E, IS_NULL, IS_NOT_NULL, IN, NOT_IN,
+		BETWEEN, LIKE, STARTS_WITH, REGEXP }) {
+		args, ok := v[compOpNames[op]]
+		if !ok { continue }
+		name := compOpNames[op]
+		pargs, _ := args.([]interface{})
+		if len(pargs) == 0 {
+			return nil, fmt.Errorf("%w: %s expects a column first, got %v", ErrInvalidPlan, name, args)
+		}
+		left, err := parseLeftArg(name, pargs[0])
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+			case IS_NULL, IS_NOT_NULL:
+				if len(pargs) != 1 {
+					return nil, fmt.Errorf("%w: %s expects a column, got %v", ErrInvalidPlan, name, args)
+				}
+				return initPredicateExpression("", op, NullValue()).withLeft(left), nil
+			case IN, NOT_IN:
+				var list []interface{}
+				if len(pargs) == 2 {
+					list, ok = pargs[1].([]interface{})
+				}
+				if len(pargs) != 2 || !ok {
+					return nil, fmt.Errorf("%w: %s expects a column and a list, got %v",
+						ErrInvalidPlan, name, args)
+				}
+				values, err := argsToValues(name, list)
+				if err != nil {
+					return nil, err
+				}
+				return initPredicateList("", op, values).withLeft(left), nil
+			case BETWEEN:
+				if len(pargs) != 3 {
+					return nil, fmt.Errorf("%w: %s expects a column and two bounds, got %v",
+						ErrInvalidPlan, name, args)
+				}
+				values, err := argsToValues(name, pargs[1:])
+				if err != nil {
+					return nil, err
+				}
+				return initPredicateList("", op, values).withLeft(left), nil
+			case LIKE, STARTS_WITH, REGEXP:
+				var pattern string
+				if len(pargs) == 2 {
+					pattern, ok = pargs[1].(string)
+				}
+				if len(pargs) != 2 || !ok {
+					return nil, fmt.Errorf("%w: %s expects a column and a string, got %v",
+						ErrInvalidPlan, name, args)
+				}
+				p, err := initPredicatePattern("", op, pattern)
+				if err != nil {
+					return nil, err
+				}
+				return p.withLeft(left), nil
+		}
+		if len(pargs) != 2 {
+			return nil, fmt.Errorf("%w: %s expects a column and a value, got %v",
+				ErrInvalidPlan, name, args)
+		}
+		right, err := parseExpression(pargs[1])
+		if err != nil {
+			return nil, err
+		}
+		return initPredicateOperands(left, op, right), nil
 	}
+	return nil, fmt.Errorf("%w: no comparison in %v", ErrInvalidPlan, v)
+}
 
-	lteq_args, ok := v["LT_E"]
-	if ok {
-		plteq_args := toStringSlice(lteq_args)
-		return &predicateExpression{ plteq_args[0], LT_E, plteq_args[1] }
+// parseLeftArg returns the column or the expression a comparison starts with.
+func parseLeftArg(name string, arg interface{}) (*expression, error) {
+	if col, ok := arg.(string); ok {
+		return initColumnExpression(col), nil
 	}
-
-	gteq_args, ok := v["GT_E"]
-	if ok {
-		pgteq_args := toStringSlice(gteq_args)
-		return &predicateExpression{ pgteq_args[0], GT_E, pgteq_args[1] }
+	if _, ok := arg.(map[string]interface{}); ok {
+		return parseExpression(arg)
 	}
-
-	return nil
+	return nil, fmt.Errorf("%w: %s expects a column first, got %v", ErrInvalidPlan, name, arg)
 }
 
-func isPredicate(args interface{}) bool {
-	arr := args.([]interface{})
-	for _, v := range(arr) {
-		_, ok := v.(string)
-		if !ok {
-			return false
+func argsToValues(name string, args []interface{}) ([]Value, error) {
+	values := make([]Value, len(args))
+	for i, arg := range(args) {
+		value, err := argToValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s value %v: %w", ErrInvalidPlan, name, arg, err)
 		}
+		values[i] = value
 	}
-	return true
+	return values, nil
 }
 
 /*
-args: {
-  "AND": {
-	   "EQUALS": ["id", "5"],
-		 "LT": []
-	}
-}
+A predicate is a comparison, or AND or OR of a list of predicates, or NOT of a
+predicate:
 
-multiple
+{ "EQ": ["Id", 5] }
+{ "AND": [ { "OR": [ { "EQ": ["Id", 5] }, { "EQ": ["Id", 6] } ] }, { "NOT": { "IS_NULL": ["Year"] } } ] }
 
-args: {
-  OR: {
-     EQUALS: ["id", "5"],
-		 AND: {
-       EQUALS: ["id", "5"],
-			 OR: {
- 					predicateExpr
-			 }
-		 }
-	 },
-}
+AND or OR of an object is the older chained format, a comparison joined to an
+optional rest of the chain by the operator, where a OR b AND c is a OR (b AND c):
 
+{ "OR": { "EQ": ["Id", 5], "AND": { "EQ": ["Year", 2000] } } }
 */
-func parsePredicates(args map[string]interface{}) *predicateExpressions {
-	or_args, or_ok := args["OR"]
-	and_args, and_ok := args["AND"]
-	var predicate map[string]interface{} 
-	if or_ok {
-		predicate, _ = or_args.(map[string]interface{})
+func parsePredicates(args map[string]interface{}) (*predicateTree, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%w: predicate %v has more than one operator", ErrInvalidPlan, args)
 	}
-	if and_ok {
-		predicate, _ = and_args.(map[string]interface{})
+	for name, v := range(args) {
+		switch name {
+			case "AND", "OR":
+				op := AND
+				if name == "OR" {
+					op = OR
+				}
+				if link, ok := v.(map[string]interface{}); ok {
+					return parsePredicateChain(link, op)
+				}
+				list, ok := v.([]interface{})
+				if !ok || len(list) == 0 {
+					return nil, fmt.Errorf("%w: %s expects a list of predicates, got %v", ErrInvalidPlan, name, v)
+				}
+				children := make([]*predicateTree, len(list))
+				for i, child := range(list) {
+					var err error
+					if children[i], err = parsePredicateArg(child); err != nil {
+						return nil, err
+					}
+				}
+				return initPredicateTree(op, children...), nil
+			case "NOT":
+				child, err := parsePredicateArg(v)
+				if err != nil {
+					return nil, err
+				}
+				return initPredicateTree(NOT, child), nil
+		}
 	}
-	var op Op
-	if or_ok {
-		op = OR
+	leaf, err := parsePredicate(args)
+	if err != nil {
+		return nil, err
 	}
-	if and_ok {
-		op = AND
+	return initPredicateLeaf(leaf), nil
+}
+
+func parsePredicateArg(arg interface{}) (*predicateTree, error) {
+	m, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: predicate %v is not an object", ErrInvalidPlan, arg)
 	}
-	if !or_ok && !and_ok {
-		panic(fmt.Sprintf("Failed to parse selection node for %v", args))
+	return parsePredicates(m)
+}
+
+// parsePredicateChain reads the link of the chained format whose comparison is
+// joined with op to the rest of the chain.
+func parsePredicateChain(link map[string]interface{}, op Op) (*predicateTree, error) {
+	left, err := parsePredicate(link)
+	if err != nil {
+		return nil, err
 	}
-	if (or_ok && len(predicate) == 1) || (and_ok && len(predicate) == 1) {
-		return &predicateExpressions{ parsePredicate(predicate), op, nil }
+	var right *predicateTree
+	for name, next_op := range(map[string]Op{ "AND": AND, "OR": OR }) {
+		next, ok := link[name]
+		if !ok { continue }
+		next_link, ok := next.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: %s link %v is not an object", ErrInvalidPlan, name, next)
+		}
+		if right != nil {
+			return nil, fmt.Errorf("%w: predicate %v has both AND and OR", ErrInvalidPlan, link)
+		}
+		if right, err = parsePredicateChain(next_link, next_op); err != nil {
+			return nil, err
+		}
 	}
-	return &predicateExpressions{ parsePredicate(predicate), op,
-	parsePredicates(predicate) }
+	return initPredicateExpressions(left, op, right), nil
 }
 
-func parseSelectionNodeArgs(args interface{}) *predicateExpressions {
+func parseSelectionNodeArgs(args interface{}) (*predicateTree, error) {
 	margs, ok := args.(map[string]interface{})
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("%w: selection %v is not an object", ErrInvalidPlan, args)
 	}
 	return parsePredicates(margs)
 }
 
-func parseFileScanNodeArgs(args interface{}) *StorageReader {
+// tableSource is the table a scan reads. Its files are only opened when the
+// scan is.
+type tableSource struct {
+	dir string
+	file_number int
+}
+
+func (t *tableSource) open() (*StorageReader, error) {
+	return initStorageReader(t.dir, t.file_number, true, nil)
+}
+
+/*
+A scan reads a table by name, or the table in a directory from its segment
+file_number on:
+
+{ "table": "movies" }
+{ "dir": "movies", "file_number": "0" }
+*/
+func parseScanSource(p NodeParser, args interface{}) (*tableSource, error) {
+	margs, _ := args.(map[string]interface{})
+	table, ok := margs["table"]
+	if !ok {
+		return parseFileScanNodeArgs(args)
+	}
+	name, ok := table.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid argument table for scan node", ErrInvalidPlan)
+	}
+	return p.table(name)
+}
+
+func parseFileScanNodeArgs(args interface{}) (*tableSource, error) {
 	margs, ok := args.(map[string]interface{})
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("%w: filescan %v is not an object", ErrInvalidPlan, args)
 	}
 	dir, ok := margs["dir"]
 	if !ok {
-		log.Fatal("Missing argument dir for filescan node")
+		return nil, fmt.Errorf("%w: missing argument dir for filescan node", ErrInvalidPlan)
 	}
 	file_number, ok := margs["file_number"]
 	if !ok {
-		log.Fatal("Missing argument file_number for filescan node")
+		return nil, fmt.Errorf("%w: missing argument file_number for filescan node", ErrInvalidPlan)
 	}
 	asserted_dir, ok := dir.(string)
 	if !ok {
-		log.Fatal("Invalid argument dir for filescan node")
+		return nil, fmt.Errorf("%w: invalid argument dir for filescan node", ErrInvalidPlan)
 	}
 	asserted_file_number, ok := file_number.(string)
 	if !ok {
-		log.Fatal("Invalid argument file_number for filescan node")
+		return nil, fmt.Errorf("%w: invalid argument file_number for filescan node", ErrInvalidPlan)
 	}
 	num, err  := strconv.Atoi(asserted_file_number)
 	if err != nil {
-		log.Fatal("Invalid argument file number for filescan node. Expect an int")
+		return nil, fmt.Errorf("%w: invalid argument file_number for filescan node. Expect an int",
+			ErrInvalidPlan)
 	}
-	reader := initStorageReader(asserted_dir, num, true)
-	return reader
+	return &tableSource{ asserted_dir, num }, nil
 }
 
-func initFileScanNode(reader *StorageReader) Iterator {
-	return &FileScan{ reader, 0 }
+/*
+INDEX_SCAN args are the ones of FILE_SCAN plus either the key to look up or the
+bounds of the range of keys to read, lo inclusive and hi exclusive. A missing
+or empty bound is open.
+
+{ "table": "movies", "key": "5" }
+{ "dir": "movies", "file_number": "0", "lo": "2", "hi": "5" }
+*/
+func parseIndexScanNodeArgs(args interface{}) (string, string) {
+	margs, ok := args.(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	if key, ok := margs["key"].(string); ok {
+		return key, key + "\x00"
+	}
+	lo, _ := margs["lo"].(string)
+	hi, _ := margs["hi"].(string)
+	return lo, hi
 }
 
-type FileScan struct {
+func initIndexScanNode(reader *StorageReader, lo string, hi string) Iterator {
+	return &IndexScan{ reader: reader, lo: lo, hi: hi }
+}
+
+// IndexScan reads the rows whose key is in [lo, hi) through the index, in key
+// order.
+type IndexScan struct {
+	source *tableSource
 	reader *StorageReader
-	offset int64
+	ctx context.Context
+	lo string
+	hi string
+	pointers []rowPointer
+	i int
 }
 
-func (r *FileScan) next() *Record {
-	data, offset := (*r).reader.ReadRow(r.offset)
-	if data == nil {
-		return nil
+func (s *IndexScan) Open(ctx context.Context) error {
+	reader, err := openScanReader(s.source, s.reader)
+	if err != nil {
+		return err
 	}
-	(*r).offset = offset
+	s.reader = reader
+	s.ctx = ctx
+	s.pointers = nil
+	s.i = 0
+	return nil
+}
+
+func (s *IndexScan) Close() error {
+	return closeScanReader(&s.reader)
+}
+
+func (s *IndexScan) Next() (*Record, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.pointers == nil {
+		pointers, err := s.reader.Range(s.lo, s.hi)
+		if err != nil {
+			return nil, err
+		}
+		s.pointers = pointers
+	}
+	for s.i < len(s.pointers) {
+		data, err := s.reader.ReadPointer(s.pointers[s.i])
+		if err != nil {
+			return nil, err
+		}
+		s.i += 1
+		if data != nil {
+			return dataToRecord(data), nil
+		}
+	}
+	return nil, nil
+}
+
+func dataToRecord(data *Data) *Record {
 	ret := &Record{}
 	ret.key = data.row_key
-	ret.values = make(map[string]string)
+	ret.values = make(map[string]Value)
 	for _, col := range(data.cols) {
 		ret.values[col.name] = col.col
 	}
 	return ret
 }
+
+// openScanReader returns the reader a scan was created with, or opens its
+// table.
+func openScanReader(source *tableSource, reader *StorageReader) (*StorageReader, error) {
+	if reader != nil {
+		return reader, nil
+	}
+	if source == nil {
+		return nil, fmt.Errorf("%w: scan has no table to read", ErrInvalidPlan)
+	}
+	return source.open()
+}
+
+func closeScanReader(reader **StorageReader) error {
+	if *reader == nil {
+		return nil
+	}
+	err := (*reader).Close()
+	*reader = nil
+	return err
+}
+
+func initFileScanNode(reader *StorageReader) Iterator {
+	return &FileScan{ reader: reader }
+}
+
+type FileScan struct {
+	source *tableSource
+	reader *StorageReader
+	ctx context.Context
+	segment int
+	offset int64
+}
+
+func (r *FileScan) Open(ctx context.Context) error {
+	reader, err := openScanReader(r.source, r.reader)
+	if err != nil {
+		return err
+	}
+	(*r).reader = reader
+	(*r).ctx = ctx
+	(*r).segment = 0
+	(*r).offset = 0
+	return nil
+}
+
+func (r *FileScan) Close() error {
+	return closeScanReader(&r.reader)
+}
+
+func (r *FileScan) Next() (*Record, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, offset, err := (*r).reader.ReadSegmentRow(r.segment, r.offset)
+	for data == nil && err == nil {
+		if r.segment + 1 >= r.reader.Segments() {
+			return nil, nil
+		}
+		(*r).segment += 1
+		(*r).offset = 0
+		data, offset, err = (*r).reader.ReadSegmentRow(r.segment, r.offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	(*r).offset = offset
+	return dataToRecord(data), nil
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"log"
 	"fmt"
+	"errors"
+	"context"
 )
 
 type StaticScanNode struct {
@@ -18,15 +20,32 @@ func initStaticScan(movies []Record) Iterator {
 	return &StaticScanNode{ movies, 0 }
 }
 
-func (s *StaticScanNode) next() *Record {
+func (s *StaticScanNode) Open(ctx context.Context) error {
+	(*s).i = 0
+	return nil
+}
+
+func (s *StaticScanNode) Close() error {
+	return nil
+}
+
+func (s *StaticScanNode) Next() (*Record, error) {
 	index := (*s).i
 	max := len((*s).r)
 	if index >= max {
-		return nil
+		return nil, nil
 	}
 	ret := (*s).r[index]
 	(*s).i = (*s).i + 1
-	return &ret
+	return &ret, nil
+}
+
+func makeRecord(row_key string, name string, id string, year string) Record {
+	return Record{ key: row_key, values: map[string]Value {
+		"Name": StringValue(name),
+		"Id": StringValue(id),
+		"Year": StringValue(year),
+	}}
 }
 
 func makeMovies() []Record {
@@ -37,8 +56,8 @@ func makeMovies() []Record {
 	return []Record{ m1, m2, m3 }
 }
 
-func staticScanConstructor(p NodeParser, n *Node) Iterator {
-	return initStaticScan(makeMovies())
+func staticScanConstructor(p NodeParser, n *Node) (Iterator, error) {
+	return initStaticScan(makeMovies()), nil
 }
 
 func TestScanNode(t *testing.T) {
@@ -48,11 +67,11 @@ func TestScanNode(t *testing.T) {
 	scanner := initStaticScan(movies)
 	s := initScanNode(scanner)
 
-	r1 := s.next()
+	r1, _ := s.Next()
 	if !reflect.DeepEqual(*r1, m1) {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
-	r2 := s.next()
+	r2, _ := s.Next()
 	if !reflect.DeepEqual(*r2, m2) {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
@@ -66,15 +85,15 @@ func TestChildNode(t *testing.T) {
 	s := initScanNode(scanner)
 	l := initLimitNode(2, s)
 
-	r1 := l.next()
+	r1, _ := l.Next()
 	if !reflect.DeepEqual(*r1, m1) {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
-	r2 := l.next()
+	r2, _ := l.Next()
 	if !reflect.DeepEqual(*r2, m2) {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
-	r3 := l.next()
+	r3, _ := l.Next()
 	if r3 != nil {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
@@ -87,16 +106,16 @@ func TestSelectionNode(t *testing.T) {
 	scanner := initStaticScan(movies)
 	s := initScanNode(scanner)
 
-	left := initPredicateExpression("Id", EQ, "1")
+	left := initPredicateExpression("Id", EQ, StringValue("1"))
 	expression := initPredicateExpressions(left, AND, nil)
 
 	sel := initSelectionNode(expression, s)
 
-	r1 := sel.next()
+	r1, _ := sel.Next()
 	if !reflect.DeepEqual(*r1, m1)  {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
-	r2 := sel.next()
+	r2, _ := sel.Next()
 	if r2 != nil {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
@@ -111,13 +130,13 @@ func TestProjectionNode(t *testing.T) {
 
 	p := initProjectionNode([]string{"Name"}, s)
 
-	r1 := p.next()
-	expected_v, _ := (*r1).getColumn("Name")
-	actual_v, _ := m1.getColumn("Name")
+	r1, _ := p.Next()
+	expected_v := (*r1).getColumn("Name")
+	actual_v := m1.getColumn("Name")
 	if expected_v != actual_v {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
-	if expected_v, _ = (*r1).getColumn("Id"); expected_v != "" {
+	if expected_v = (*r1).getColumn("Id"); !expected_v.IsNull() {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
 }
@@ -133,23 +152,119 @@ func TestSortNode(t *testing.T) {
 	s := initScanNode(scanner)
 
 	sort := initSortNode(s, []SortTuple{
-		SortTuple{"Id", ASC},
+		SortTuple{ "Id", ASC, NULLS_LAST },
 	})
 
-	r1 := sort.next()
+	r1, _ := sort.Next()
 	if !reflect.DeepEqual(*r1, m1) {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
-	r2 := sort.next()
+	r2, _ := sort.Next()
 	if !reflect.DeepEqual(*r2, m2)  {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
-	r3 := sort.next()
+	r3, _ := sort.Next()
 	if !reflect.DeepEqual(*r3, m3) {
 		t.Errorf("Expected %s. Actual %s", m3, r3)
 	}
 }
 
+func TestSortNodeMultipleKeys(t *testing.T) {
+	movies := []Record{
+		makeRecord("1", "Movie A", "1", "2"),
+		makeRecord("2", "Movie B", "2", "1"),
+		makeRecord("3", "Movie A", "3", "1"),
+		makeRecord("4", "Movie C", "4", "2"),
+		makeRecord("5", "Movie B", "5", "2"),
+	}
+	movies[1].values["Name"] = NullValue()
+	cases := []struct {
+		tuples []SortTuple
+		expected []string
+	}{
+		{ []SortTuple{ { "Id", DESC, NULLS_LAST } }, []string{ "5", "4", "3", "2", "1" } },
+		{ []SortTuple{ { "Name", ASC, NULLS_LAST }, { "Id", DESC, NULLS_LAST } },
+			[]string{ "3", "1", "5", "4", "2" } },
+		{ []SortTuple{ { "Name", DESC, NULLS_FIRST }, { "Id", ASC, NULLS_LAST } },
+			[]string{ "2", "4", "5", "1", "3" } },
+		{ []SortTuple{ { "Name", DESC, NULLS_LAST } }, []string{ "4", "5", "1", "3", "2" } },
+		// equal records keep their order
+		{ []SortTuple{ { "Year", ASC, NULLS_LAST } }, []string{ "2", "3", "1", "4", "5" } },
+	}
+	for _, c := range(cases) {
+		sort := initSortNode(initStaticScan(movies), c.tuples)
+		actual := make([]string, 0)
+		for r, err := sort.Next(); r != nil || err != nil; r, err = sort.Next() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual = append(actual, r.Key())
+		}
+		if !slices.Equal(c.expected, actual) {
+			t.Errorf("%v: Expected %v. Actual %v", c.tuples, c.expected, actual)
+		}
+	}
+
+	sort := initSortNode(initStaticScan([]Record{}), []SortTuple{ { "Id", ASC, NULLS_LAST } })
+	if r, err := sort.Next(); r != nil || err != nil {
+		t.Errorf("Expected no record. Actual %v %v", r, err)
+	}
+	for _, args := range([]interface{}{
+		[]interface{}{ "Id" },
+		[]interface{}{ "Id:UP" },
+		[]interface{}{ "Id:ASC:NULLS_MIDDLE" },
+		[]interface{}{ ":ASC" },
+		[]interface{}{ "Id:ASC", 1.0 },
+		[]interface{}{},
+		"Id:ASC",
+		map[string]interface{}{ "sorted_args": []interface{}{ "Id:ASC" } },
+		nil,
+	}) {
+		if _, err := parseSortNodeArgs(args); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%v: Expected %v. Actual %v", args, ErrInvalidPlan, err)
+		}
+	}
+}
+
+func TestTopNNode(t *testing.T) {
+	tuples := []SortTuple{ { "Year", DESC, NULLS_LAST }, { "Name", ASC, NULLS_LAST } }
+	for _, limit := range([]uint32{ 0, 1, 7, 50, 200, 500 }) {
+		sort := initSortNode(initStaticScan(makeSortRecords()), tuples)
+		expected := make([]*Record, 0)
+		limited := initLimitNode(limit, sort)
+		for r, _ := limited.Next(); r != nil; r, _ = limited.Next() {
+			expected = append(expected, r)
+		}
+		top := initTopNNode(limit, tuples, initStaticScan(makeSortRecords()))
+		actual := make([]*Record, 0)
+		for r, err := top.Next(); r != nil || err != nil; r, err = top.Next() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual = append(actual, r)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%d: Expected %v. Actual %v", limit, expected, actual)
+		}
+	}
+
+	b := `{"head": { "name": "PROJECTION", "args": ["Name"], "child": {
+		"name": "LIMIT", "args": ["2"], "child": {
+			"name": "SORT", "args": ["Year:DESC"], "child": {
+				"name": "FILE_SCAN", "args": { "table": "movies" } } } } } }`
+	a_t, _ := generateTree(b)
+	planned, err := planQuery(a_t.Head)
+	expected := &Node{ "PROJECTION", []interface{}{ "Name" },
+		&Node{ "TOP_N", map[string]interface{}{ "limit": "2", "sort": []interface{}{ "Year:DESC" } },
+			&Node{ "FILE_SCAN", map[string]interface{}{ "table": "movies" }, nil } } }
+	if err != nil || !reflect.DeepEqual(expected, planned) {
+		t.Errorf("Expected %v. Actual %v %v", expected, planned, err)
+	}
+	if _, _, err := parseTopNNodeArgs(map[string]interface{}{ "sort": []interface{}{ "Year:DESC" } }); !errors.Is(err, ErrInvalidPlan) {
+		t.Errorf("Expected %v. Actual %v", ErrInvalidPlan, err)
+	}
+}
+
 func TestSelectionNodeAndPredicate(t *testing.T) {
 	m1 := makeRecord("1", "Movie 1", "1", "2")
 	m2 :=  makeRecord("2", "Movie 2", "1", "1")
@@ -157,17 +272,17 @@ func TestSelectionNodeAndPredicate(t *testing.T) {
 	scanner := initStaticScan(movies)
 	s := initScanNode(scanner)
 
-	left := initPredicateExpression("Id", EQ, "1")
-	right := initPredicateExpressions(initPredicateExpression("Year", EQ, "2"), AND, nil)
+	left := initPredicateExpression("Id", EQ, StringValue("1"))
+	right := initPredicateExpressions(initPredicateExpression("Year", EQ, StringValue("2")), AND, nil)
 	pexpressions := initPredicateExpressions(left, AND, right)
 
 	sel := initSelectionNode(pexpressions, s)
 
-	r1 := sel.next()
+	r1, _ := sel.Next()
 	if !reflect.DeepEqual(*r1, m1) {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
-	r2 := sel.next()
+	r2, _ := sel.Next()
 	if r2 != nil {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
@@ -181,21 +296,21 @@ func TestSelectionNodeOrPredicate(t *testing.T) {
 	scanner := initStaticScan(movies)
 	s := initScanNode(scanner)
 
-	left := initPredicateExpression("Id", EQ, "1")
-	right := initPredicateExpressions(initPredicateExpression( "Id", EQ, "2" ), AND, nil)
+	left := initPredicateExpression("Id", EQ, StringValue("1"))
+	right := initPredicateExpressions(initPredicateExpression("Id", EQ, StringValue("2")), AND, nil)
 	pexpressions := initPredicateExpressions(left, OR, right)
 
 	sel := initSelectionNode(pexpressions, s)
 
-	r1 := sel.next()
+	r1, _ := sel.Next()
 	if !reflect.DeepEqual(*r1, m1) {
 		t.Errorf("Expected %s. Actual %s", m1, r1)
 	}
-	r2 := sel.next()
+	r2, _ := sel.Next()
 	if !reflect.DeepEqual(*r2, m2) {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
-	r3 := sel.next()
+	r3, _ := sel.Next()
 	if r3 != nil {
 		t.Errorf("Expected %s. Actual %s", m2, r2)
 	}
@@ -212,10 +327,10 @@ func TestCountNode(t *testing.T) {
 	s := initScanNode(scanner)
 	c := initCountNode(s, []string{"Name"})
 
-	r1 := c.next()
-	expected_c1 := Record{ values: map[string]string{
-		"Name": "Movie 1",
-		"Count": "3",
+	r1, _ := c.Next()
+	expected_c1 := Record{ values: map[string]Value{
+		"Name": StringValue("Movie 1"),
+		"Count": IntValue(3),
 	}}
 	if !reflect.DeepEqual(*r1, expected_c1) {
 		t.Errorf("Expected %s. Actual %s", expected_c1, r1)
@@ -232,24 +347,24 @@ func TestCountNodeCompositeKey(t *testing.T) {
 	scanner := initStaticScan(movies)
 	s := initScanNode(scanner)
 	c := initCountNode(s, []string{"Name", "Id"})
-	sort := initSortNode(c, []SortTuple{ SortTuple{ "Name", ASC, }, SortTuple{ "Id", ASC, }  } )
+	sort := initSortNode(c, []SortTuple{ SortTuple{ "Name", ASC, NULLS_LAST }, SortTuple{ "Id", ASC, NULLS_LAST }  } )
 
-	r1 := sort.next()
-	expected_c1 := Record{ values: map[string]string{
-		"Name": "Movie 1",
-		"Id": "1",
-		"Count": "2",
+	r1, _ := sort.Next()
+	expected_c1 := Record{ values: map[string]Value{
+		"Name": StringValue("Movie 1"),
+		"Id": StringValue("1"),
+		"Count": IntValue(2),
 	}}
 	
 	if !reflect.DeepEqual(*r1, expected_c1) {
 		t.Errorf("Expected %s. Actual %s",  expected_c1, r1)
 	}
 
-	r2 := sort.next()
-	expected_c2 := Record{ values: map[string]string{
-		"Name": "Movie 1",
-		"Id": "3",
-		"Count": "1",
+	r2, _ := sort.Next()
+	expected_c2 := Record{ values: map[string]Value{
+		"Name": StringValue("Movie 1"),
+		"Id": StringValue("3"),
+		"Count": IntValue(1),
 	}}
 	if !reflect.DeepEqual(*r2, expected_c2) {
 		t.Errorf("Expected %s. Actual %s", expected_c2, r2)
@@ -262,7 +377,7 @@ func TestGenerateTree(t *testing.T) {
 	s := &Node{ "SCAN", []interface{}{"movies"}, nil }
 	e_t := &Tree { s }
 
-	a_t := generateTree(b)
+	a_t, _ := generateTree(b)
 
 	if !reflect.DeepEqual(a_t,e_t) {
 		t.Errorf("Expected %s. Actual %s", e_t, a_t)
@@ -275,8 +390,8 @@ func TestGenerateQueryTree(t *testing.T) {
 	}} }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	query_t, _ := transformToQueryTree(a_t)
 	scanner :=  initStaticScan(makeMovies())
 	expected_query_t := initScanNode(scanner)
 
@@ -290,7 +405,7 @@ func TestGenerateTreeProjection(t *testing.T) {
 	s := &Node{ "PROJECTION", []interface{}{"Name", "Id"}, nil }
 	e_t := &Tree { s }
 
-	a_t := generateTree(b)
+	a_t, _ := generateTree(b)
 	if !reflect.DeepEqual(a_t,e_t) {
 		t.Errorf("Expected %v. Actual %v", e_t, a_t)
 	}
@@ -300,12 +415,45 @@ func TestGenerateQueryTreeProjection(t *testing.T) {
 	b := ` {"head": { "name": "PROJECTION", "args": ["Name", "Id"], "child": {
 		"name": "STATIC_SCAN"
 	}} }`
-	a_t := generateTree(b)
-	query_t := transformToQueryTree(a_t)
-	expected_query_t := initProjectionNode([]string{"Name", "Id"}, nil)
+	a_t, _ := generateTree(b)
+	// STATIC_SCAN is not registered
+	query_t, err := transformToQueryTree(a_t)
+	if !errors.Is(err, ErrInvalidPlan) {
+		t.Errorf("Expected %v. Actual %#v, %v", ErrInvalidPlan, query_t, err)
+	}
+}
 
-	if !reflect.DeepEqual(query_t, expected_query_t) {
-		t.Errorf("Expected %#v. Actual %#v", expected_query_t, query_t)
+func TestGenerateQueryTreeInvalidArgs(t *testing.T) {
+	Registry["STATIC_SCAN"] = staticScanConstructor
+	defer delete(Registry, "STATIC_SCAN")
+	for _, head := range([]string{
+		`{ "name": "LIMIT", "args": ["ten"], "child": { "name": "STATIC_SCAN" } }`,
+		`{ "name": "SELECTION", "args": { "AND": [] }, "child": { "name": "STATIC_SCAN" } }`,
+		`{ "name": "SELECTION", "args": { "EQ": ["Id", "1"], "NOT": { "EQ": ["Id", "2"] } }, "child": { "name": "STATIC_SCAN" } }`,
+		`{ "name": "SELECTION", "args": { "OR": [ { "NOT": ["Id"] } ] }, "child": { "name": "STATIC_SCAN" } }`,
+		`{ "name": "SELECTION", "args": { "AND": { "EQ": ["Id"] } }, "child": { "name": "STATIC_SCAN" } }`,
+		`{ "name": "FILE_SCAN", "args": { "dir": "movies" } }`,
+	}) {
+		a_t, _ := generateTree(fmt.Sprintf(`{"head": %s }`, head))
+		if _, err := transformToQueryTree(a_t); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%s: Expected %v. Actual %v", head, ErrInvalidPlan, err)
+		}
+	}
+	if _, err := generateTree(`{"head": `); !errors.Is(err, ErrInvalidPlan) {
+		t.Errorf("Expected %v. Actual %v", ErrInvalidPlan, err)
+	}
+}
+
+func TestMissingColumnIsNull(t *testing.T) {
+	scanner := initStaticScan(makeMovies())
+	sel := initSelectionNode(initPredicateExpressions(
+		initPredicateExpression("Rating", EQ, StringValue("5")), AND, nil), scanner)
+	if r, err := sel.Next(); r != nil || err != nil {
+		t.Errorf("Expected no record. Actual %v %v", r, err)
+	}
+	p := initProjectionNode([]string{ "Rating" }, initStaticScan(makeMovies()))
+	if r, err := p.Next(); err != nil || !(*r).getColumn("Rating").IsNull() {
+		t.Errorf("Expected NULL. Actual %v %v", r, err)
 	}
 }
 
@@ -316,8 +464,8 @@ func TestGenerateQueryTreeProjectionWithChild(t *testing.T) {
 			} }} }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	query_t, _ := transformToQueryTree(a_t)
 	
 	scanner := initStaticScan(makeMovies())
 	scan_node := initScanNode(scanner)
@@ -328,6 +476,36 @@ func TestGenerateQueryTreeProjectionWithChild(t *testing.T) {
 	}
 }
 
+func TestComputedProjection(t *testing.T) {
+	Registry["STATIC_SCAN"] = staticScanConstructor
+	defer delete(Registry, "STATIC_SCAN")
+	b := `{"head": { "name": "PROJECTION", "args": ["Id",
+		{ "as": "Next", "expression": { "ADD": [{ "COLUMN": "Year" }, 1] } },
+		{ "as": "Title", "expression": { "COLUMN": "Name" } }
+		], "child": { "name": "STATIC_SCAN" } } }`
+	a_t, _ := generateTree(b)
+	it, err := transformToQueryTree(a_t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := collectRecords(t, it)
+	expected := map[string]Value{ "Id": StringValue("2"), "Next": IntValue(3), "Title": StringValue("Movie 2") }
+	if len(records) != 3 || !reflect.DeepEqual(expected, records[1].values) {
+		t.Errorf("Expected %v. Actual %v", expected, records)
+	}
+
+	for _, args := range([]interface{}{
+		[]interface{}{ "Id", map[string]interface{}{ "as": "Id", "expression": 1.0 } },
+		[]interface{}{ map[string]interface{}{ "expression": 1.0 } },
+		[]interface{}{ map[string]interface{}{ "as": "Id" } },
+		[]interface{}{ 1.0 },
+	}) {
+		if _, _, err := parseProjectionNodeArgs(args); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%v: Expected %v. Actual %v", args, ErrInvalidPlan, err)
+		}
+	}
+}
+
 func TestEvaluateQueryTreeProjectionWithChild(t *testing.T) {
 	b := ` {"head": { "name": "PROJECTION", "args": ["Name", "Id"], "child": {
 			"name": "SCAN", "args": {}, "child": {
@@ -335,15 +513,15 @@ func TestEvaluateQueryTreeProjectionWithChild(t *testing.T) {
 			}}} }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	actual_query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	actual_query_t, _ := transformToQueryTree(a_t)
 	
 	scanner := initStaticScan(makeMovies())
 	scan_node := initScanNode(scanner)
 	expected_query_t := initProjectionNode([]string{"Name", "Id"}, scan_node)
 
-	for expected := expected_query_t.next(); expected != nil; expected = expected_query_t.next() {
-		actual := actual_query_t.next()
+	for expected, _ := expected_query_t.Next(); expected != nil; expected, _ = expected_query_t.Next() {
+		actual, _ := actual_query_t.Next()
 		if !reflect.DeepEqual(expected, actual) {
 			t.Errorf("Expected %#v. Actual %#v", expected, actual)
 		}
@@ -356,7 +534,7 @@ func TestGenerateTreeLimit(t *testing.T) {
 	s := &Node{ "LIMIT", []interface{}{"1"}, nil }
 	e_t := &Tree { s }
 
-	a_t := generateTree(b)
+	a_t, _ := generateTree(b)
 	if !reflect.DeepEqual(a_t,e_t) {
 		t.Errorf("Expected %v. Actual %v", e_t, a_t)
 	}
@@ -364,8 +542,8 @@ func TestGenerateTreeLimit(t *testing.T) {
 
 func TestGenerateQueryTreeLimit(t *testing.T) {
 	b := ` {"head": { "name": "LIMIT", "args": ["1"], "child": null } }`
-	a_t := generateTree(b)
-	query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	query_t, _ := transformToQueryTree(a_t)
 	expected_query_t := initLimitNode(1, nil)
 
 	if !reflect.DeepEqual(expected_query_t, query_t) {
@@ -381,20 +559,20 @@ func TestEvaluateQueryLimit(t *testing.T) {
 	} } }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	actual_query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	actual_query_t, _ := transformToQueryTree(a_t)
 	
 	scanner := initStaticScan(makeMovies())
 	scan_node := initScanNode(scanner)
 	expected_query_t := initLimitNode(1, scan_node)
 
-	expected := expected_query_t.next()
-	actual := actual_query_t.next()
+	expected, _ := expected_query_t.Next()
+	actual, _ := actual_query_t.Next()
 	if !reflect.DeepEqual(expected, actual) {
 		t.Errorf("Expected %#v. Actual %#v", expected, actual)
 	}
 
-	if actual_query_t.next() != nil {
+	if actual, _ := actual_query_t.Next(); actual != nil {
 		t.Errorf("Expected nil. Actual %#v", actual)
 	}
 }
@@ -404,7 +582,7 @@ func TestGenerateTreeCount(t *testing.T) {
 	s := &Node{ "COUNT", []interface{}{"Name"}, nil }
 	e_t := &Tree { s }
 
-	a_t := generateTree(b)
+	a_t, _ := generateTree(b)
 	if !reflect.DeepEqual(a_t,e_t) {
 		t.Errorf("Expected %v. Actual %v", e_t, a_t)
 	}
@@ -412,8 +590,8 @@ func TestGenerateTreeCount(t *testing.T) {
 
 func TestGenerateQueryTreeCount(t *testing.T) {
 	b := ` {"head": { "name": "COUNT", "args": ["Name"], "child": null } }`
-	a_t := generateTree(b)
-	query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	query_t, _ := transformToQueryTree(a_t)
 	expected_query_t := initCountNode(nil, []string{"Name"})
 
 	if !reflect.DeepEqual(expected_query_t, query_t) {
@@ -427,30 +605,30 @@ func TestEvaluateQueryCount(t *testing.T) {
 	} } }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	actual_query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	actual_query_t, _ := transformToQueryTree(a_t)
 	
 	scanner := initStaticScan(makeMovies())
 	scan_node := initScanNode(scanner)
 	expected_query_t := initCountNode(scan_node, []string{"Name"})
 
 	expected_arr := make([]Record, 0)
-	for v := expected_query_t.next(); v!= nil; v = expected_query_t.next() {
+	for v, _ := expected_query_t.Next(); v!= nil; v, _ = expected_query_t.Next() {
 		expected_arr = append(expected_arr, *v)
 		slices.SortFunc(expected_arr, func(a, b Record) int {
-			if a.values["Name"] < b.values["Name"] { return -1 }
-			if a.values["Id"] < b.values["Id"] { return -1 }
-			if a.values["Year"] < b.values["Year"] { return -1 }
+			if a.values["Name"].String() < b.values["Name"].String() { return -1 }
+			if a.values["Id"].String() < b.values["Id"].String() { return -1 }
+			if a.values["Year"].String() < b.values["Year"].String() { return -1 }
 			return 0
 		})
 	}
 	actual_arr := make([]Record, 0)
-	for v := actual_query_t.next(); v!= nil; v = actual_query_t.next() {
+	for v, _ := actual_query_t.Next(); v!= nil; v, _ = actual_query_t.Next() {
 		actual_arr = append(actual_arr, *v)
 		slices.SortFunc(actual_arr, func(a, b Record) int {
-			if a.values["Name"] < b.values["Name"] { return -1 }
-			if a.values["Id"] < b.values["Id"] { return -1 }
-			if a.values["Year"] < b.values["Year"] { return -1 }
+			if a.values["Name"].String() < b.values["Name"].String() { return -1 }
+			if a.values["Id"].String() < b.values["Id"].String() { return -1 }
+			if a.values["Year"].String() < b.values["Year"].String() { return -1 }
 			return 0
 		})
 	}
@@ -466,7 +644,7 @@ func TestGenerateTreeSelectionSingleton(t *testing.T) {
 	s := &Node{ "SELECTION", []interface{}{[]interface{}{"Id", "EQ", "1"}}, nil }
 	e_t := &Tree { s }
 
-	a_t := generateTree(b)
+	a_t, _ := generateTree(b)
 	if !reflect.DeepEqual(a_t,e_t) {
 		t.Errorf("Expected %v. Actual %v", e_t, a_t)
 	}
@@ -476,9 +654,9 @@ func TestGenerateQueryTreeSelectionSingleton(t *testing.T) {
 	b := ` {"head": { "name": "SELECTION", "args": {"AND": {
 		"EQ": ["Id", "1"]
 	}}, "child": null } }`
-	a_t := generateTree(b)
-	query_t := transformToQueryTree(a_t)
-	left := initPredicateExpression("Id", EQ, "1")
+	a_t, _ := generateTree(b)
+	query_t, _ := transformToQueryTree(a_t)
+	left := initPredicateExpression("Id", EQ, StringValue("1"))
 	exp := initPredicateExpressions(left, AND, nil)
 	expected_query_t := initSelectionNode(exp, nil)
 
@@ -497,22 +675,22 @@ func TestEvaluateSelectionQueryTreeSingleton(t *testing.T) {
 	} } }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	actual_query_t := transformToQueryTree(a_t)
-	left := initPredicateExpression("Id", EQ, "1")
+	a_t, _ := generateTree(b)
+	actual_query_t, _ := transformToQueryTree(a_t)
+	left := initPredicateExpression("Id", EQ, StringValue("1"))
 	exp := initPredicateExpressions(left, AND, nil)
 	
 	scanner := initStaticScan(makeMovies())
 	scan_node := initScanNode(scanner)
 	expected_query_t := initSelectionNode(exp, scan_node)
 
-	expected := expected_query_t.next()
-	actual := actual_query_t.next()
+	expected, _ := expected_query_t.Next()
+	actual, _ := actual_query_t.Next()
 	if !reflect.DeepEqual(expected, actual) {
 		t.Errorf("Expected %#v. Actual %#v", expected, actual)
 	}
 
-	if actual = actual_query_t.next(); actual != nil {
+	if actual, _ = actual_query_t.Next(); actual != nil {
 		t.Errorf("Expected nil. Actual %#v", actual)
 	}
 }
@@ -531,7 +709,7 @@ func TestGenerateTreeSelectionMultipleExpressions(t *testing.T) {
 			"OR": map[string]interface{}{"EQ": []interface{}{"Year", "1"}}}}, nil}
 	e_t := &Tree { s }
 
-	a_t := generateTree(b)
+	a_t, _ := generateTree(b)
 	if !reflect.DeepEqual(a_t,e_t) {
 		t.Errorf("Expected %v. Actual %v", e_t, a_t)
 	}
@@ -545,10 +723,10 @@ func TestGenerateQueryTreeSelectionMultipleExpressions(t *testing.T) {
 				"EQ": ["Year", "1"]
 			}
 		}}, "child": null } }`
-	a_t := generateTree(b)
-	query_t := transformToQueryTree(a_t)
-	left := initPredicateExpression("Id", EQ, "1")
-	right_exp := initPredicateExpression("Year", EQ, "1")
+	a_t, _ := generateTree(b)
+	query_t, _ := transformToQueryTree(a_t)
+	left := initPredicateExpression("Id", EQ, StringValue("1"))
+	right_exp := initPredicateExpression("Year", EQ, StringValue("1"))
 	right := initPredicateExpressions(right_exp, OR, nil)
 	exp := initPredicateExpressions(left, AND, right)
 	expected_query_t := initSelectionNode(exp, nil)
@@ -558,12 +736,115 @@ func TestGenerateQueryTreeSelectionMultipleExpressions(t *testing.T) {
 	}
 }
 
+func TestNestedPredicates(t *testing.T) {
+	Registry["STATIC_SCAN"] = staticScanConstructor
+	defer delete(Registry, "STATIC_SCAN")
+	cases := []struct {
+		args string
+		expected []string
+	}{
+		{ `{ "AND": [ { "OR": [ { "EQ": ["Id", "1"] }, { "EQ": ["Id", "2"] } ] },
+			{ "OR": [ { "EQ": ["Year", "2"] }, { "EQ": ["Year", "3"] } ] } ] }`, []string{ "2" } },
+		{ `{ "NOT": { "OR": [ { "EQ": ["Id", "1"] }, { "GT": ["Year", "2"] } ] } }`, []string{ "2" } },
+		{ `{ "NOT": { "EQ": ["Rating", "5"] } }`, []string{} },
+		{ `{ "NOT": { "IS_NULL": ["Rating"] } }`, []string{} },
+		{ `{ "LT": ["Id", "3"] }`, []string{ "1", "2" } },
+		// a chain ends with its last comparison whatever its operator
+		{ `{ "AND": { "GT": ["Id", "1"], "OR": { "EQ": ["Year", "3"] } } }`, []string{ "3" } },
+		{ `{ "OR": { "EQ": ["Id", "1"] } }`, []string{ "1" } },
+	}
+	for _, c := range(cases) {
+		b := fmt.Sprintf(`{"head": { "name": "SELECTION", "args": %s, "child": { "name": "STATIC_SCAN" } } }`, c.args)
+		a_t, err := generateTree(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := queryKeys(t, a_t); !slices.Equal(c.expected, actual) {
+			t.Errorf("%s: Expected %v. Actual %v", c.args, c.expected, actual)
+		}
+	}
+
+	// the comparison of Name with a number fails, unless it is not evaluated
+	m1 := makeRecord("1", "Movie 1", "1", "1")
+	failing := initPredicateLeaf(initPredicateExpression("Name", EQ, IntValue(1)))
+	no := initPredicateLeaf(initPredicateExpression("Id", EQ, StringValue("2")))
+	yes := initPredicateLeaf(initPredicateExpression("Id", EQ, StringValue("1")))
+	for _, p := range([]*predicateTree{ initPredicateTree(AND, no, failing), initPredicateTree(OR, yes, failing) }) {
+		if _, err := evaluatePredicates(p, &m1); err != nil {
+			t.Errorf("Expected no error. Actual %v", err)
+		}
+	}
+	if _, err := evaluatePredicates(initPredicateTree(AND, yes, failing), &m1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected %v. Actual %v", ErrTypeMismatch, err)
+	}
+}
+
+func TestPredicateOperators(t *testing.T) {
+	Registry["STATIC_SCAN"] = staticScanConstructor
+	defer delete(Registry, "STATIC_SCAN")
+	cases := []struct {
+		args string
+		expected []string
+	}{
+		{ `{ "NE": ["Id", "2"] }`, []string{ "1", "3" } },
+		{ `{ "IN": ["Id", ["3", "1", "7"]] }`, []string{ "1", "3" } },
+		{ `{ "NOT_IN": ["Id", ["3", "1"]] }`, []string{ "2" } },
+		// NOT IN a list holding NULL is never true
+		{ `{ "NOT_IN": ["Id", ["3", null]] }`, []string{} },
+		{ `{ "IN": ["Id", ["3", null]] }`, []string{ "3" } },
+		{ `{ "BETWEEN": ["Id", "2", "3"] }`, []string{ "2", "3" } },
+		{ `{ "NOT": { "BETWEEN": ["Id", "2", "3"] } }`, []string{ "1" } },
+		{ `{ "LIKE": ["Name", "Movie _"] }`, []string{ "1", "2", "3" } },
+		{ `{ "LIKE": ["Name", "%2"] }`, []string{ "2" } },
+		{ `{ "LIKE": ["Name", "movie%"] }`, []string{} },
+		{ `{ "LIKE": ["Name", "Movie\\_%"] }`, []string{} },
+		{ `{ "STARTS_WITH": ["Name", "Movie "] }`, []string{ "1", "2", "3" } },
+		{ `{ "REGEXP": ["Name", "[13]$"] }`, []string{ "1", "3" } },
+		{ `{ "LIKE": ["Rating", "%"] }`, []string{} },
+		{ `{ "EQ": ["Year", { "COLUMN": "Id" }] }`, []string{ "1", "2", "3" } },
+		{ `{ "LT": [{ "ADD": [{ "COLUMN": "Id" }, 1] }, 3] }`, []string{ "1" } },
+		{ `{ "IN": [{ "CONCAT": ["#", { "COLUMN": "Id" }] }, ["#2"]] }`, []string{ "2" } },
+	}
+	for _, c := range(cases) {
+		b := fmt.Sprintf(`{"head": { "name": "SELECTION", "args": %s, "child": { "name": "STATIC_SCAN" } } }`, c.args)
+		a_t, err := generateTree(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := queryKeys(t, a_t); !slices.Equal(c.expected, actual) {
+			t.Errorf("%s: Expected %v. Actual %v", c.args, c.expected, actual)
+		}
+	}
+
+	for _, args := range([]string{
+		`{ "IN": ["Id", "1"] }`,
+		`{ "BETWEEN": ["Id", "1"] }`,
+		`{ "LIKE": ["Name", 1] }`,
+		`{ "REGEXP": ["Name", "("] }`,
+		`{ "NE": ["Id"] }`,
+		`{ "MATCHES": ["Id", "1"] }`,
+	}) {
+		b := fmt.Sprintf(`{"head": { "name": "SELECTION", "args": %s, "child": { "name": "STATIC_SCAN" } } }`, args)
+		a_t, _ := generateTree(b)
+		if _, err := (Engine{ Registry, nil, 0 }).Compile(a_t); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%s: Expected %v. Actual %v", args, ErrInvalidPlan, err)
+		}
+	}
+
+	m1 := makeRecord("1", "Movie 1", "1", "1")
+	m1.values["Year"] = IntValue(1)
+	like, _ := initPredicatePattern("Year", LIKE, "1")
+	if _, err := evaluatePredicate(like, &m1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected %v. Actual %v", ErrTypeMismatch, err)
+	}
+}
+
 func TestGenerateQueryTreeSelectionMultipleExpr(t *testing.T) {
 	b := ` {"head": { "name": "SELECTION", "args": {
 		"AND": {
 			"EQ": ["Id", "1"],
 			"OR": {
-				"EQ": ["Year", "2"]
+				"EQ": ["Year", "1"]
 			}
 		}}, "child": {
 			"name": "SCAN", "args": {}, "child": {
@@ -572,10 +853,10 @@ func TestGenerateQueryTreeSelectionMultipleExpr(t *testing.T) {
 		}} }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	actual_query_t := transformToQueryTree(a_t)
-	left := initPredicateExpression("Id", EQ, "1")
-	right_exp := initPredicateExpression("Year", EQ, "1")
+	a_t, _ := generateTree(b)
+	actual_query_t, _ := transformToQueryTree(a_t)
+	left := initPredicateExpression("Id", EQ, StringValue("1"))
+	right_exp := initPredicateExpression("Year", EQ, StringValue("1"))
 	right := initPredicateExpressions(right_exp, OR, nil)
 	exp := initPredicateExpressions(left, AND, right)
 
@@ -583,14 +864,14 @@ func TestGenerateQueryTreeSelectionMultipleExpr(t *testing.T) {
 	scan_node := initScanNode(scanner)
 	expected_query_t := initSelectionNode(exp, scan_node)
 
-	expected := expected_query_t.next()
-	actual := actual_query_t.next()
+	expected, _ := expected_query_t.Next()
+	actual, _ := actual_query_t.Next()
 	if !reflect.DeepEqual(expected, actual) {
 		t.Errorf("Expected %v. Actual %v", expected, actual)
 	}
 
-	expected = expected_query_t.next()
-	actual = actual_query_t.next()
+	expected, _ = expected_query_t.Next()
+	actual, _ = actual_query_t.Next()
 
 	if !reflect.DeepEqual(expected, actual) {
 		t.Errorf("Expected %v. Actual %v", expected, actual)
@@ -598,44 +879,43 @@ func TestGenerateQueryTreeSelectionMultipleExpr(t *testing.T) {
 }
 
 func TestGenerateTreeSortNode(t *testing.T) {
-	b := `{"head": { "name": "SORT", "args": {
-		"sorted_args": ["Id:ASC"]
-	}, "child": null } }`
-	s := &Node{ "SORT", map[string]interface{}{
-		"sorted_args": []interface{}{"Id:ASC"},
-		}, nil}
+	b := `{"head": { "name": "SORT", "args": ["Id:ASC"], "child": null } }`
+	s := &Node{ "SORT", []interface{}{"Id:ASC"}, nil}
 	e_t := &Tree { s }
 
-	a_t := generateTree(b)
+	a_t, _ := generateTree(b)
 	if !reflect.DeepEqual(a_t,e_t) {
 		t.Errorf("Expected %v. Actual %v", e_t, a_t)
 	}
 }
 
 func TestGenerateQueryTreeSortNode(t *testing.T) {
-	b := `{"head": { "name": "SORT", "args": {
-		"sorted_args": ["Id:DESC"]
-	}, "child": {
+	b := `{"head": { "name": "SORT", "args": ["Id:DESC"], "child": {
 		"name": "SCAN", "args": {}, "child": {
 			"name": "STATIC_SCAN"
 		}
 	}} }`
 	Registry["STATIC_SCAN"] = staticScanConstructor
 	defer delete(Registry, "STATIC_SCAN")
-	a_t := generateTree(b)
-	actual_query_t := transformToQueryTree(a_t)
+	a_t, _ := generateTree(b)
+	actual_query_t, _ := transformToQueryTree(a_t)
 
 	scanner := initStaticScan(makeMovies())
 	scan_node := initScanNode(scanner)
 	sort_node := initSortNode(scan_node, []SortTuple{
-		SortTuple{ "Id", DESC },
+		SortTuple{ "Id", DESC, NULLS_LAST },
 	})
 
-	for n := actual_query_t.next(); n != nil; n = actual_query_t.next() {
-		e := sort_node.next()
+	count := 0
+	for n, _ := actual_query_t.Next(); n != nil; n, _ = actual_query_t.Next() {
+		e, _ := sort_node.Next()
 		if !reflect.DeepEqual(n, e) {
 			t.Errorf("Expected %v. Actual %v", e, n)
 		}
+		count += 1
+	}
+	if count != len(makeMovies()) {
+		t.Errorf("Expected %d records. Actual %d", len(makeMovies()), count)
 	}
 }
 
@@ -648,22 +928,21 @@ func TestFileScanNodeGroup(t *testing.T) {
 		if err != nil && !os.IsExist(err) {
 			log.Fatal(err)
 		}
-		wr := initStorageWriter(dir, 0, true)
+		wr, _ := initStorageWriter(dir, 0, true, nil)
 		records := makeMovies()
 		d := make([]Data, 0)
 		for _, r := range(records) {
 			size := len(r.key)
 			cols := make([]Column, 0)
 			for name, val := range(r.values) {
-				size += len(name) + len(val)
+				size += len(name) + len(val.payload())
 				cols = append(cols, Column{ name, val })
 			}
 			d = append(d, Data{ r.key, cols, uint32(size) })
 		}
 		for _, r := range(d) {
-			succeeded := wr.Write(&r)
-			if !succeeded {
-				t.Errorf("Failed to write data")
+			if err := wr.Write(&r); err != nil {
+				t.Errorf("Failed to write data: %v", err)
 			}
 		}
 		wr.Flush()
@@ -680,15 +959,21 @@ func TestFileScanNodeGroup(t *testing.T) {
 		b := fmt.Sprintf(`{"head": { "name": "SCAN", "args": {}, "child": {
 			"name": "FILE_SCAN", "args": {"dir": "%s", "file_number": "0"}
 		}} }`, dir)
-		a_t := generateTree(b)
-		actual_query_t := transformToQueryTree(a_t)
+		a_t, _ := generateTree(b)
+		actual_query_t, _ := transformToQueryTree(a_t)
 		
-		reader := initStorageReader(dir, 0, true)
+		reader, _ := initStorageReader(dir, 0, true, nil)
 		fscan_node := initFileScanNode(reader)
 		scan_node := initScanNode(fscan_node)
-		
-		for n := actual_query_t.next(); n != nil; n = actual_query_t.next() {
-			e := scan_node.next()
+		for _, it := range([]Iterator{ actual_query_t, scan_node }) {
+			if err := it.Open(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+		}
+
+		for n, _ := actual_query_t.Next(); n != nil; n, _ = actual_query_t.Next() {
+			e, _ := scan_node.Next()
 			if !reflect.DeepEqual(n, e) {
 				t.Errorf("Expected %v. Actual %v", e, n)
 			}
@@ -698,3 +983,326 @@ func TestFileScanNodeGroup(t *testing.T) {
 
 
 
+func TestFileScanAcrossSegments(t *testing.T) {
+	const dir = "./db_segments_test"
+	if err := os.Mkdir(dir, 0750); err != nil && !os.IsExist(err) {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wr, _ := initStorageWriter(dir, 0, true, nil)
+	expected := make([]string, 0)
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("%03d", i)
+		if err := wr.Write(&Data{ key, []Column{ Column{ "Name", StringValue("Movie") } }, uint32(len(key) + 9) }); err != nil {
+			t.Fatalf("Failed to write data %d", i)
+		}
+		expected = append(expected, key)
+	}
+	wr.Flush()
+
+	reader, _ := initStorageReader(dir, 0, true, nil)
+	if reader.Segments() < 2 {
+		t.Errorf("Expected more than 1 segment. Actual %d", reader.Segments())
+	}
+	scan := initFileScanNode(reader)
+	scan.Open(context.Background())
+	defer scan.Close()
+	actual := make([]string, 0)
+	for r, _ := scan.Next(); r != nil; r, _ = scan.Next() {
+		actual = append(actual, r.key)
+	}
+	if !slices.Equal(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+}
+
+func writeMovies(t *testing.T, dir string, records []Record) {
+	t.Helper()
+	if err := os.Mkdir(dir, 0750); err != nil && !os.IsExist(err) {
+		log.Fatal(err)
+	}
+	wr, _ := initStorageWriter(dir, 0, true, nil)
+	for _, r := range(records) {
+		size := len(r.key)
+		cols := make([]Column, 0)
+		for _, name := range([]string{ "Name", "Id", "Year" }) {
+			size += len(name) + len(r.values[name].payload())
+			cols = append(cols, Column{ name, r.values[name] })
+		}
+		if err := wr.Write(&Data{ r.key, cols, uint32(size) }); err != nil {
+			t.Fatalf("Failed to write data")
+		}
+	}
+	wr.Flush()
+}
+
+func collectKeys(it Iterator) []string {
+	it.Open(context.Background())
+	defer it.Close()
+	keys := make([]string, 0)
+	for r, _ := it.Next(); r != nil; r, _ = it.Next() {
+		keys = append(keys, r.key)
+	}
+	return keys
+}
+
+func collectRecords(t *testing.T, it Iterator) []*Record {
+	t.Helper()
+	if err := it.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	records := make([]*Record, 0)
+	for {
+		r, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil {
+			return records
+		}
+		records = append(records, r)
+	}
+}
+
+func queryKeys(t *testing.T, a_t *Tree) []string {
+	t.Helper()
+	it, err := transformToQueryTree(a_t)
+	if err != nil {
+		t.Fatalf("Failed to build query tree: %v", err)
+	}
+	return collectKeys(it)
+}
+
+func TestIndexScanNode(t *testing.T) {
+	const dir = "./db_index_test"
+	records := make([]Record, 0)
+	for _, i := range([]int{ 4, 1, 3, 5, 2 }) {
+		k := fmt.Sprintf("%d", i)
+		records = append(records, makeRecord(k, "Movie " + k, k, "2000"))
+	}
+	writeMovies(t, dir, records)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		args string
+		expected []string
+	}{
+		{ `"key": "3"`, []string{ "3" } },
+		{ `"key": "6"`, []string{} },
+		{ `"lo": "2", "hi": "4"`, []string{ "2", "3" } },
+		{ `"lo": "4"`, []string{ "4", "5" } },
+		{ `"hi": "3"`, []string{ "1", "2" } },
+	}
+	for _, c := range(cases) {
+		b := fmt.Sprintf(`{"head": { "name": "INDEX_SCAN", "args": {
+			"dir": "%s", "file_number": "0", %s } } }`, dir, c.args)
+		a_t, _ := generateTree(b)
+		actual := queryKeys(t, a_t)
+		if !slices.Equal(c.expected, actual) {
+			t.Errorf("%s: Expected %v. Actual %v", c.args, c.expected, actual)
+		}
+	}
+}
+
+func TestPlanQueryRewritesKeySelection(t *testing.T) {
+	const dir = "./db_plan_test"
+	records := make([]Record, 0)
+	for i := 1; i <= 5; i++ {
+		k := fmt.Sprintf("%d", i)
+		year := "2000"
+		if i % 2 == 0 { year = "2001" }
+		records = append(records, makeRecord(k, "Movie " + k, k, year))
+	}
+	writeMovies(t, dir, records)
+	defer os.RemoveAll(dir)
+
+	b := fmt.Sprintf(`{"head": { "name": "SELECTION", "args": {
+		"AND": {
+			"GT": ["_key", "1"],
+			"AND": {
+				"EQ": ["Year", "2000"],
+				"AND": { "LT_E": ["_key", "5"] }
+			}
+		}}, "child": {
+			"name": "FILE_SCAN", "args": {"dir": "%s", "file_number": "0"}
+		}} }`, dir)
+	a_t, _ := generateTree(b)
+	planned, _ := planQuery(a_t.Head)
+	expected := &Node{ "SELECTION", map[string]interface{}{ "EQ": []interface{}{ "Year", "2000" } },
+		&Node{ "INDEX_SCAN", map[string]interface{}{
+			"dir": dir, "file_number": "0", "lo": "1\x00", "hi": "5\x00",
+		}, nil } }
+	if !reflect.DeepEqual(expected, planned) {
+		t.Errorf("Expected %#v. Actual %#v", expected, planned)
+	}
+
+	actual := queryKeys(t, a_t)
+	if !slices.Equal([]string{ "3", "5" }, actual) {
+		t.Errorf("Expected %v. Actual %v", []string{ "3", "5" }, actual)
+	}
+
+	// OR cannot be answered from the index alone
+	b = fmt.Sprintf(`{"head": { "name": "SELECTION", "args": {
+		"OR": { "EQ": ["_key", "1"], "AND": { "EQ": ["Year", "2001"] } }
+		}, "child": {
+			"name": "FILE_SCAN", "args": {"dir": "%s", "file_number": "0"}
+		}} }`, dir)
+	a_t, _ = generateTree(b)
+	if planned, _ := planQuery(a_t.Head); planned.Child.Name != "FILE_SCAN" {
+		t.Errorf("Expected FILE_SCAN. Actual %s", planned.Child.Name)
+	}
+}
+
+func TestPlanQueryPushesDownKeyRanges(t *testing.T) {
+	scan := map[string]interface{}{ "dir": "d", "file_number": "0" }
+	cases := []struct {
+		args string
+		lo string
+		hi string
+		residual interface{}
+	}{
+		{ `{ "STARTS_WITH": ["_key", "ab"] }`, "ab", "ac", nil },
+		{ `{ "BETWEEN": ["_key", "2", "4"] }`, "2", "4\x00", nil },
+		{ `{ "LIKE": ["_key", "ab%"] }`, "ab", "ac", nil },
+		{ `{ "LIKE": ["_key", "ab_c"] }`, "ab", "ac",
+			map[string]interface{}{ "LIKE": []interface{}{ "_key", "ab_c" } } },
+	}
+	for _, c := range(cases) {
+		b := fmt.Sprintf(`{"head": { "name": "SELECTION", "args": %s, "child": {
+			"name": "FILE_SCAN", "args": {"dir": "d", "file_number": "0"} } } }`, c.args)
+		a_t, err := generateTree(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		planned, err := planQuery(a_t.Head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := planned
+		if c.residual != nil {
+			if !reflect.DeepEqual(c.residual, planned.Args) {
+				t.Errorf("%s: Expected %v. Actual %v", c.args, c.residual, planned.Args)
+			}
+			index = planned.Child
+		}
+		args, _ := index.Args.(map[string]interface{})
+		if index.Name != "INDEX_SCAN" || args["lo"] != c.lo || args["hi"] != c.hi || args["dir"] != scan["dir"] {
+			t.Errorf("%s: Expected INDEX_SCAN [%q, %q). Actual %s %v", c.args, c.lo, c.hi, index.Name, index.Args)
+		}
+	}
+
+	// a LIKE starting with a wildcard has no range, nor a comparison with a column
+	for _, args := range([]string{ `{ "LIKE": ["_key", "%b"] }`, `{ "EQ": ["_key", { "COLUMN": "Id" }] }` }) {
+		a_t, _ := generateTree(fmt.Sprintf(`{"head": { "name": "SELECTION", "args": %s, "child": {
+			"name": "FILE_SCAN", "args": {"dir": "d", "file_number": "0"} } } }`, args))
+		if planned, _ := planQuery(a_t.Head); planned.Child.Name != "FILE_SCAN" {
+			t.Errorf("%s: Expected FILE_SCAN. Actual %s", args, planned.Child.Name)
+		}
+	}
+	if end := prefixEnd("a\xff"); end != "b" {
+		t.Errorf("Expected %q. Actual %q", "b", end)
+	}
+	if end := prefixEnd("\xff\xff"); end != "" {
+		t.Errorf("Expected no end. Actual %q", end)
+	}
+}
+
+func TestPlanQueryKeepsTypedKeyComparisons(t *testing.T) {
+	const dir = "./db_key_type_test"
+	records := make([]Record, 0)
+	for i := 1; i <= 12; i++ {
+		k := fmt.Sprintf("%d", i)
+		records = append(records, makeRecord(k, "Movie " + k, k, "2000"))
+	}
+	writeMovies(t, dir, records)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		args string
+		scan string
+		expected []string
+	}{
+		// an int compares the keys as ints, which the index cannot range over
+		{ `{ "GT_E": ["_key", 9] }`, "FILE_SCAN", []string{ "10", "11", "12", "9" } },
+		{ `{ "LT": ["_key", 2] }`, "FILE_SCAN", []string{ "1" } },
+		{ `{ "AND": [{ "GT_E": ["_key", "1"] }, { "LT_E": ["_key", 10] }] }`, "INDEX_SCAN",
+			[]string{ "1", "10", "2", "3", "4", "5", "6", "7", "8", "9" } },
+		{ `{ "GT_E": ["_key", "9"] }`, "INDEX_SCAN", []string{ "9" } },
+		{ `{ "BETWEEN": ["_key", 2, 10] }`, "FILE_SCAN",
+			[]string{ "10", "2", "3", "4", "5", "6", "7", "8", "9" } },
+		// "10" is before "2", but not after 10
+		{ `{ "BETWEEN": ["_key", "2", 10] }`, "FILE_SCAN", []string{ "2", "3", "4", "5", "6", "7", "8", "9" } },
+		{ `{ "BETWEEN": ["_key", "10", "2"] }`, "INDEX_SCAN",
+			[]string{ "10", "11", "12", "2" } },
+	}
+	for _, c := range(cases) {
+		b := fmt.Sprintf(`{"head": { "name": "SELECTION", "args": %s, "child": {
+			"name": "FILE_SCAN", "args": {"dir": "%s", "file_number": "0"} } } }`, c.args, dir)
+		a_t, err := generateTree(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		planned, err := planQuery(a_t.Head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scan := planned
+		for scan.Child != nil {
+			scan = scan.Child
+		}
+		if scan.Name != c.scan {
+			t.Errorf("%s: Expected %s. Actual %s", c.args, c.scan, scan.Name)
+		}
+		actual := queryKeys(t, a_t)
+		slices.Sort(actual)
+		if !slices.Equal(c.expected, actual) {
+			t.Errorf("%s: Expected %v. Actual %v", c.args, c.expected, actual)
+		}
+	}
+}
+
+func TestIteratorOpenClose(t *testing.T) {
+	const dir = "./db_iterator_test"
+	records := make([]Record, 0)
+	for i := 1; i <= 3; i++ {
+		k := fmt.Sprintf("%d", i)
+		records = append(records, makeRecord(k, "Movie " + k, k, "2000"))
+	}
+	writeMovies(t, dir, records)
+	defer os.RemoveAll(dir)
+
+	b := fmt.Sprintf(`{"head": { "name": "LIMIT", "args": ["2"], "child": {
+		"name": "FILE_SCAN", "args": {"dir": "%s", "file_number": "0"}
+		}} }`, dir)
+	a_t, _ := generateTree(b)
+	it, err := transformToQueryTree(a_t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the files of the table are only opened by Open
+	scan := (*it.(*LimitNode).child).(*FileScan)
+	if scan.reader != nil {
+		t.Errorf("Expected no reader before Open")
+	}
+	// a plan can be run again once closed
+	for run := 0; run < 2; run++ {
+		if actual := collectKeys(it); !slices.Equal([]string{ "1", "2" }, actual) {
+			t.Errorf("Expected %v. Actual %v", []string{ "1", "2" }, actual)
+		}
+		if scan.reader != nil {
+			t.Errorf("Expected the reader to be closed")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := it.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	cancel()
+	if _, err := it.Next(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v. Actual %v", context.Canceled, err)
+	}
+}
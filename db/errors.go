@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+)
+
+/*
+Errors returned by the storage layer and the query engine. They are wrapped
+with the details of the failure, so compare them with errors.Is.
+*/
+var (
+	// a record has no such column
+	ErrColumnNotFound = errors.New("column not found")
+	// a data, index, manifest or log file does not follow its format
+	ErrCorruptFile = errors.New("corrupt file")
+	// a row, or its index entry, does not fit in an empty segment
+	ErrNoSpace = errors.New("no space left")
+	// the table has no row with the key
+	ErrKeyNotFound = errors.New("key not found")
+	// invalid storage options
+	ErrInvalidOptions = errors.New("invalid storage options")
+	// a node of a query plan is unknown or has invalid arguments
+	ErrInvalidPlan = errors.New("invalid query plan")
+	// a SQL query does not follow the grammar in sql.go
+	ErrSyntax = errors.New("syntax error")
+	// values of different types are compared, or a value does not parse as
+	// the type it is compared with
+	ErrTypeMismatch = errors.New("type mismatch")
+	// an expression divides by zero
+	ErrDivisionByZero = errors.New("division by zero")
+	// the result of integer arithmetic does not fit in an int
+	ErrOverflow = errors.New("integer overflow")
+	// the catalog has no table with the name
+	ErrTableNotFound = errors.New("table not found")
+	// a table with the name already exists
+	ErrTableExists = errors.New("table already exists")
+	// a table definition is invalid, or a row does not match the schema of its
+	// table
+	ErrSchema = errors.New("schema violation")
+	// a function to register has no callback, an invalid type or the name of
+	// another function
+	ErrInvalidFunction = errors.New("invalid function")
+)
@@ -0,0 +1,397 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type ExprOp int
+
+const (
+	EXPR_COLUMN ExprOp = iota
+	EXPR_VALUE
+	EXPR_ADD
+	EXPR_SUB
+	EXPR_MUL
+	EXPR_DIV
+	EXPR_CONCAT
+	EXPR_COALESCE
+	EXPR_CASE
+	EXPR_CALL
+)
+
+var exprOpNames = map[ExprOp]string {
+	EXPR_COLUMN: "COLUMN",
+	EXPR_ADD: "ADD",
+	EXPR_SUB: "SUB",
+	EXPR_MUL: "MUL",
+	EXPR_DIV: "DIV",
+	EXPR_CONCAT: "CONCAT",
+	EXPR_COALESCE: "COALESCE",
+	EXPR_CASE: "CASE",
+	EXPR_CALL: "CALL",
+}
+
+// the SQL operators of the arithmetic expressions and CONCAT
+var exprOpSymbols = map[ExprOp]string {
+	EXPR_ADD: "+",
+	EXPR_SUB: "-",
+	EXPR_MUL: "*",
+	EXPR_DIV: "/",
+	EXPR_CONCAT: "||",
+}
+
+/*
+expression is a scalar expression evaluated on a record: a column, a value, or
+an operator applied to the expressions args. The conditions of a CASE are
+when, args holding the result of each condition followed by the result of ELSE
+if there is one. A CALL calls the function of Functions named function.
+*/
+type expression struct {
+	op ExprOp
+	column string
+	value Value
+	args []*expression
+	when []*predicateTree
+	function string
+}
+
+func initColumnExpression(column string) *expression {
+	return &expression{ EXPR_COLUMN, column, NullValue(), nil, nil, "" }
+}
+
+func initValueExpression(value Value) *expression {
+	return &expression{ EXPR_VALUE, "", value, nil, nil, "" }
+}
+
+func initExpression(op ExprOp, args ...*expression) *expression {
+	return &expression{ op, "", NullValue(), args, nil, "" }
+}
+
+// initCallExpression returns the call of the function name with args, or an
+// ErrInvalidPlan if Functions has no such function taking as many arguments.
+func initCallExpression(name string, args ...*expression) (*expression, error) {
+	if _, err := lookupFunction(name, len(args)); err != nil {
+		return nil, err
+	}
+	return &expression{ EXPR_CALL, "", NullValue(), args, nil, name }, nil
+}
+
+// initCaseExpression returns the CASE returning then[i] for the first of when
+// that is true, otherwise otherwise, which may be nil for NULL.
+func initCaseExpression(when []*predicateTree, then []*expression, otherwise *expression) *expression {
+	args := append([]*expression{}, then...)
+	if otherwise != nil {
+		args = append(args, otherwise)
+	}
+	return &expression{ EXPR_CASE, "", NullValue(), args, when, "" }
+}
+
+/*
+evaluate returns the value of e for the record r. Arithmetic is on numbers, or
+strings that parse as numbers, and is an int for ints, / truncating, and a
+float otherwise. An int result that overflows is an ErrOverflow. Arithmetic,
+CONCAT and calls of NULL are NULL.
+*/
+func (e *expression) evaluate(r *Record) (Value, error) {
+	switch e.op {
+		case EXPR_COLUMN:
+			return r.getColumn(e.column), nil
+		case EXPR_VALUE:
+			return e.value, nil
+		case EXPR_COALESCE:
+			for _, arg := range(e.args) {
+				v, err := arg.evaluate(r)
+				if err != nil || !v.IsNull() {
+					return v, err
+				}
+			}
+			return NullValue(), nil
+		case EXPR_CASE:
+			for i, when := range(e.when) {
+				truth, err := evaluatePredicates(when, r)
+				if err != nil {
+					return Value{}, err
+				}
+				if truth == TRUE {
+					return e.args[i].evaluate(r)
+				}
+			}
+			if len(e.args) > len(e.when) {
+				return e.args[len(e.when)].evaluate(r)
+			}
+			return NullValue(), nil
+	}
+	values := make([]Value, len(e.args))
+	for i, arg := range(e.args) {
+		v, err := arg.evaluate(r)
+		if err != nil {
+			return Value{}, err
+		}
+		if v.IsNull() {
+			return NullValue(), nil
+		}
+		values[i] = v
+	}
+	if e.op == EXPR_CALL {
+		f, err := lookupFunction(e.function, len(values))
+		if err != nil {
+			return Value{}, err
+		}
+		return f.Call(values)
+	}
+	if e.op == EXPR_CONCAT {
+		var s strings.Builder
+		for _, v := range(values) {
+			s.WriteString(v.String())
+		}
+		return StringValue(s.String()), nil
+	}
+	return arithmetic(e.op, values[0], values[1])
+}
+
+func arithmetic(op ExprOp, a Value, b Value) (Value, error) {
+	a, err := numericValue(a)
+	if err != nil {
+		return Value{}, fmt.Errorf("%s: %w", exprOpNames[op], err)
+	}
+	if b, err = numericValue(b); err != nil {
+		return Value{}, fmt.Errorf("%s: %w", exprOpNames[op], err)
+	}
+	if op == EXPR_DIV && ((b.typ == TYPE_INT && b.i == 0) || (b.typ == TYPE_FLOAT && b.f == 0)) {
+		return Value{}, fmt.Errorf("%w: %s / %s", ErrDivisionByZero, a, b)
+	}
+	if a.typ == TYPE_INT && b.typ == TYPE_INT {
+		return intArithmetic(op, a.i, b.i)
+	}
+	switch op {
+		case EXPR_ADD:
+			return FloatValue(a.asFloat() + b.asFloat()), nil
+		case EXPR_SUB:
+			return FloatValue(a.asFloat() - b.asFloat()), nil
+		case EXPR_MUL:
+			return FloatValue(a.asFloat() * b.asFloat()), nil
+	}
+	return FloatValue(a.asFloat() / b.asFloat()), nil
+}
+
+// intArithmetic applies op to a and b, or returns an ErrOverflow if the result
+// does not fit in an int.
+func intArithmetic(op ExprOp, a int64, b int64) (Value, error) {
+	var r int64
+	overflow := false
+	switch op {
+		case EXPR_ADD:
+			r = a + b
+			overflow = (b > 0 && r < a) || (b < 0 && r > a)
+		case EXPR_SUB:
+			r = a - b
+			overflow = (b > 0 && r > a) || (b < 0 && r < a)
+		case EXPR_MUL:
+			r = a * b
+			overflow = a != 0 && (r / a != b || (a == -1 && b == math.MinInt64))
+		default:
+			r = a / b
+			overflow = a == math.MinInt64 && b == -1
+	}
+	if overflow {
+		return Value{}, fmt.Errorf("%w: %d %s %d", ErrOverflow, a, exprOpSymbols[op], b)
+	}
+	return IntValue(r), nil
+}
+
+// columns returns the columns e reads, conditions of a CASE included.
+func (e *expression) columns() []string {
+	switch e.op {
+		case EXPR_COLUMN:
+			return []string{ e.column }
+		case EXPR_VALUE:
+			return nil
+	}
+	cols := make([]string, 0)
+	for _, arg := range(e.args) {
+		cols = append(cols, arg.columns()...)
+	}
+	for _, when := range(e.when) {
+		cols = append(cols, when.columns()...)
+	}
+	return cols
+}
+
+/*
+String returns e in SQL, which is the column a PROJECTION returns e in when it
+is not named. Operands that are operators themselves are parenthesised and a
+CASE is only named CASE.
+*/
+func (e *expression) String() string {
+	switch e.op {
+		case EXPR_COLUMN:
+			return e.column
+		case EXPR_VALUE:
+			switch e.value.typ {
+				case TYPE_NULL:
+					return "NULL"
+				case TYPE_STRING:
+					return "'" + strings.ReplaceAll(e.value.s, "'", "''") + "'"
+				case TYPE_BOOL:
+					return strings.ToUpper(e.value.String())
+			}
+			return e.value.String()
+		case EXPR_CASE:
+			return "CASE"
+	}
+	args := make([]string, len(e.args))
+	for i, arg := range(e.args) {
+		args[i] = arg.String()
+		if _, ok := exprOpSymbols[arg.op]; ok && exprOpSymbols[e.op] != "" {
+			args[i] = "(" + args[i] + ")"
+		}
+	}
+	switch {
+		case e.op == EXPR_COALESCE:
+			return "COALESCE(" + strings.Join(args, ", ") + ")"
+		case e.op == EXPR_CALL && e.function == "CAST" && e.args[1].op == EXPR_VALUE:
+			return fmt.Sprintf("CAST(%s AS %s)", args[0], e.args[1].value)
+		case e.op == EXPR_CALL:
+			return e.function + "(" + strings.Join(args, ", ") + ")"
+	}
+	return strings.Join(args, " " + exprOpSymbols[e.op] + " ")
+}
+
+/*
+An expression of a plan is a value, a column or an operator with its operands:
+
+2000, "text", true or null
+{ "COLUMN": "Year" }
+{ "SUB": [{ "COLUMN": "EndYear" }, { "COLUMN": "Year" }] }    also ADD, MUL and DIV
+{ "CONCAT": [{ "COLUMN": "Name" }, " (", { "COLUMN": "Year" }, ")"] }
+{ "COALESCE": [{ "COLUMN": "Rating" }, 0] }
+{ "CASE": { "when": [{ "condition": { "LT": ["Year", 2000] }, "then": "old" }], "else": "new" } }
+{ "CALL": ["UPPER", { "COLUMN": "Name" }] }
+
+A CASE returns the then of the first true condition, otherwise its else, NULL
+by default. A CALL names a function of Functions, followed by its arguments.
+*/
+func parseExpression(arg interface{}) (*expression, error) {
+	m, ok := arg.(map[string]interface{})
+	if !ok {
+		value, err := argToValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: expression %v: %w", ErrInvalidPlan, arg, err)
+		}
+		return initValueExpression(value), nil
+	}
+	if len(m) != 1 {
+		return nil, fmt.Errorf("%w: expression %v must have a single operator", ErrInvalidPlan, arg)
+	}
+	for op, name := range(exprOpNames) {
+		operands, ok := m[name]
+		if !ok { continue }
+		switch op {
+			case EXPR_COLUMN:
+				column, ok := operands.(string)
+				if !ok || column == "" {
+					return nil, fmt.Errorf("%w: COLUMN %v is not a column", ErrInvalidPlan, operands)
+				}
+				return initColumnExpression(column), nil
+			case EXPR_CASE:
+				return parseCaseExpression(operands)
+			case EXPR_CALL:
+				return parseCallExpression(operands)
+		}
+		list, ok := operands.([]interface{})
+		if !ok || len(list) == 0 || (exprOpSymbols[op] != "" && op != EXPR_CONCAT && len(list) != 2) {
+			return nil, fmt.Errorf("%w: %s operands %v", ErrInvalidPlan, name, operands)
+		}
+		args := make([]*expression, len(list))
+		for i, operand := range(list) {
+			var err error
+			if args[i], err = parseExpression(operand); err != nil {
+				return nil, err
+			}
+		}
+		return initExpression(op, args...), nil
+	}
+	return nil, fmt.Errorf("%w: unknown expression %v", ErrInvalidPlan, arg)
+}
+
+func parseCaseExpression(arg interface{}) (*expression, error) {
+	m, ok := arg.(map[string]interface{})
+	list, list_ok := m["when"].([]interface{})
+	if !ok || !list_ok || len(list) == 0 {
+		return nil, fmt.Errorf("%w: CASE expects a list of conditions, got %v", ErrInvalidPlan, arg)
+	}
+	when := make([]*predicateTree, len(list))
+	then := make([]*expression, len(list))
+	for i, v := range(list) {
+		c, ok := v.(map[string]interface{})
+		if !ok || c["condition"] == nil {
+			return nil, fmt.Errorf("%w: CASE condition %v", ErrInvalidPlan, v)
+		}
+		var err error
+		if when[i], err = parseSelectionNodeArgs(c["condition"]); err != nil {
+			return nil, err
+		}
+		if then[i], err = parseExpression(c["then"]); err != nil {
+			return nil, err
+		}
+	}
+	var otherwise *expression
+	if m["else"] != nil {
+		var err error
+		if otherwise, err = parseExpression(m["else"]); err != nil {
+			return nil, err
+		}
+	}
+	return initCaseExpression(when, then, otherwise), nil
+}
+
+func parseCallExpression(arg interface{}) (*expression, error) {
+	list, _ := arg.([]interface{})
+	var name string
+	ok := false
+	if len(list) > 0 {
+		name, ok = list[0].(string)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: CALL expects a function name first, got %v", ErrInvalidPlan, arg)
+	}
+	args := make([]*expression, len(list) - 1)
+	for i, operand := range(list[1:]) {
+		var err error
+		if args[i], err = parseExpression(operand); err != nil {
+			return nil, err
+		}
+	}
+	return initCallExpression(name, args...)
+}
+
+// expressionToArg is the inverse of parseExpression.
+func expressionToArg(e *expression) interface{} {
+	switch e.op {
+		case EXPR_COLUMN:
+			return map[string]interface{}{ exprOpNames[e.op]: e.column }
+		case EXPR_VALUE:
+			return toArg(e.value)
+		case EXPR_CASE:
+			when := make([]interface{}, len(e.when))
+			for i, w := range(e.when) {
+				when[i] = map[string]interface{}{ "condition": predicatesToArgs(w),
+					"then": expressionToArg(e.args[i]) }
+			}
+			args := map[string]interface{}{ "when": when }
+			if len(e.args) > len(e.when) {
+				args["else"] = expressionToArg(e.args[len(e.when)])
+			}
+			return map[string]interface{}{ exprOpNames[e.op]: args }
+	}
+	args := make([]interface{}, 0, len(e.args) + 1)
+	if e.op == EXPR_CALL {
+		args = append(args, e.function)
+	}
+	for _, arg := range(e.args) {
+		args = append(args, expressionToArg(arg))
+	}
+	return map[string]interface{}{ exprOpNames[e.op]: args }
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"reflect"
+	"math"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	r := &Record{ values: map[string]Value{
+		"Year": IntValue(2000),
+		"EndYear": StringValue("2004"),
+		"Rating": FloatValue(3.5),
+		"Name": StringValue("Movie"),
+		"Missing": NullValue(),
+	} }
+	year, end := initColumnExpression("Year"), initColumnExpression("EndYear")
+	old := initPredicateLeaf(initPredicateExpression("Year", LT, IntValue(2001)))
+	cases := []struct {
+		e *expression
+		expected Value
+	}{
+		{ initExpression(EXPR_SUB, end, year), IntValue(4) },
+		{ initExpression(EXPR_ADD, year, initColumnExpression("Rating")), FloatValue(2003.5) },
+		{ initExpression(EXPR_MUL, initValueExpression(IntValue(2)), initColumnExpression("Rating")), FloatValue(7) },
+		{ initExpression(EXPR_DIV, year, initValueExpression(IntValue(3))), IntValue(666) },
+		{ initExpression(EXPR_DIV, year, initValueExpression(FloatValue(8))), FloatValue(250) },
+		{ initExpression(EXPR_ADD, year, initColumnExpression("Missing")), NullValue() },
+		{ initExpression(EXPR_CONCAT, initColumnExpression("Name"), initValueExpression(StringValue(" ")), year),
+			StringValue("Movie 2000") },
+		{ initExpression(EXPR_MUL, initValueExpression(IntValue(-1)), initValueExpression(IntValue(math.MaxInt64))),
+			IntValue(-math.MaxInt64) },
+		{ initExpression(EXPR_SUB, initValueExpression(IntValue(-1)), initValueExpression(IntValue(math.MaxInt64))),
+			IntValue(math.MinInt64) },
+		{ initExpression(EXPR_CONCAT, initColumnExpression("Name"), initColumnExpression("Missing")), NullValue() },
+		{ initExpression(EXPR_COALESCE, initColumnExpression("Missing"), year), IntValue(2000) },
+		{ initExpression(EXPR_COALESCE, initColumnExpression("Missing")), NullValue() },
+		{ initCaseExpression([]*predicateTree{ old }, []*expression{ initValueExpression(StringValue("old")) },
+			initValueExpression(StringValue("new"))), StringValue("old") },
+		{ initCaseExpression([]*predicateTree{ initPredicateTree(NOT, old) },
+			[]*expression{ initValueExpression(StringValue("new")) }, nil), NullValue() },
+	}
+	for _, c := range(cases) {
+		actual, err := c.e.evaluate(r)
+		if err != nil || actual != c.expected {
+			t.Errorf("%s: Expected %v. Actual %v %v", c.e, c.expected, actual, err)
+		}
+	}
+
+	for _, c := range([]struct {
+		e *expression
+		err error
+	}{
+		{ initExpression(EXPR_DIV, year, initValueExpression(IntValue(0))), ErrDivisionByZero },
+		{ initExpression(EXPR_SUB, initColumnExpression("Name"), year), ErrTypeMismatch },
+		{ initExpression(EXPR_ADD, year, initValueExpression(IntValue(math.MaxInt64))), ErrOverflow },
+		{ initExpression(EXPR_ADD, initValueExpression(IntValue(math.MinInt64)), initValueExpression(IntValue(-1))),
+			ErrOverflow },
+		{ initExpression(EXPR_SUB, initValueExpression(IntValue(-2)), initValueExpression(IntValue(math.MaxInt64))),
+			ErrOverflow },
+		{ initExpression(EXPR_SUB, initValueExpression(IntValue(0)), initValueExpression(IntValue(math.MinInt64))),
+			ErrOverflow },
+		{ initExpression(EXPR_MUL, year, initValueExpression(IntValue(math.MaxInt64 / 1000))), ErrOverflow },
+		{ initExpression(EXPR_MUL, initValueExpression(IntValue(-1)), initValueExpression(IntValue(math.MinInt64))),
+			ErrOverflow },
+		{ initExpression(EXPR_DIV, initValueExpression(IntValue(math.MinInt64)), initValueExpression(IntValue(-1))),
+			ErrOverflow },
+	}) {
+		if _, err := c.e.evaluate(r); !errors.Is(err, c.err) {
+			t.Errorf("%s: Expected %v. Actual %v", c.e, c.err, err)
+		}
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	args := []interface{}{
+		2000.0,
+		"text",
+		map[string]interface{}{ "COLUMN": "Year" },
+		map[string]interface{}{ "SUB": []interface{}{ map[string]interface{}{ "COLUMN": "EndYear" },
+			map[string]interface{}{ "COLUMN": "Year" } } },
+		map[string]interface{}{ "CONCAT": []interface{}{ map[string]interface{}{ "COLUMN": "Name" }, "!" } },
+		map[string]interface{}{ "CASE": map[string]interface{}{
+			"when": []interface{}{ map[string]interface{}{
+				"condition": map[string]interface{}{ "LT": []interface{}{ "Year", 2000.0 } }, "then": "old" } },
+			"else": "new" } },
+	}
+	expected := []string{ "2000", "'text'", "Year", "EndYear - Year", "Name || '!'", "CASE" }
+	for i, arg := range(args) {
+		e, err := parseExpression(arg)
+		if err != nil || e.String() != expected[i] {
+			t.Errorf("%v: Expected %s. Actual %v %v", arg, expected[i], e, err)
+			continue
+		}
+		// integers read back as int64
+		if back, _ := parseExpression(expressionToArg(e)); !reflect.DeepEqual(e, back) {
+			t.Errorf("%v: Expected %v. Actual %v", arg, e, back)
+		}
+	}
+
+	for _, arg := range([]interface{}{
+		map[string]interface{}{ "COLUMN": 1.0 },
+		map[string]interface{}{ "ADD": []interface{}{ 1.0 } },
+		map[string]interface{}{ "COALESCE": []interface{}{} },
+		map[string]interface{}{ "POW": []interface{}{ 1.0, 2.0 } },
+		map[string]interface{}{ "CASE": map[string]interface{}{ "else": 1.0 } },
+		map[string]interface{}{ "ADD": []interface{}{ 1.0, 2.0 }, "SUB": []interface{}{ 1.0, 2.0 } },
+		[]interface{}{ 1.0 },
+	}) {
+		if _, err := parseExpression(arg); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%v: Expected %v. Actual %v", arg, ErrInvalidPlan, err)
+		}
+	}
+}
+
+func TestQueryExpressions(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("CREATE TABLE shows (Id INT PRIMARY KEY, Name TEXT, Start INT, Finish INT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, years := range([][]any{ { 2000, 2004 }, { 2010, 2010 }, { 2015, nil } }) {
+		row := map[string]any{ "Id": i, "Name": "Show", "Start": years[0], "Finish": years[1] }
+		if err := db.Put("shows", row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.Query(`SELECT Id, Name || ' ' || Start AS Title, COALESCE(Finish, 2024) - Start AS Years,
+		CASE WHEN Finish IS NULL THEN 'running' ELSE 'ended' END AS Status FROM shows
+		WHERE COALESCE(Finish, 2024) > Start ORDER BY Id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	expected := [][]Value{
+		{ IntValue(0), StringValue("Show 2000"), IntValue(4), StringValue("ended") },
+		{ IntValue(2), StringValue("Show 2015"), IntValue(9), StringValue("running") },
+	}
+	actual := make([][]Value, 0)
+	for rows.Next() {
+		r := rows.Record()
+		row := make([]Value, 0)
+		for _, col := range([]string{ "Id", "Title", "Years", "Status" }) {
+			v, _ := r.Value(col)
+			row = append(row, v)
+		}
+		actual = append(actual, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+
+	rows, err = db.Query("SELECT Id + 9223372036854775807 AS Next FROM shows WHERE Id > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t.Errorf("Expected no rows. Actual %v", rows.Record())
+	}
+	if err := rows.Err(); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Expected %v. Actual %v", ErrOverflow, err)
+	}
+}
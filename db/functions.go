@@ -0,0 +1,247 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+A Function is a scalar function callable from the expressions of a plan, with
+at least MinArgs and at most MaxArgs arguments, -1 meaning any number. Call is
+only called with values that are not NULL: a call with a NULL argument is NULL.
+*/
+type Function struct {
+	MinArgs int
+	MaxArgs int
+	Call func(args []Value) (Value, error)
+}
+
+// Functions are the scalar functions of expressions by name. Functions added
+// to it can be called by plans and SQL queries compiled afterwards. Unlike
+// RegisterFunction, writing to it directly is only safe before queries run.
+var Functions = map[string]Function {
+	"UPPER": { 1, 1, upperFunction },
+	"LOWER": { 1, 1, lowerFunction },
+	"LENGTH": { 1, 1, lengthFunction },
+	"SUBSTR": { 2, 3, substrFunction },
+	"TRIM": { 1, 2, trimFunction },
+	"ABS": { 1, 1, absFunction },
+	"ROUND": { 1, 2, roundFunction },
+	"CAST": { 2, 2, castFunction },
+	"NOW": { 0, 0, nowFunction },
+	"DATE_TRUNC": { 2, 2, dateTruncFunction },
+}
+
+// lookupFunction returns the function name, or an ErrInvalidPlan if there is
+// none or it does not take n arguments.
+func lookupFunction(name string, n int) (Function, error) {
+	functions_mutex.RLock()
+	f, ok := Functions[name]
+	functions_mutex.RUnlock()
+	if !ok {
+		return Function{}, fmt.Errorf("%w: unknown function %s", ErrInvalidPlan, name)
+	}
+	if n < f.MinArgs || (f.MaxArgs >= 0 && n > f.MaxArgs) {
+		return Function{}, fmt.Errorf("%w: %s does not take %d arguments", ErrInvalidPlan, name, n)
+	}
+	return f, nil
+}
+
+func stringArg(name string, v Value) (string, error) {
+	if v.typ != TYPE_STRING {
+		return "", fmt.Errorf("%w: %s of %v %s", ErrTypeMismatch, name, v.typ, v)
+	}
+	return v.s, nil
+}
+
+// intArg returns v as an int, strings being parsed.
+func intArg(name string, v Value) (int64, error) {
+	n, err := numericValue(v)
+	if err == nil && n.typ != TYPE_INT {
+		err = fmt.Errorf("%w: %v %s is not an int", ErrTypeMismatch, v.typ, v)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return n.i, nil
+}
+
+func upperFunction(args []Value) (Value, error) {
+	s, err := stringArg("UPPER", args[0])
+	return StringValue(strings.ToUpper(s)), err
+}
+
+func lowerFunction(args []Value) (Value, error) {
+	s, err := stringArg("LOWER", args[0])
+	return StringValue(strings.ToLower(s)), err
+}
+
+// LENGTH is the number of characters of a string, or of bytes of bytes.
+func lengthFunction(args []Value) (Value, error) {
+	if args[0].typ == TYPE_BYTES {
+		return IntValue(int64(len(args[0].s))), nil
+	}
+	s, err := stringArg("LENGTH", args[0])
+	return IntValue(int64(utf8.RuneCountInString(s))), err
+}
+
+/*
+SUBSTR(s, start, length) returns the length characters of s from the 1-based
+position start, or the characters from start without length. Positions before
+the first character count towards length, so SUBSTR('abc', 0, 2) is 'a'.
+*/
+func substrFunction(args []Value) (Value, error) {
+	s, err := stringArg("SUBSTR", args[0])
+	if err != nil {
+		return Value{}, err
+	}
+	runes := []rune(s)
+	start, err := intArg("SUBSTR", args[1])
+	if err != nil {
+		return Value{}, err
+	}
+	end := int64(len(runes)) + 1
+	if len(args) == 3 {
+		length, err := intArg("SUBSTR", args[2])
+		if err != nil {
+			return Value{}, err
+		}
+		if length < 0 {
+			return Value{}, fmt.Errorf("%w: SUBSTR of negative length %d", ErrTypeMismatch, length)
+		}
+		end = min(end, start + length)
+	}
+	start = max(start, 1)
+	if start >= end {
+		return StringValue(""), nil
+	}
+	return StringValue(string(runes[start - 1:end - 1])), nil
+}
+
+// TRIM(s, characters) removes the characters from both ends of s, white space
+// without characters.
+func trimFunction(args []Value) (Value, error) {
+	s, err := stringArg("TRIM", args[0])
+	if err != nil {
+		return Value{}, err
+	}
+	if len(args) == 1 {
+		return StringValue(strings.TrimSpace(s)), nil
+	}
+	cutset, err := stringArg("TRIM", args[1])
+	return StringValue(strings.Trim(s, cutset)), err
+}
+
+func absFunction(args []Value) (Value, error) {
+	n, err := numericValue(args[0])
+	if err != nil {
+		return Value{}, fmt.Errorf("ABS: %w", err)
+	}
+	if n.typ == TYPE_FLOAT {
+		return FloatValue(math.Abs(n.f)), nil
+	}
+	if n.i < 0 {
+		// the negation of math.MinInt64 does not fit an int64
+		v, err := intArithmetic(EXPR_SUB, 0, n.i)
+		if err != nil {
+			return Value{}, fmt.Errorf("ABS: %w", err)
+		}
+		return v, nil
+	}
+	return n, nil
+}
+
+// ROUND(n, digits) rounds n half away from zero to digits decimals, 0 by
+// default. Negative digits round to tens, hundreds and so on. An int stays an
+// int.
+func roundFunction(args []Value) (Value, error) {
+	n, err := numericValue(args[0])
+	if err != nil {
+		return Value{}, fmt.Errorf("ROUND: %w", err)
+	}
+	digits := int64(0)
+	if len(args) == 2 {
+		if digits, err = intArg("ROUND", args[1]); err != nil {
+			return Value{}, err
+		}
+	}
+	if n.typ == TYPE_INT && digits >= 0 {
+		return n, nil
+	}
+	scale := math.Pow(10, float64(digits))
+	rounded := math.Round(n.asFloat() * scale) / scale
+	if n.typ == TYPE_INT {
+		return IntValue(int64(rounded)), nil
+	}
+	return FloatValue(rounded), nil
+}
+
+/*
+CAST(v, type) converts v to the type named as in CREATE TABLE. Every value
+converts to a string, strings are parsed, numbers convert to each other, floats
+being truncated, and booleans to and from ints.
+*/
+func castFunction(args []Value) (Value, error) {
+	name, err := stringArg("CAST", args[1])
+	if err != nil {
+		return Value{}, err
+	}
+	typ, ok := parseValueType(name)
+	if !ok {
+		return Value{}, fmt.Errorf("%w: CAST to unknown type %s", ErrTypeMismatch, name)
+	}
+	return castValue(args[0], typ)
+}
+
+func castValue(v Value, typ ValueType) (Value, error) {
+	switch {
+		case typ == TYPE_STRING:
+			return StringValue(v.String()), nil
+		case v.typ == TYPE_FLOAT && typ == TYPE_INT:
+			return IntValue(int64(v.f)), nil
+		case v.typ == TYPE_BOOL && typ == TYPE_INT:
+			return IntValue(v.i), nil
+		case v.typ == TYPE_INT && typ == TYPE_BOOL:
+			return BoolValue(v.i != 0), nil
+	}
+	return coerceValue(v, typ)
+}
+
+func nowFunction(args []Value) (Value, error) {
+	return TimestampValue(time.Now()), nil
+}
+
+var date_trunc_units = []string{ "year", "month", "day", "hour", "minute", "second" }
+
+// DATE_TRUNC(unit, t) returns the timestamp t, or a string parsing as one, with
+// the parts smaller than the unit zeroed. The units are year, month, day, hour,
+// minute and second.
+func dateTruncFunction(args []Value) (Value, error) {
+	unit, err := stringArg("DATE_TRUNC", args[0])
+	if err != nil {
+		return Value{}, err
+	}
+	v, err := coerceValue(args[1], TYPE_TIMESTAMP)
+	if err != nil {
+		return Value{}, fmt.Errorf("DATE_TRUNC: %w", err)
+	}
+	t := v.Time()
+	parts := []int{ t.Year(), int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second() }
+	for i, u := range(date_trunc_units) {
+		if strings.EqualFold(u, unit) {
+			for j := i + 1; j < len(parts); j++ {
+				parts[j] = 0
+				if j <= 2 {
+					// months and days start at 1
+					parts[j] = 1
+				}
+			}
+			return TimestampValue(time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3],
+				parts[4], parts[5], 0, time.UTC)), nil
+		}
+	}
+	return Value{}, fmt.Errorf("%w: DATE_TRUNC to unknown unit %s", ErrTypeMismatch, unit)
+}
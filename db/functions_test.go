@@ -0,0 +1,157 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"strings"
+	"time"
+	"math"
+)
+
+func call(t *testing.T, name string, args ...Value) (Value, error) {
+	t.Helper()
+	exprs := make([]*expression, len(args))
+	for i, arg := range(args) {
+		exprs[i] = initValueExpression(arg)
+	}
+	e, err := initCallExpression(name, exprs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.evaluate(&Record{ values: map[string]Value{} })
+}
+
+func TestFunctions(t *testing.T) {
+	date := TimestampValue(time.Date(2024, 5, 17, 13, 45, 30, 500, time.UTC))
+	cases := []struct {
+		name string
+		args []Value
+		expected Value
+	}{
+		{ "UPPER", []Value{ StringValue("Movie é") }, StringValue("MOVIE É") },
+		{ "LOWER", []Value{ StringValue("Movie") }, StringValue("movie") },
+		{ "LENGTH", []Value{ StringValue("héllo") }, IntValue(5) },
+		{ "LENGTH", []Value{ BytesValue([]byte("héllo")) }, IntValue(6) },
+		{ "SUBSTR", []Value{ StringValue("héllo"), IntValue(2), IntValue(3) }, StringValue("éll") },
+		{ "SUBSTR", []Value{ StringValue("hello"), StringValue("4") }, StringValue("lo") },
+		{ "SUBSTR", []Value{ StringValue("hello"), IntValue(0), IntValue(2) }, StringValue("h") },
+		{ "SUBSTR", []Value{ StringValue("hello"), IntValue(9) }, StringValue("") },
+		{ "TRIM", []Value{ StringValue("  a b \n") }, StringValue("a b") },
+		{ "TRIM", []Value{ StringValue("xxaxx"), StringValue("x") }, StringValue("a") },
+		{ "ABS", []Value{ IntValue(-3) }, IntValue(3) },
+		{ "ABS", []Value{ StringValue("-2.5") }, FloatValue(2.5) },
+		{ "ROUND", []Value{ FloatValue(2.5) }, FloatValue(3) },
+		{ "ROUND", []Value{ FloatValue(-2.345), IntValue(2) }, FloatValue(-2.35) },
+		{ "ROUND", []Value{ IntValue(1250), IntValue(-2) }, IntValue(1300) },
+		{ "ROUND", []Value{ IntValue(7), IntValue(1) }, IntValue(7) },
+		{ "CAST", []Value{ StringValue("2000"), StringValue("INT") }, IntValue(2000) },
+		{ "CAST", []Value{ FloatValue(2.9), StringValue("int") }, IntValue(2) },
+		{ "CAST", []Value{ IntValue(2), StringValue("REAL") }, FloatValue(2) },
+		{ "CAST", []Value{ IntValue(0), StringValue("bool") }, BoolValue(false) },
+		{ "CAST", []Value{ FloatValue(1.5), StringValue("text") }, StringValue("1.5") },
+		{ "CAST", []Value{ StringValue("2024-05-17"), StringValue("timestamp") },
+			TimestampValue(time.Date(2024, 5, 17, 0, 0, 0, 0, time.UTC)) },
+		{ "DATE_TRUNC", []Value{ StringValue("year"), date },
+			TimestampValue(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) },
+		{ "DATE_TRUNC", []Value{ StringValue("Month"), StringValue("2024-05-17T13:45:30Z") },
+			TimestampValue(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) },
+		{ "DATE_TRUNC", []Value{ StringValue("hour"), date },
+			TimestampValue(time.Date(2024, 5, 17, 13, 0, 0, 0, time.UTC)) },
+		{ "DATE_TRUNC", []Value{ StringValue("second"), date },
+			TimestampValue(time.Date(2024, 5, 17, 13, 45, 30, 0, time.UTC)) },
+		{ "UPPER", []Value{ NullValue() }, NullValue() },
+		{ "SUBSTR", []Value{ StringValue("hello"), NullValue() }, NullValue() },
+	}
+	for _, c := range(cases) {
+		actual, err := call(t, c.name, c.args...)
+		if err != nil || actual != c.expected {
+			t.Errorf("%s%v: Expected %v. Actual %v %v", c.name, c.args, c.expected, actual, err)
+		}
+	}
+
+	before := time.Now()
+	if now, err := call(t, "NOW"); err != nil || now.typ != TYPE_TIMESTAMP || now.Time().Before(before.Truncate(time.Microsecond)) {
+		t.Errorf("Expected the time after %v. Actual %v %v", before, now, err)
+	}
+
+	for _, c := range([]struct {
+		name string
+		args []Value
+	}{
+		{ "UPPER", []Value{ IntValue(1) } },
+		{ "SUBSTR", []Value{ StringValue("a"), FloatValue(1.5) } },
+		{ "SUBSTR", []Value{ StringValue("a"), IntValue(1), IntValue(-1) } },
+		{ "ABS", []Value{ StringValue("a") } },
+		{ "CAST", []Value{ StringValue("a"), StringValue("int") } },
+		{ "CAST", []Value{ IntValue(1), StringValue("decimal") } },
+		{ "CAST", []Value{ BoolValue(true), StringValue("timestamp") } },
+		{ "DATE_TRUNC", []Value{ StringValue("week"), StringValue("2024-05-17") } },
+	}) {
+		if _, err := call(t, c.name, c.args...); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("%s%v: Expected %v. Actual %v", c.name, c.args, ErrTypeMismatch, err)
+		}
+	}
+
+	if _, err := call(t, "ABS", IntValue(math.MinInt64)); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Expected %v. Actual %v", ErrOverflow, err)
+	}
+
+	for _, arg := range([]interface{}{
+		map[string]interface{}{ "CALL": []interface{}{ "REVERSE", "a" } },
+		map[string]interface{}{ "CALL": []interface{}{ "UPPER" } },
+		map[string]interface{}{ "CALL": []interface{}{ "NOW", 1.0 } },
+		map[string]interface{}{ "CALL": []interface{}{} },
+	}) {
+		if _, err := parseExpression(arg); !errors.Is(err, ErrInvalidPlan) {
+			t.Errorf("%v: Expected %v. Actual %v", arg, ErrInvalidPlan, err)
+		}
+	}
+}
+
+func TestQueryFunctions(t *testing.T) {
+	Functions["REVERSE"] = Function{ 1, 1, func(args []Value) (Value, error) {
+		runes := []rune(args[0].String())
+		for i, j := 0, len(runes) - 1; i < j; i, j = i + 1, j - 1 {
+			runes[i], runes[j] = runes[j], runes[i]
+		}
+		return StringValue(string(runes)), nil
+	} }
+	defer delete(Functions, "REVERSE")
+
+	db, err := Open(t.TempDir(), &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Name TEXT, Released TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range([]string{ " Alien ", "heat", "Up" }) {
+		row := map[string]any{ "Id": i, "Name": name, "Released": "2001-0" + string(rune('1' + i)) + "-15" }
+		if err := db.Put("movies", row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.Query(`SELECT upper(trim(Name)) AS Name, Reverse(TRIM(Name)) AS Backwards,
+		CAST(SUBSTR(Released, 1, 4) AS INT) + 1 AS Next FROM movies
+		WHERE LENGTH(TRIM(Name)) > 2 AND DATE_TRUNC('month', Released) >= CAST('2001-02-01' AS TIMESTAMP)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]string, 0)
+	for rows.Next() {
+		r := rows.Record()
+		row := make([]string, 0)
+		for _, col := range([]string{ "Name", "Backwards", "Next" }) {
+			v, _ := r.Value(col)
+			row = append(row, v.String())
+		}
+		actual = append(actual, strings.Join(row, " "))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 1 || actual[0] != "HEAT taeh 2002" {
+		t.Errorf("Expected %v. Actual %v", []string{ "HEAT taeh 2002" }, actual)
+	}
+}
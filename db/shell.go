@@ -0,0 +1,480 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const shell_prompt = "tinydb> "
+const shell_continue_prompt = "   ...> "
+
+const shell_help = `Enter a SQL statement ending with ";" or a JSON plan, or a meta-command:
+.tables            list the tables of the data directory
+.schema [table]    show the columns of the tables
+.explain QUERY     show the plan of a query without running it
+.timer on|off      show how long each query takes
+.history           show the previous queries
+.help              show this message
+.quit              exit the shell
+`
+
+/*
+Shell is an interactive prompt over a data directory, in which the tables of
+the catalog, and every subdirectory holding a table, can be queried by name in
+SQL or in a JSON plan. Tables are created and dropped with CREATE TABLE and
+DROP TABLE. Queries are appended to a history file, if any, and results are
+printed as aligned tables.
+*/
+type Shell struct {
+	dir string
+	catalog *Catalog
+	out io.Writer
+	timer bool
+	history []string
+	history_file *os.File
+}
+
+// OpenShell opens the data directory dir. Queries are recorded in
+// history_path unless it is empty.
+func OpenShell(dir string, history_path string, out io.Writer) (*Shell, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	catalog, err := openCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	sh := &Shell{ dir, catalog, out, false, make([]string, 0), nil }
+	if history_path == "" {
+		return sh, nil
+	}
+	if data, err := os.ReadFile(history_path); err == nil {
+		for _, line := range(strings.Split(string(data), "\n")) {
+			if line != "" {
+				sh.history = append(sh.history, unquoteHistory(line))
+			}
+		}
+	}
+	sh.history_file, err = os.OpenFile(history_path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+func (sh *Shell) Close() error {
+	if sh.history_file == nil {
+		return nil
+	}
+	return sh.history_file.Close()
+}
+
+// Run reads statements from in until it is exhausted or .quit is entered.
+// Errors of a statement are printed and do not stop the shell.
+func (sh *Shell) Run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	statement := ""
+	fmt.Fprint(sh.out, shell_prompt)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if statement == "" && strings.HasPrefix(strings.TrimSpace(line), ".") {
+			if quit := sh.meta(strings.TrimSpace(line)); quit {
+				return nil
+			}
+			fmt.Fprint(sh.out, shell_prompt)
+			continue
+		}
+		statement = strings.TrimSpace(statement + "\n" + line)
+		if statement != "" && !isCompleteStatement(statement) {
+			fmt.Fprint(sh.out, shell_continue_prompt)
+			continue
+		}
+		if statement != "" {
+			sh.record(statement)
+			sh.execute(statement)
+		}
+		statement = ""
+		fmt.Fprint(sh.out, shell_prompt)
+	}
+	return scanner.Err()
+}
+
+// isCompleteStatement reports whether s is a SQL query ending with ";" or a
+// JSON plan whose braces are balanced, outside of their string literals.
+func isCompleteStatement(s string) bool {
+	quoted := quotedBytes(s)
+	if !strings.HasPrefix(s, "{") {
+		return strings.HasSuffix(s, ";") && !quoted[len(s) - 1]
+	}
+	depth := 0
+	for i := range(len(s)) {
+		if quoted[i] { continue }
+		if s[i] == '{' {
+			depth++
+		} else if s[i] == '}' {
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+/*
+quotedBytes reports which bytes of s are part of a string literal, quotes
+included: in SQL, text quoted by ' or " where a doubled quote stands for
+itself, and in a JSON plan, text quoted by " where \ escapes the next byte. The
+rest of an unterminated literal is quoted.
+*/
+func quotedBytes(s string) []bool {
+	json := strings.HasPrefix(s, "{")
+	quoted := make([]bool, len(s))
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote == 0 {
+			if c == '"' || (c == '\'' && !json) {
+				quote = c
+				quoted[i] = true
+			}
+			continue
+		}
+		quoted[i] = true
+		if json && c == '\\' && i + 1 < len(s) {
+			i++
+			quoted[i] = true
+		} else if c == quote && !json && i + 1 < len(s) && s[i + 1] == quote {
+			i++
+			quoted[i] = true
+		} else if c == quote {
+			quote = 0
+		}
+	}
+	return quoted
+}
+
+// record adds statement to the history with its whitespace collapsed to single
+// spaces, except in string literals.
+func (sh *Shell) record(statement string) {
+	quoted := quotedBytes(statement)
+	var line strings.Builder
+	space := false
+	for i := range(len(statement)) {
+		c := statement[i]
+		if !quoted[i] && (c == ' ' || c == '\t' || c == '\n' || c == '\r') {
+			space = line.Len() > 0
+			continue
+		}
+		if space {
+			line.WriteByte(' ')
+			space = false
+		}
+		line.WriteByte(c)
+	}
+	sh.history = append(sh.history, line.String())
+	if sh.history_file != nil {
+		fmt.Fprintln(sh.history_file, quoteHistory(line.String()))
+	}
+}
+
+// quoteHistory returns the line of the history file of a statement, which is
+// quoted as a Go string if a literal holds a line break or it starts with a
+// quote.
+func quoteHistory(statement string) string {
+	if strings.ContainsAny(statement, "\r\n") || strings.HasPrefix(statement, `"`) {
+		return strconv.Quote(statement)
+	}
+	return statement
+}
+
+func unquoteHistory(line string) string {
+	if s, err := strconv.Unquote(line); err == nil && strings.HasPrefix(line, `"`) {
+		return s
+	}
+	return line
+}
+
+func (sh *Shell) meta(line string) bool {
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	var err error
+	switch command {
+		case ".quit", ".exit":
+			return true
+		case ".help":
+			fmt.Fprint(sh.out, shell_help)
+		case ".tables":
+			var tables []string
+			tables, err = sh.catalog.names()
+			for _, t := range(tables) {
+				fmt.Fprintln(sh.out, t)
+			}
+		case ".schema":
+			err = sh.schema(arg)
+		case ".explain":
+			var t *Tree
+			t, err = sh.plan(strings.TrimSuffix(arg, ";"))
+			if err == nil {
+				var planned *Node
+				planned, err = planQuery(t.Head)
+				writePlan(sh.out, planned, 0)
+			}
+		case ".timer":
+			switch arg {
+				case "on":
+					sh.timer = true
+				case "off":
+					sh.timer = false
+				default:
+					err = fmt.Errorf("Usage: .timer on|off")
+			}
+		case ".history":
+			for i, h := range(sh.history) {
+				fmt.Fprintf(sh.out, "%4d  %s\n", i + 1, h)
+			}
+		default:
+			err = fmt.Errorf("Unknown command %s, enter .help for the list of commands", command)
+	}
+	if err != nil {
+		fmt.Fprintf(sh.out, "Error: %v\n", err)
+	}
+	return false
+}
+
+// schema prints the columns of the table, or of every table. The columns of a
+// table without a schema are the ones found in its rows.
+func (sh *Shell) schema(table string) error {
+	tables := []string{ table }
+	if table == "" {
+		var err error
+		if tables, err = sh.catalog.names(); err != nil {
+			return err
+		}
+	}
+	for _, t := range(tables) {
+		if schema, ok := sh.catalog.table(t); ok {
+			fmt.Fprintln(sh.out, schema)
+			continue
+		}
+		source, err := sh.catalog.source(t)
+		if err != nil {
+			return err
+		}
+		cols, err := columnsOf(&FileScan{ source: source })
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "%s (%s)\n", t, strings.Join(cols, ", "))
+	}
+	return nil
+}
+
+func columnsOf(it Iterator) ([]string, error) {
+	records, err := runIterator(context.Background(), it)
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]string, 0)
+	for _, r := range(records) {
+		for name := range(r.values) {
+			if !slices.Contains(cols, name) {
+				cols = append(cols, name)
+			}
+		}
+	}
+	slices.Sort(cols)
+	return cols, nil
+}
+
+func runIterator(ctx context.Context, it Iterator) ([]*Record, error) {
+	if err := it.Open(ctx); err != nil {
+		it.Close()
+		return nil, err
+	}
+	records := make([]*Record, 0)
+	for {
+		r, err := it.Next()
+		if err != nil {
+			return nil, errors.Join(err, it.Close())
+		}
+		if r == nil {
+			return records, it.Close()
+		}
+		records = append(records, r)
+	}
+}
+
+// plan compiles a SQL query or a JSON plan. Tables are looked up in the data
+// directory.
+func (sh *Shell) plan(statement string) (*Tree, error) {
+	var t *Tree
+	var err error
+	if strings.HasPrefix(statement, "{") {
+		t, err = generateTree(statement)
+	} else {
+		t, err = parseSQL(statement)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Head == nil {
+		return nil, fmt.Errorf("%w: the plan has no head", ErrInvalidPlan)
+	}
+	return &Tree{ sh.resolveTables(t.Head) }, nil
+}
+
+func (sh *Shell) resolveTables(n *Node) *Node {
+	if n == nil { return nil }
+	resolved := &Node{ n.Name, n.Args, sh.resolveTables(n.Child) }
+	args, ok := n.Args.(map[string]interface{})
+	if !ok { return resolved }
+	if table, ok := args["dir"].(string); ok && !filepath.IsAbs(table) {
+		resolved_args := make(map[string]interface{})
+		for k, v := range(args) {
+			resolved_args[k] = v
+		}
+		resolved_args["dir"] = filepath.Join(sh.dir, table)
+		resolved.Args = resolved_args
+	}
+	return resolved
+}
+
+func (sh *Shell) execute(statement string) {
+	start := time.Now()
+	err := sh.query(statement)
+	if err != nil {
+		fmt.Fprintf(sh.out, "Error: %v\n", err)
+	}
+	if sh.timer {
+		fmt.Fprintf(sh.out, "Time: %v\n", time.Since(start))
+	}
+}
+
+func (sh *Shell) query(statement string) error {
+	if done, err := sh.define(statement); done || err != nil {
+		return err
+	}
+	t, err := sh.plan(strings.TrimSuffix(statement, ";"))
+	if err != nil {
+		return err
+	}
+	it, err := Engine{ Registry, sh.catalog, 0 }.Compile(t)
+	if err != nil {
+		return err
+	}
+	records, err := runIterator(context.Background(), it)
+	if err != nil {
+		return err
+	}
+	writeTable(sh.out, resultColumns(t.Head, records), records)
+	return nil
+}
+
+// define runs statement if it is a CREATE TABLE or a DROP TABLE, and reports
+// whether it was.
+func (sh *Shell) define(statement string) (bool, error) {
+	if strings.HasPrefix(statement, "{") {
+		return false, nil
+	}
+	s, err := parseStatement(statement)
+	if err != nil {
+		return true, err
+	}
+	if s.query != nil {
+		return false, nil
+	}
+	if s.create != nil {
+		w, err := sh.catalog.create(s.create, nil)
+		if err != nil {
+			return true, err
+		}
+		fmt.Fprintln(sh.out, "CREATE TABLE")
+		return true, w.Flush()
+	}
+	if err := sh.catalog.drop(s.drop); err != nil {
+		return true, err
+	}
+	fmt.Fprintln(sh.out, "DROP TABLE")
+	return true, nil
+}
+
+// resultColumns returns the columns of a PROJECTION in its order, otherwise the
+// row key followed by every column of the records in alphabetical order.
+func resultColumns(head *Node, records []*Record) []string {
+	if head.Name == "PROJECTION" {
+		if cols, _, err := parseProjectionNodeArgs(head.Args); err == nil {
+			return cols
+		}
+	}
+	cols := make([]string, 0)
+	keyed := false
+	for _, r := range(records) {
+		keyed = keyed || r.key != ""
+		for name := range(r.values) {
+			if !slices.Contains(cols, name) {
+				cols = append(cols, name)
+			}
+		}
+	}
+	slices.Sort(cols)
+	if keyed {
+		cols = append([]string{ row_key_column }, cols...)
+	}
+	return cols
+}
+
+func writeTable(out io.Writer, cols []string, records []*Record) {
+	widths := make([]int, len(cols))
+	rows := make([][]string, 0)
+	for i, col := range(cols) {
+		widths[i] = len(col)
+	}
+	for _, r := range(records) {
+		row := make([]string, len(cols))
+		for i, col := range(cols) {
+			row[i] = r.getColumn(col).String()
+			widths[i] = max(widths[i], len(row[i]))
+		}
+		rows = append(rows, row)
+	}
+	writeRow := func(row []string) {
+		cells := make([]string, len(row))
+		for i, v := range(row) {
+			cells[i] = v + strings.Repeat(" ", widths[i] - len(v))
+		}
+		fmt.Fprintln(out, strings.TrimRight(strings.Join(cells, " | "), " "))
+	}
+	writeRow(cols)
+	rules := make([]string, len(cols))
+	for i, w := range(widths) {
+		rules[i] = strings.Repeat("-", w)
+	}
+	fmt.Fprintln(out, strings.Join(rules, "-+-"))
+	for _, row := range(rows) {
+		writeRow(row)
+	}
+	if len(rows) == 1 {
+		fmt.Fprintln(out, "(1 row)")
+	} else {
+		fmt.Fprintf(out, "(%d rows)\n", len(rows))
+	}
+}
+
+func writePlan(out io.Writer, n *Node, depth int) {
+	if n == nil { return }
+	args, _ := json.Marshal(n.Args)
+	fmt.Fprintf(out, "%s%s %s\n", strings.Repeat("  ", depth), n.Name, args)
+	writePlan(out, n.Child, depth + 1)
+}
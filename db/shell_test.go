@@ -0,0 +1,128 @@
+package db
+
+import (
+	"testing"
+	"strings"
+	"bytes"
+	"os"
+	"path/filepath"
+	"fmt"
+	"reflect"
+)
+
+func TestShell(t *testing.T) {
+	data_dir := t.TempDir()
+	records := make([]Record, 0)
+	for i := 1; i <= 3; i++ {
+		k := fmt.Sprintf("%d", i)
+		records = append(records, makeRecord(k, "Movie " + k, k, "2000"))
+	}
+	writeMovies(t, filepath.Join(data_dir, "movies"), records)
+	history := filepath.Join(t.TempDir(), "history")
+
+	out := new(bytes.Buffer)
+	sh, err := OpenShell(data_dir, history, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join([]string{
+		".tables",
+		".schema movies",
+		"CREATE TABLE shows (Id INT PRIMARY KEY, Title TEXT);",
+		".tables",
+		".schema shows",
+		"DROP TABLE shows;",
+		"SELECT Name, Id",
+		"  FROM movies WHERE Id >= 2;",
+		`{"head": { "name": "LIMIT", "args": ["1"], "child": {`,
+		`  "name": "FILE_SCAN", "args": { "dir": "movies", "file_number": "0" } } } }`,
+		".explain SELECT * FROM movies WHERE _key = '2'",
+		"SELECT * FORM movies;",
+		".quit",
+		"SELECT * FROM movies;",
+	}, "\n")
+	if err := sh.Run(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	sh.Close()
+
+	expected := strings.Join([]string{
+		"tinydb> movies",
+		"tinydb> movies (Id, Name, Year)",
+		"tinydb> CREATE TABLE",
+		"tinydb> movies",
+		"shows",
+		"tinydb> shows (Id int PRIMARY KEY, Title string)",
+		"tinydb> DROP TABLE",
+		"tinydb>    ...> Name    | Id",
+		"--------+---",
+		"Movie 2 | 2",
+		"Movie 3 | 3",
+		"(2 rows)",
+		"tinydb>    ...> _key | Id | Name    | Year",
+		"-----+----+---------+-----",
+		"1    | 1  | Movie 1 | 2000",
+		"(1 row)",
+		`tinydb> INDEX_SCAN {"hi":"2\u0000","lo":"2","table":"movies"}`,
+		`tinydb> Error: syntax error at position 10 near "FORM": expected FROM`,
+		"tinydb> ",
+	}, "\n")
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\nActual\n%s", expected, out.String())
+	}
+
+	data, err := os.ReadFile(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_history := "CREATE TABLE shows (Id INT PRIMARY KEY, Title TEXT);\n" +
+		"DROP TABLE shows;\n" +
+		"SELECT Name, Id FROM movies WHERE Id >= 2;\n" +
+		`{"head": { "name": "LIMIT", "args": ["1"], "child": { "name": "FILE_SCAN", ` +
+		`"args": { "dir": "movies", "file_number": "0" } } } }` + "\n" +
+		"SELECT * FORM movies;\n"
+	if string(data) != expected_history {
+		t.Errorf("Expected %q. Actual %q", expected_history, string(data))
+	}
+}
+
+func TestShellStringLiterals(t *testing.T) {
+	for _, c := range([]struct {
+		statement string
+		expected bool
+	}{
+		{ "SELECT * FROM movies WHERE Name = 'a;", false },
+		{ "SELECT * FROM movies WHERE Name = 'a;\nb';", true },
+		{ "SELECT * FROM movies WHERE Name = 'it''s;'", false },
+		{ "SELECT * FROM movies WHERE Name = 'it''s;';", true },
+		{ `SELECT "a;" FROM movies`, false },
+		{ `{"head": { "name": "}}" `, false },
+		{ `{"head": { "name": "\"}}" } }`, true },
+		{ `{"head": { "name": "{{" } }`, true },
+	}) {
+		if actual := isCompleteStatement(c.statement); actual != c.expected {
+			t.Errorf("%q: Expected %v. Actual %v", c.statement, c.expected, actual)
+		}
+	}
+
+	history := filepath.Join(t.TempDir(), "history")
+	sh, err := OpenShell(t.TempDir(), history, new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.record("SELECT  Name\n  FROM movies WHERE Name = 'a  b\nc' OR Name = \"x  y\";")
+	sh.record(`"a  b";`)
+	sh.Close()
+	expected := []string{
+		"SELECT Name FROM movies WHERE Name = 'a  b\nc' OR Name = \"x  y\";",
+		`"a  b";`,
+	}
+	sh, err = OpenShell(t.TempDir(), history, new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sh.Close()
+	if !reflect.DeepEqual(expected, sh.history) {
+		t.Errorf("Expected %q. Actual %q", expected, sh.history)
+	}
+}
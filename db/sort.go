@@ -0,0 +1,187 @@
+package db
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+)
+
+// SORT keeps up to this many bytes of records in memory before spilling them
+const default_sort_memory = 64 << 20
+
+/*
+A sortRun is a sorted run of records a SORT spilled to a temporary file. The
+file is a single typed segment without an index: a file header whose maximum
+size is the size of the file and whose free space is 0, followed by the rows
+encoded by ToBytes. It is read back in order with readRow.
+
+The row key of a record is its row key and its values are the columns, so
+records read back are the records written, NULLs and types included.
+*/
+type sortRun struct {
+	seg *segment
+	offset int64
+}
+
+func recordToData(r *Record) *Data {
+	names := make([]string, 0, len(r.values))
+	for name := range(r.values) {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	cols := make([]Column, len(names))
+	for i, name := range(names) {
+		cols[i] = Column{ name, r.values[name] }
+	}
+	return newData(r.key, cols)
+}
+
+// recordSize is the number of bytes a record counts against the memory of a
+// SORT.
+func recordSize(r *Record) int {
+	return int(recordToData(r).size)
+}
+
+// writeRun writes the sorted records to a new temporary file.
+func writeRun(records []*Record) (*sortRun, error) {
+	f, err := os.CreateTemp("", "sort_run_")
+	if err != nil {
+		return nil, err
+	}
+	run := &sortRun{ &segment{ file: f }, 0 }
+	size, err := run.write(records)
+	if err == nil && size > math.MaxUint32 {
+		err = fmt.Errorf("%w: sort run of %d bytes", ErrNoSpace, size)
+	}
+	if err == nil {
+		opts := defaultStorageOptions()
+		h := newFileHeader(opts)
+		h.max_file_size = uint32(size)
+		_, err = f.WriteAt(h.bytes(0), 0)
+		run.seg.header = h
+	}
+	if err != nil {
+		return nil, errors.Join(err, run.remove())
+	}
+	return run, nil
+}
+
+// write writes the header placeholder and the rows, and returns the size of
+// the file.
+func (run *sortRun) write(records []*Record) (int64, error) {
+	w := bufio.NewWriter(run.seg.file)
+	size := int64(file_header_size)
+	if _, err := w.Write(make([]byte, file_header_size)); err != nil {
+		return 0, err
+	}
+	for _, r := range(records) {
+		n, err := w.Write(ToBytes(recordToData(r), true))
+		if err != nil {
+			return 0, err
+		}
+		size += int64(n)
+	}
+	return size, w.Flush()
+}
+
+// removeRuns deletes the files of runs.
+func removeRuns(runs []*sortRun) error {
+	var errs []error
+	for _, run := range(runs) {
+		errs = append(errs, run.remove())
+	}
+	return errors.Join(errs...)
+}
+
+// next returns the next record of the run, or nil at its end.
+func (run *sortRun) next() (*Record, error) {
+	data, offset, err := run.seg.readRow(run.offset)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	run.offset = offset
+	return dataToRecord(data), nil
+}
+
+func (run *sortRun) remove() error {
+	name := run.seg.file.Name()
+	return errors.Join(run.seg.file.Close(), os.Remove(name))
+}
+
+type runHead struct {
+	record *Record
+	run int
+}
+
+/*
+runMerge merges sorted runs with a heap holding the next record of every run.
+Records that compare equal come out in the order of their runs, so a merge of
+runs spilled in order is stable.
+*/
+type runMerge struct {
+	runs []*sortRun
+	heads []runHead
+	compare func(a, b *Record) int
+}
+
+func (m *runMerge) Len() int {
+	return len(m.heads)
+}
+
+func (m *runMerge) Less(i, j int) bool {
+	if c := m.compare(m.heads[i].record, m.heads[j].record); c != 0 {
+		return c < 0
+	}
+	return m.heads[i].run < m.heads[j].run
+}
+
+func (m *runMerge) Swap(i, j int) {
+	m.heads[i], m.heads[j] = m.heads[j], m.heads[i]
+}
+
+func (m *runMerge) Push(x any) {
+	m.heads = append(m.heads, x.(runHead))
+}
+
+func (m *runMerge) Pop() any {
+	last := m.heads[len(m.heads) - 1]
+	m.heads = m.heads[:len(m.heads) - 1]
+	return last
+}
+
+func initRunMerge(runs []*sortRun, compare func(a, b *Record) int) (*runMerge, error) {
+	m := &runMerge{ runs, make([]runHead, 0, len(runs)), compare }
+	for i, run := range(runs) {
+		r, err := run.next()
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			m.heads = append(m.heads, runHead{ r, i })
+		}
+	}
+	heap.Init(m)
+	return m, nil
+}
+
+func (m *runMerge) next() (*Record, error) {
+	if len(m.heads) == 0 {
+		return nil, nil
+	}
+	head := m.heads[0]
+	r, err := m.runs[head.run].next()
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		heap.Pop(m)
+	} else {
+		m.heads[0].record = r
+		heap.Fix(m, 0)
+	}
+	return head.record, nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"testing"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+)
+
+func makeSortRecords() []Record {
+	records := make([]Record, 0)
+	for i := 0; i < 200; i++ {
+		r := Record{ key: fmt.Sprintf("%d", i), values: map[string]Value{
+			"Id": IntValue(int64(i)),
+			"Year": IntValue(int64(1900 + (i * 37) % 50)),
+			"Rating": FloatValue(float64(i % 7) / 2),
+			"Name": StringValue(fmt.Sprintf("Movie %d", i % 13)),
+		} }
+		if i % 11 == 0 {
+			r.values["Year"] = NullValue()
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func sortAll(t *testing.T, sort *SortNode) []*Record {
+	t.Helper()
+	if err := sort.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records := make([]*Record, 0)
+	for {
+		r, err := sort.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil { break }
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestExternalSort(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	tuples := []SortTuple{ { "Year", DESC, NULLS_FIRST }, { "Rating", ASC, NULLS_LAST } }
+	expected := sortAll(t, initSortNode(initStaticScan(makeSortRecords()), tuples))
+
+	for _, memory := range([]int{ 1, 100, 1000 }) {
+		sort := initSortNode(initStaticScan(makeSortRecords()), tuples)
+		sort.memory = memory
+		actual := sortAll(t, sort)
+		if len(sort.runs) < 2 {
+			t.Errorf("%d: Expected several runs. Actual %d", memory, len(sort.runs))
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%d: Expected %v. Actual %v", memory, expected, actual)
+		}
+		if err := sort.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+			t.Errorf("%d: Expected no run files. Actual %v", memory, entries)
+		}
+	}
+
+	sort := initSortNode(initStaticScan([]Record{}), tuples)
+	sort.memory = 1
+	if records := sortAll(t, sort); len(records) != 0 || len(sort.runs) != 0 {
+		t.Errorf("Expected no records. Actual %v", records)
+	}
+}
+
+func TestQueryExternalSort(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{ NoSync: true, SortMemory: 64 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Year INT)"); err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		if err := db.Put("movies", map[string]any{ "Id": i, "Year": 2000 - i }); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, fmt.Sprintf("%d", 49 - i))
+	}
+	rows, err := db.Query("SELECT * FROM movies ORDER BY Year")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := rowKeys(t, rows); !slices.Equal(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+}
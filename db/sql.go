@@ -0,0 +1,1144 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+The SQL front-end compiles a query into the same plan tree as the JSON format,
+which Engine.Parse then runs, and table definitions into the schemas of the
+catalog. The grammar is:
+
+statement  := ( query | create | drop ) [ ";" ]
+query      := SELECT columns FROM table [ WHERE condition ] [ GROUP BY names ]
+              [ HAVING condition ] [ ORDER BY orders ] [ LIMIT number ]
+create     := CREATE TABLE table "(" definition { "," definition } ")"
+definition := name type { PRIMARY KEY | NOT NULL }
+drop       := DROP TABLE table
+columns    := "*" | selected { "," selected }
+selected   := expression [ AS name ]
+column     := name | aggregate
+aggregate  := COUNT "(" ( "*" | [ DISTINCT ] name ) ")"
+              | ( SUM | AVG | MIN | MAX | user aggregate ) "(" name ")"
+table      := name | string
+condition  := term { OR term }
+term       := negation { AND negation }
+negation   := NOT negation | "(" condition ")" | comparison
+comparison := expression ( "=" | "!=" | "<>" | "<" | ">" | "<=" | ">=" ) expression
+              | expression IS [ NOT ] NULL
+              | expression [ NOT ] IN "(" literal { "," literal } ")"
+              | expression [ NOT ] BETWEEN literal AND literal
+              | expression [ NOT ] LIKE string
+              | expression REGEXP string
+expression := sum { "||" sum }
+sum        := product { ( "+" | "-" ) product }
+product    := factor { ( "*" | "/" ) factor }
+factor     := [ "-" ] ( column | literal | "(" expression ")"
+              | COALESCE "(" expression { "," expression } ")"
+              | function "(" [ expression { "," expression } ] ")"
+              | CAST "(" expression AS name ")"
+              | CASE WHEN condition THEN expression { WHEN condition THEN expression }
+                [ ELSE expression ] END )
+literal    := string | [ "-" ] number | TRUE | FALSE | NULL
+names      := name { "," name }
+orders     := order { "," order }
+order      := column [ ASC | DESC ] [ NULLS ( FIRST | LAST ) ]
+name       := identifier | "quoted identifier"
+string     := 'text, with '' for a quote'
+
+Keywords and types are case-insensitive and the row key is the _key column.
+The types are the ones of value.go, also named TEXT, INTEGER, REAL and BOOLEAN.
+A table is looked up by name in the catalog. NOT binds tighter than AND, which
+binds tighter than OR.
+Numbers without a fraction are integers, the others floats. A comparison with
+NULL is never true, nor is IN a list holding NULL unless the column is in it.
+In a LIKE pattern % matches any text, _ any character and a backslash makes the
+next character literal. Aggregates other than COUNT(*) skip NULLs and NULLs sort
+last unless NULLS FIRST, in either order. Rows equal on every ORDER BY column
+keep their order.
+
+Aggregates are computed by an AGGREGATE node and named as in aggregateName
+unless renamed with AS. HAVING, ORDER BY and the selected columns refer to them
+by that name or by the aggregate itself; WHERE cannot. The other selected
+expressions are computed by the PROJECTION, in a column named with AS or by
+expression.String, so ORDER BY cannot refer to them. A comparison needs a
+column on one side at least. A function is one of Functions and a user
+aggregate one of UserAggregates, both named in any case.
+
+SELECT Name, COUNT(*) FROM movies WHERE Year >= 2000 AND Year < 2010
+GROUP BY Name HAVING AVG(Rating) > 3 LIMIT 5
+
+compiles to
+
+PROJECTION ["Name", "Count"]
+  LIMIT ["5"]
+    AGGREGATE { group: ["Name"], aggregates: [{ function: "COUNT", column: "*" },
+        { function: "AVG", column: "Rating" }], having: { GT: ["AVG(Rating)", 3] } }
+      SELECTION { AND: [{ GT_E: ["Year", 2000] }, { LT: ["Year", 2010] }] }
+        FILE_SCAN { table: "movies" }
+*/
+
+type sqlTokenKind int
+
+const (
+	sql_eof sqlTokenKind = iota
+	sql_keyword
+	sql_ident
+	sql_string
+	sql_number
+	sql_symbol
+)
+
+var sql_keywords = []string{ "SELECT", "FROM", "WHERE", "AND", "OR", "GROUP",
+	"ORDER", "BY", "LIMIT", "ASC", "DESC", "COUNT", "TRUE", "FALSE", "CREATE", "DROP",
+	"TABLE", "PRIMARY", "KEY", "IS", "NOT", "NULL", "NULLS", "FIRST", "LAST", "SUM", "AVG",
+	"MIN", "MAX", "DISTINCT", "AS", "HAVING", "IN", "BETWEEN", "LIKE", "REGEXP", "CASE", "WHEN",
+	"THEN", "ELSE", "END", "COALESCE", "CAST" }
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	// 1-based offset of the token in the query
+	pos int
+}
+
+func (t sqlToken) String() string {
+	switch t.kind {
+		case sql_eof:
+			return "end of query"
+		case sql_string:
+			return fmt.Sprintf("'%s'", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func sqlSyntaxError(t sqlToken, format string, args ...any) error {
+	if t.kind == sql_eof {
+		return fmt.Errorf("%w at end of query: %s", ErrSyntax, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%w at position %d near %s: %s", ErrSyntax, t.pos, t,
+		fmt.Sprintf(format, args...))
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func lexSQL(q string) ([]sqlToken, error) {
+	tokens := make([]sqlToken, 0)
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		start := i
+		switch {
+			case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+				i++
+			case isIdentStart(c):
+				for i < len(q) && (isIdentStart(q[i]) || isDigit(q[i])) { i++ }
+				word := q[start:i]
+				if slices.Contains(sql_keywords, strings.ToUpper(word)) {
+					tokens = append(tokens, sqlToken{ sql_keyword, strings.ToUpper(word), start + 1 })
+				} else {
+					tokens = append(tokens, sqlToken{ sql_ident, word, start + 1 })
+				}
+			case isDigit(c):
+				i++
+				for i < len(q) && (isDigit(q[i]) || q[i] == '.') { i++ }
+				tokens = append(tokens, sqlToken{ sql_number, q[start:i], start + 1 })
+			case c == '\'' || c == '"':
+				text, n, ok := lexQuoted(q[i:], c)
+				if !ok {
+					return nil, fmt.Errorf("%w at position %d: unterminated %c", ErrSyntax, start + 1, c)
+				}
+				kind := sql_string
+				if c == '"' {
+					kind = sql_ident
+				}
+				tokens = append(tokens, sqlToken{ kind, text, start + 1 })
+				i += n
+			case c == '<' || c == '>' || (c == '!' && i + 1 < len(q) && q[i + 1] == '='):
+				i++
+				if i < len(q) && (q[i] == '=' || (c == '<' && q[i] == '>')) { i++ }
+				tokens = append(tokens, sqlToken{ sql_symbol, q[start:i], start + 1 })
+			case c == '|' && i + 1 < len(q) && q[i + 1] == '|':
+				i += 2
+				tokens = append(tokens, sqlToken{ sql_symbol, "||", start + 1 })
+			case strings.IndexByte(",()*=;+-/", c) >= 0:
+				i++
+				tokens = append(tokens, sqlToken{ sql_symbol, q[start:i], start + 1 })
+			default:
+				return nil, fmt.Errorf("%w at position %d: unexpected character %q", ErrSyntax,
+					start + 1, c)
+		}
+	}
+	return append(tokens, sqlToken{ sql_eof, "", len(q) + 1 }), nil
+}
+
+// lexQuoted reads the text quoted by q at the start of s, where a doubled
+// quote stands for the quote itself. It returns the text and the number of
+// bytes read.
+func lexQuoted(s string, q byte) (string, int, bool) {
+	var text strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != q {
+			text.WriteByte(s[i])
+			continue
+		}
+		if i + 1 < len(s) && s[i + 1] == q {
+			text.WriteByte(q)
+			i++
+			continue
+		}
+		return text.String(), i + 1, true
+	}
+	return "", 0, false
+}
+
+type sqlParser struct {
+	tokens []sqlToken
+	i int
+	// the aggregates of the query, in the order they are first seen
+	aggregates []Aggregate
+}
+
+// sqlStatement is either a query, a table to create or a table to drop.
+type sqlStatement struct {
+	query *Tree
+	create *TableSchema
+	drop string
+}
+
+// parseSQL compiles a query into a plan tree for transformToQueryTree.
+func parseSQL(q string) (*Tree, error) {
+	tokens, err := lexSQL(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{ tokens, 0, nil }
+	head, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEnd(); err != nil {
+		return nil, err
+	}
+	return &Tree{ head }, nil
+}
+
+func parseStatement(q string) (*sqlStatement, error) {
+	tokens, err := lexSQL(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{ tokens, 0, nil }
+	statement := &sqlStatement{}
+	switch {
+		case p.isKeyword("CREATE"):
+			statement.create, err = p.parseCreate()
+		case p.isKeyword("DROP"):
+			p.advance()
+			if err = p.expectKeyword("TABLE"); err == nil {
+				statement.drop, err = p.parseTable()
+			}
+		default:
+			var head *Node
+			head, err = p.parseQuery()
+			statement.query = &Tree{ head }
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEnd(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func (p *sqlParser) expectEnd() error {
+	if p.isSymbol(";") {
+		p.advance()
+	}
+	if t := p.peek(); t.kind != sql_eof {
+		return sqlSyntaxError(t, "expected end of query")
+	}
+	return nil
+}
+
+func (p *sqlParser) parseCreate() (*TableSchema, error) {
+	for _, k := range([]string{ "CREATE", "TABLE" }) {
+		if err := p.expectKeyword(k); err != nil {
+			return nil, err
+		}
+	}
+	name, err := p.parseTable()
+	if err != nil {
+		return nil, err
+	}
+	t := &TableSchema{ Name: name, Columns: make([]ColumnSchema, 0) }
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		type_token := p.advance()
+		typ, ok := parseValueType(type_token.text)
+		if type_token.kind != sql_ident || !ok {
+			return nil, sqlSyntaxError(type_token, "expected a column type")
+		}
+		not_null := false
+		for p.isKeyword("PRIMARY") || p.isKeyword("NOT") {
+			constraint := p.advance()
+			next := "NULL"
+			if constraint.text == "PRIMARY" {
+				next = "KEY"
+			}
+			if err := p.expectKeyword(next); err != nil {
+				return nil, err
+			}
+			if constraint.text == "NOT" {
+				not_null = true
+				continue
+			}
+			if t.PrimaryKey != "" {
+				return nil, sqlSyntaxError(constraint, "the table already has a primary key")
+			}
+			t.PrimaryKey = col
+		}
+		t.Columns = append(t.Columns, ColumnSchema{ col, typ, not_null })
+		if !p.isSymbol(",") {
+			break
+		}
+		p.advance()
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.i]
+}
+
+func (p *sqlParser) advance() sqlToken {
+	t := p.tokens[p.i]
+	if t.kind != sql_eof {
+		p.i++
+	}
+	return t
+}
+
+func (p *sqlParser) isKeyword(k string) bool {
+	t := p.peek()
+	return t.kind == sql_keyword && t.text == k
+}
+
+func (p *sqlParser) isSymbol(s string) bool {
+	t := p.peek()
+	return t.kind == sql_symbol && t.text == s
+}
+
+func (p *sqlParser) expectKeyword(k string) error {
+	if !p.isKeyword(k) {
+		return sqlSyntaxError(p.peek(), "expected %s", k)
+	}
+	p.advance()
+	return nil
+}
+
+func (p *sqlParser) expectSymbol(s string) error {
+	if !p.isSymbol(s) {
+		return sqlSyntaxError(p.peek(), "expected %s", s)
+	}
+	p.advance()
+	return nil
+}
+
+func (p *sqlParser) parseQuery() (*Node, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	cols, exprs, err := p.parseColumns()
+	if err != nil {
+		return nil, err
+	}
+	selected := len(p.aggregates)
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.parseTable()
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{ "FILE_SCAN", map[string]interface{}{ "table": table }, nil }
+
+	if p.isKeyword("WHERE") {
+		t := p.advance()
+		predicates, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if len(p.aggregates) != selected {
+			return nil, sqlSyntaxError(t, "aggregates are not allowed in WHERE, use HAVING")
+		}
+		node = &Node{ "SELECTION", predicatesToArgs(predicates), node }
+	}
+
+	var group []string
+	if p.isKeyword("GROUP") {
+		p.advance()
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		group, err = p.parseNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var having *predicateTree
+	if p.isKeyword("HAVING") {
+		p.advance()
+		having, err = p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var orders []string
+	if p.isKeyword("ORDER") {
+		p.advance()
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		orders, err = p.parseOrders()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.aggregates) > 0 || group != nil || having != nil {
+		for i, col := range(cols) {
+			read := []string{ col }
+			if exprs[i] != nil {
+				read = exprs[i].columns()
+			}
+			for _, col := range(read) {
+				if !slices.Contains(group, col) && !p.isColumnName(col) {
+					return nil, fmt.Errorf("%w: column %s must be in GROUP BY", ErrSyntax, col)
+				}
+			}
+		}
+		args := map[string]interface{}{ "group": stringsToArgs(group),
+			"aggregates": aggregatesToArgs(p.aggregates) }
+		if having != nil {
+			args["having"] = predicatesToArgs(having)
+		}
+		node = &Node{ "AGGREGATE", args, node }
+	}
+
+	if orders != nil {
+		node = &Node{ "SORT", stringsToArgs(orders), node }
+	}
+
+	if p.isKeyword("LIMIT") {
+		p.advance()
+		t := p.advance()
+		if _, err := strconv.ParseUint(t.text, 10, 32); t.kind != sql_number || err != nil {
+			return nil, sqlSyntaxError(t, "expected a number of rows")
+		}
+		node = &Node{ "LIMIT", []interface{}{ t.text }, node }
+	}
+
+	if cols != nil {
+		node = &Node{ "PROJECTION", projectionToArgs(cols, exprs), node }
+	}
+	return node, nil
+}
+
+func aggregatesToArgs(aggregates []Aggregate) []interface{} {
+	args := make([]interface{}, len(aggregates))
+	for i, a := range(aggregates) {
+		arg := map[string]interface{}{ "function": a.functionName(), "column": a.column }
+		if a.as != "" {
+			arg["as"] = a.as
+		}
+		args[i] = arg
+	}
+	return args
+}
+
+// projectionToArgs is the inverse of parseProjectionNodeArgs.
+func projectionToArgs(cols []string, exprs []*expression) []interface{} {
+	args := make([]interface{}, len(cols))
+	for i, col := range(cols) {
+		args[i] = col
+		if exprs[i] != nil {
+			args[i] = map[string]interface{}{ "as": col, "expression": expressionToArg(exprs[i]) }
+		}
+	}
+	return args
+}
+
+// parseColumns returns the selected columns, nil for *, and the expression
+// computing each column that is not copied from the records the PROJECTION
+// reads.
+func (p *sqlParser) parseColumns() ([]string, []*expression, error) {
+	if p.isSymbol("*") {
+		p.advance()
+		return nil, nil, nil
+	}
+	cols := make([]string, 0)
+	exprs := make([]*expression, 0)
+	for {
+		t, aggregate := p.peek(), p.isAggregateStart()
+		e, err := p.parseExpression()
+		if err != nil {
+			return nil, nil, err
+		}
+		col := e.String()
+		computed := e
+		if e.op == EXPR_COLUMN {
+			computed = nil
+		}
+		if p.isKeyword("AS") {
+			if e.op == EXPR_COLUMN && aggregate {
+				col, err = p.parseAlias(t, col)
+			} else {
+				p.advance()
+				col, err = p.parseName()
+				computed = e
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		cols = append(cols, col)
+		exprs = append(exprs, computed)
+		if !p.isSymbol(",") {
+			return cols, exprs, nil
+		}
+		p.advance()
+	}
+}
+
+// parseAlias names the aggregate col, started at t, after AS.
+func (p *sqlParser) parseAlias(t sqlToken, col string) (string, error) {
+	p.advance()
+	i := slices.IndexFunc(p.aggregates, func(a Aggregate) bool { return a.name() == col })
+	if i < 0 {
+		return "", sqlSyntaxError(t, "only aggregates can be renamed with AS")
+	}
+	as, err := p.parseName()
+	if err != nil {
+		return "", err
+	}
+	if p.aggregates[i].as != "" && p.aggregates[i].as != as {
+		return "", sqlSyntaxError(t, "aggregate %s is already named", col)
+	}
+	if as != col && p.isColumnName(as) {
+		return "", sqlSyntaxError(t, "column %s is not unique", as)
+	}
+	p.aggregates[i].as = as
+	return as, nil
+}
+
+// isColumnName reports whether an aggregate of the query is named name.
+func (p *sqlParser) isColumnName(name string) bool {
+	return slices.ContainsFunc(p.aggregates, func(a Aggregate) bool { return a.name() == name })
+}
+
+var sql_aggregates = map[string]AggregateFunction {
+	"COUNT": AGG_COUNT,
+	"SUM": AGG_SUM,
+	"AVG": AGG_AVG,
+	"MIN": AGG_MIN,
+	"MAX": AGG_MAX,
+}
+
+func isAggregateKeyword(t sqlToken) bool {
+	_, ok := sql_aggregates[t.text]
+	return t.kind == sql_keyword && ok
+}
+
+// isAggregateStart reports whether the next token starts an aggregate, a user
+// aggregate being a name of UserAggregates followed by "(".
+func (p *sqlParser) isAggregateStart() bool {
+	t := p.peek()
+	if isAggregateKeyword(t) {
+		return true
+	}
+	_, ok := lookupUserAggregate(strings.ToUpper(t.text))
+	return ok && t.kind == sql_ident && p.i + 1 < len(p.tokens) &&
+		p.tokens[p.i + 1].kind == sql_symbol && p.tokens[p.i + 1].text == "("
+}
+
+// parseColumn returns a column name, or the name of the column holding an
+// aggregate, which is added to the aggregates of the query the first time.
+func (p *sqlParser) parseColumn() (string, error) {
+	if !p.isAggregateStart() {
+		return p.parseName()
+	}
+	t := p.advance()
+	function, user := sql_aggregates[t.text], ""
+	if t.kind == sql_ident {
+		function, user = AGG_USER, strings.ToUpper(t.text)
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return "", err
+	}
+	column := count_all
+	if function == AGG_COUNT && p.isSymbol("*") {
+		p.advance()
+	} else {
+		if function == AGG_COUNT && p.isKeyword("DISTINCT") {
+			p.advance()
+			function = AGG_COUNT_DISTINCT
+		}
+		var err error
+		if column, err = p.parseName(); err != nil {
+			return "", err
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return "", err
+	}
+	for _, a := range(p.aggregates) {
+		if a.function == function && a.column == column && a.user == user {
+			return a.name(), nil
+		}
+	}
+	a := Aggregate{ function, column, "", user }
+	if p.isColumnName(a.name()) {
+		return "", sqlSyntaxError(p.peek(), "column %s is not unique", a.name())
+	}
+	p.aggregates = append(p.aggregates, a)
+	return a.name(), nil
+}
+
+func (p *sqlParser) parseName() (string, error) {
+	t := p.advance()
+	if t.kind != sql_ident {
+		return "", sqlSyntaxError(t, "expected a column name")
+	}
+	return t.text, nil
+}
+
+func (p *sqlParser) parseNames() ([]string, error) {
+	names := make([]string, 0)
+	for {
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.isSymbol(",") {
+			return names, nil
+		}
+		p.advance()
+	}
+}
+
+func (p *sqlParser) parseTable() (string, error) {
+	t := p.advance()
+	if t.kind != sql_ident && t.kind != sql_string {
+		return "", sqlSyntaxError(t, "expected a table name")
+	}
+	return t.text, nil
+}
+
+func (p *sqlParser) parseOrders() ([]string, error) {
+	orders := make([]string, 0)
+	for {
+		col, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+		order := col + ":ASC"
+		if p.isKeyword("DESC") {
+			p.advance()
+			order = col + ":DESC"
+		} else if p.isKeyword("ASC") {
+			p.advance()
+		}
+		if p.isKeyword("NULLS") {
+			p.advance()
+			t := p.advance()
+			if t.kind != sql_keyword || (t.text != "FIRST" && t.text != "LAST") {
+				return nil, sqlSyntaxError(t, "expected FIRST or LAST")
+			}
+			order += ":NULLS_" + t.text
+		}
+		orders = append(orders, order)
+		if !p.isSymbol(",") {
+			return orders, nil
+		}
+		p.advance()
+	}
+}
+
+var sql_comp_ops = map[string]CompOp {
+	"=": EQ,
+	"!=": NE,
+	"<>": NE,
+	"<": LT,
+	">": GT,
+	"<=": LT_E,
+	">=": GT_E,
+}
+
+// flipped_comp_ops turns "value op column" into "column op value"
+var flipped_comp_ops = map[CompOp]CompOp {
+	EQ: EQ,
+	NE: NE,
+	LT: GT,
+	GT: LT,
+	LT_E: GT_E,
+	GT_E: LT_E,
+}
+
+// parseCondition returns the comparisons joined by OR, AND and NOT, which bind
+// in the reverse order.
+func (p *sqlParser) parseCondition() (*predicateTree, error) {
+	return p.parseJunction(OR)
+}
+
+// parseJunction reads the operands joined by op: the terms joined by OR or the
+// negations joined by AND.
+func (p *sqlParser) parseJunction(op Op) (*predicateTree, error) {
+	terms := make([]*predicateTree, 0)
+	for {
+		var term *predicateTree
+		var err error
+		if op == OR {
+			term, err = p.parseJunction(AND)
+		} else {
+			term, err = p.parseNegation()
+		}
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		if !p.isKeyword(opNames[op]) {
+			break
+		}
+		p.advance()
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return initPredicateTree(op, terms...), nil
+}
+
+func (p *sqlParser) parseNegation() (*predicateTree, error) {
+	switch {
+		case p.isKeyword("NOT"):
+			p.advance()
+			negated, err := p.parseNegation()
+			if err != nil {
+				return nil, err
+			}
+			return initPredicateTree(NOT, negated), nil
+		case p.isSymbol("("):
+			return p.parseGroup()
+	}
+	return p.parseComparison()
+}
+
+// parseGroup reads a parenthesised condition, or else a comparison starting
+// with a parenthesised expression. When neither parses, the error is the one
+// of the attempt that read further.
+func (p *sqlParser) parseGroup() (*predicateTree, error) {
+	start, aggregates := p.i, len(p.aggregates)
+	p.advance()
+	condition, err := p.parseCondition()
+	if err == nil {
+		err = p.expectSymbol(")")
+	}
+	if err == nil {
+		return condition, nil
+	}
+	read := p.i
+	p.i, p.aggregates = start, p.aggregates[:aggregates]
+	comparison, c_err := p.parseComparison()
+	if c_err != nil && read > p.i {
+		return nil, err
+	}
+	return comparison, c_err
+}
+
+var sql_expr_ops = map[string]ExprOp {
+	"+": EXPR_ADD,
+	"-": EXPR_SUB,
+	"*": EXPR_MUL,
+	"/": EXPR_DIV,
+	"||": EXPR_CONCAT,
+}
+
+// the operators of expressions, from the ones binding loosest
+var sql_expr_levels = [][]string{ { "||" }, { "+", "-" }, { "*", "/" } }
+
+func (p *sqlParser) parseExpression() (*expression, error) {
+	return p.parseOperators(0)
+}
+
+// parseOperators reads the operands joined by the operators of the level,
+// which apply from left to right.
+func (p *sqlParser) parseOperators(level int) (*expression, error) {
+	if level == len(sql_expr_levels) {
+		return p.parseFactor()
+	}
+	e, err := p.parseOperators(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != sql_symbol || !slices.Contains(sql_expr_levels[level], t.text) {
+			return e, nil
+		}
+		p.advance()
+		right, err := p.parseOperators(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		op := sql_expr_ops[t.text]
+		if op == EXPR_CONCAT && e.op == EXPR_CONCAT {
+			e.args = append(e.args, right)
+		} else {
+			e = initExpression(op, e, right)
+		}
+	}
+}
+
+// parseFactor returns the next operand of an expression, an aggregate as the
+// column holding it.
+func (p *sqlParser) parseFactor() (*expression, error) {
+	t := p.peek()
+	switch {
+		case p.isNegativeNumber() || isLiteral(t):
+			v, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			return initValueExpression(v), nil
+		case p.isSymbol("-"):
+			p.advance()
+			e, err := p.parseFactor()
+			if err != nil {
+				return nil, err
+			}
+			return initExpression(EXPR_SUB, initValueExpression(IntValue(0)), e), nil
+		case p.isSymbol("("):
+			p.advance()
+			e, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expectSymbol(")")
+		case p.isKeyword("CASE"):
+			return p.parseCase()
+		case p.isKeyword("COALESCE"):
+			p.advance()
+			if err := p.expectSymbol("("); err != nil {
+				return nil, err
+			}
+			args := make([]*expression, 0)
+			for {
+				arg, err := p.parseExpression()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if !p.isSymbol(",") { break }
+				p.advance()
+			}
+			return initExpression(EXPR_COALESCE, args...), p.expectSymbol(")")
+		case p.isKeyword("CAST"):
+			p.advance()
+			if err := p.expectSymbol("("); err != nil {
+				return nil, err
+			}
+			e, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectKeyword("AS"); err != nil {
+				return nil, err
+			}
+			typ := p.peek()
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := parseValueType(name); !ok {
+				return nil, sqlSyntaxError(typ, "unknown type %s", name)
+			}
+			cast, err := initCallExpression("CAST", e, initValueExpression(StringValue(name)))
+			if err != nil {
+				return nil, err
+			}
+			return cast, p.expectSymbol(")")
+		case t.kind == sql_ident && !p.isAggregateStart() && p.i + 1 < len(p.tokens) &&
+			p.tokens[p.i + 1].text == "(" && p.tokens[p.i + 1].kind == sql_symbol:
+			return p.parseCall()
+		case t.kind == sql_ident || isAggregateKeyword(t):
+			col, err := p.parseColumn()
+			if err != nil {
+				return nil, err
+			}
+			return initColumnExpression(col), nil
+	}
+	return nil, sqlSyntaxError(t, "expected a column or a value")
+}
+
+// parseCall reads the call of a function of Functions.
+func (p *sqlParser) parseCall() (*expression, error) {
+	t := p.advance()
+	name := strings.ToUpper(t.text)
+	functions_mutex.RLock()
+	_, ok := Functions[name]
+	functions_mutex.RUnlock()
+	if !ok {
+		return nil, sqlSyntaxError(t, "unknown function %s", t.text)
+	}
+	p.advance()
+	args := make([]*expression, 0)
+	for !p.isSymbol(")") {
+		if len(args) > 0 {
+			if err := p.expectSymbol(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.advance()
+	call, err := initCallExpression(name, args...)
+	if err != nil {
+		return nil, sqlSyntaxError(t, "%s does not take %d arguments", name, len(args))
+	}
+	return call, nil
+}
+
+func (p *sqlParser) parseCase() (*expression, error) {
+	p.advance()
+	when := make([]*predicateTree, 0)
+	then := make([]*expression, 0)
+	for len(when) == 0 || p.isKeyword("WHEN") {
+		if err := p.expectKeyword("WHEN"); err != nil {
+			return nil, err
+		}
+		condition, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("THEN"); err != nil {
+			return nil, err
+		}
+		e, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		when = append(when, condition)
+		then = append(then, e)
+	}
+	var otherwise *expression
+	if p.isKeyword("ELSE") {
+		p.advance()
+		var err error
+		if otherwise, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("END"); err != nil {
+		return nil, err
+	}
+	return initCaseExpression(when, then, otherwise), nil
+}
+
+func (p *sqlParser) parseComparison() (*predicateTree, error) {
+	t := p.peek()
+	left, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if p.isKeyword("IS") {
+		if left.op == EXPR_VALUE {
+			return nil, sqlSyntaxError(t, "expected a column")
+		}
+		p.advance()
+		op := IS_NULL
+		if p.isKeyword("NOT") {
+			p.advance()
+			op = IS_NOT_NULL
+		}
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return initPredicateLeaf(initPredicateExpression("", op, NullValue()).withLeft(left)), nil
+	}
+	if p.isKeyword("NOT") || p.isKeyword("IN") || p.isKeyword("BETWEEN") ||
+		p.isKeyword("LIKE") || p.isKeyword("REGEXP") {
+		if left.op == EXPR_VALUE {
+			return nil, sqlSyntaxError(t, "expected a column")
+		}
+		return p.parseMatch(left)
+	}
+	op_t := p.advance()
+	op, ok := sql_comp_ops[op_t.text]
+	if op_t.kind != sql_symbol || !ok {
+		return nil, sqlSyntaxError(op_t, "expected a comparison operator")
+	}
+	right, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if left.op == EXPR_VALUE && right.op == EXPR_VALUE {
+		return nil, sqlSyntaxError(t, "expected a comparison with a column")
+	}
+	return initPredicateLeaf(initPredicateOperands(left, op, right)), nil
+}
+
+// parseMatch reads the [NOT] IN, [NOT] BETWEEN, [NOT] LIKE or REGEXP test of
+// left.
+func (p *sqlParser) parseMatch(left *expression) (*predicateTree, error) {
+	negated := p.isKeyword("NOT")
+	if negated {
+		p.advance()
+	}
+	t := p.advance()
+	switch {
+		case t.kind == sql_keyword && t.text == "IN":
+			if err := p.expectSymbol("("); err != nil {
+				return nil, err
+			}
+			values, err := p.parseLiterals()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			op := IN
+			if negated {
+				op = NOT_IN
+			}
+			return initPredicateLeaf(initPredicateList("", op, values).withLeft(left)), nil
+		case t.kind == sql_keyword && t.text == "BETWEEN":
+			lo, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectKeyword("AND"); err != nil {
+				return nil, err
+			}
+			hi, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			return negate(negated, initPredicateList("", BETWEEN, []Value{ lo, hi }).withLeft(left)), nil
+		case t.kind == sql_keyword && (t.text == "LIKE" || (t.text == "REGEXP" && !negated)):
+			pattern := p.advance()
+			if pattern.kind != sql_string {
+				return nil, sqlSyntaxError(pattern, "expected a string")
+			}
+			op := LIKE
+			if t.text == "REGEXP" {
+				op = REGEXP
+			}
+			match, err := initPredicatePattern("", op, pattern.text)
+			if err != nil {
+				return nil, sqlSyntaxError(pattern, "%v", err)
+			}
+			return negate(negated, match.withLeft(left)), nil
+	}
+	if negated {
+		return nil, sqlSyntaxError(t, "expected IN, BETWEEN or LIKE")
+	}
+	return nil, sqlSyntaxError(t, "expected a comparison operator")
+}
+
+func negate(negated bool, p *predicateExpression) *predicateTree {
+	if negated {
+		return initPredicateTree(NOT, initPredicateLeaf(p))
+	}
+	return initPredicateLeaf(p)
+}
+
+// isNegativeNumber reports whether the next tokens are - and a number.
+func (p *sqlParser) isNegativeNumber() bool {
+	return p.isSymbol("-") && p.i + 1 < len(p.tokens) && p.tokens[p.i + 1].kind == sql_number
+}
+
+func (p *sqlParser) parseLiteral() (Value, error) {
+	if p.isNegativeNumber() {
+		t := p.advance()
+		return literalValue(sqlToken{ sql_number, "-" + p.advance().text, t.pos })
+	}
+	t := p.advance()
+	if !isLiteral(t) {
+		return Value{}, sqlSyntaxError(t, "expected a value")
+	}
+	return literalValue(t)
+}
+
+func (p *sqlParser) parseLiterals() ([]Value, error) {
+	values := make([]Value, 0)
+	for {
+		v, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if !p.isSymbol(",") {
+			return values, nil
+		}
+		p.advance()
+	}
+}
+
+func isLiteral(t sqlToken) bool {
+	return t.kind == sql_string || t.kind == sql_number ||
+		(t.kind == sql_keyword && (t.text == "TRUE" || t.text == "FALSE" || t.text == "NULL"))
+}
+
+func literalValue(t sqlToken) (Value, error) {
+	switch t.kind {
+		case sql_string:
+			return StringValue(t.text), nil
+		case sql_keyword:
+			if t.text == "NULL" {
+				return NullValue(), nil
+			}
+			return BoolValue(t.text == "TRUE"), nil
+	}
+	if v, err := parseValue(t.text, TYPE_INT); err == nil {
+		return v, nil
+	}
+	v, err := parseValue(t.text, TYPE_FLOAT)
+	if err != nil {
+		return Value{}, sqlSyntaxError(t, "invalid number")
+	}
+	return v, nil
+}
+
+func stringsToArgs(s []string) []interface{} {
+	args := make([]interface{}, len(s))
+	for i, v := range(s) {
+		args[i] = v
+	}
+	return args
+}
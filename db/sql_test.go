@@ -0,0 +1,238 @@
+package db
+
+import (
+	"testing"
+	"reflect"
+	"errors"
+	"strings"
+	"slices"
+	"os"
+	"fmt"
+)
+
+func TestParseSQL(t *testing.T) {
+	scan := &Node{ "FILE_SCAN", map[string]interface{}{ "table": "movies" }, nil }
+	cases := []struct {
+		query string
+		expected *Node
+	}{
+		{ "SELECT * FROM movies", scan },
+		{ "select Name, Id from movies;", &Node{ "PROJECTION", []interface{}{ "Name", "Id" }, scan } },
+		{ "SELECT * FROM movies WHERE Id = 1 AND 'Movie 2' <= Name",
+			&Node{ "SELECTION", map[string]interface{}{ "AND": []interface{}{
+				map[string]interface{}{ "EQ": []interface{}{ "Id", int64(1) } },
+				map[string]interface{}{ "GT_E": []interface{}{ "Name", "Movie 2" } },
+			} }, scan } },
+		{ "SELECT * FROM movies WHERE Id = 1 OR Id = 2 AND Year > 2000",
+			&Node{ "SELECTION", map[string]interface{}{ "OR": []interface{}{
+				map[string]interface{}{ "EQ": []interface{}{ "Id", int64(1) } },
+				map[string]interface{}{ "AND": []interface{}{
+					map[string]interface{}{ "EQ": []interface{}{ "Id", int64(2) } },
+					map[string]interface{}{ "GT": []interface{}{ "Year", int64(2000) } },
+				} },
+			} }, scan } },
+		{ "SELECT * FROM movies WHERE (Id = 1 OR Id = 2) AND NOT (Year > 2000 OR Year IS NULL)",
+			&Node{ "SELECTION", map[string]interface{}{ "AND": []interface{}{
+				map[string]interface{}{ "OR": []interface{}{
+					map[string]interface{}{ "EQ": []interface{}{ "Id", int64(1) } },
+					map[string]interface{}{ "EQ": []interface{}{ "Id", int64(2) } },
+				} },
+				map[string]interface{}{ "NOT": map[string]interface{}{ "OR": []interface{}{
+					map[string]interface{}{ "GT": []interface{}{ "Year", int64(2000) } },
+					map[string]interface{}{ "IS_NULL": []interface{}{ "Year" } },
+				} } },
+			} }, scan } },
+		{ "SELECT Name, COUNT(*) FROM movies GROUP BY Name ORDER BY COUNT(*), Name ASC LIMIT 2",
+			&Node{ "PROJECTION", []interface{}{ "Name", "Count" },
+				&Node{ "LIMIT", []interface{}{ "2" },
+					&Node{ "SORT", []interface{}{ "Count:ASC", "Name:ASC" },
+						&Node{ "AGGREGATE", map[string]interface{}{
+							"group": []interface{}{ "Name" },
+							"aggregates": []interface{}{ map[string]interface{}{ "function": "COUNT", "column": "*" } },
+						}, scan } } } } },
+		{ `SELECT COUNT(*) FROM "movies"`,
+			&Node{ "PROJECTION", []interface{}{ "Count" },
+				&Node{ "AGGREGATE", map[string]interface{}{
+					"group": []interface{}{},
+					"aggregates": []interface{}{ map[string]interface{}{ "function": "COUNT", "column": "*" } },
+				}, scan } } },
+		{ "SELECT * FROM movies WHERE Year IS NULL AND Name IS NOT NULL",
+			&Node{ "SELECTION", map[string]interface{}{ "AND": []interface{}{
+				map[string]interface{}{ "IS_NULL": []interface{}{ "Year" } },
+				map[string]interface{}{ "IS_NOT_NULL": []interface{}{ "Name" } },
+			} }, scan } },
+		{ "SELECT * FROM movies WHERE Id <> 1 AND Id IN (1, 2) AND Year NOT BETWEEN 2000 AND 2010 " +
+			"AND Name NOT LIKE 'M%' AND Name REGEXP '^a' AND Id NOT IN (3)",
+			&Node{ "SELECTION", map[string]interface{}{ "AND": []interface{}{
+				map[string]interface{}{ "NE": []interface{}{ "Id", int64(1) } },
+				map[string]interface{}{ "IN": []interface{}{ "Id", []interface{}{ int64(1), int64(2) } } },
+				map[string]interface{}{ "NOT": map[string]interface{}{
+					"BETWEEN": []interface{}{ "Year", int64(2000), int64(2010) } } },
+				map[string]interface{}{ "NOT": map[string]interface{}{ "LIKE": []interface{}{ "Name", "M%" } } },
+				map[string]interface{}{ "REGEXP": []interface{}{ "Name", "^a" } },
+				map[string]interface{}{ "NOT_IN": []interface{}{ "Id", []interface{}{ int64(3) } } },
+			} }, scan } },
+		{ "SELECT Name || ' (' || Year || ')' AS Title, EndYear - Year, COALESCE(Rating, 0) AS Rating " +
+			"FROM movies WHERE EndYear > Year AND (EndYear - Year) / 2 >= -1",
+			&Node{ "PROJECTION", []interface{}{
+				map[string]interface{}{ "as": "Title", "expression": map[string]interface{}{ "CONCAT": []interface{}{
+					map[string]interface{}{ "COLUMN": "Name" }, " (", map[string]interface{}{ "COLUMN": "Year" }, ")" } } },
+				map[string]interface{}{ "as": "EndYear - Year", "expression": map[string]interface{}{ "SUB": []interface{}{
+					map[string]interface{}{ "COLUMN": "EndYear" }, map[string]interface{}{ "COLUMN": "Year" } } } },
+				map[string]interface{}{ "as": "Rating", "expression": map[string]interface{}{ "COALESCE": []interface{}{
+					map[string]interface{}{ "COLUMN": "Rating" }, int64(0) } } },
+			}, &Node{ "SELECTION", map[string]interface{}{ "AND": []interface{}{
+				map[string]interface{}{ "GT": []interface{}{ "EndYear", map[string]interface{}{ "COLUMN": "Year" } } },
+				map[string]interface{}{ "GT_E": []interface{}{ map[string]interface{}{ "DIV": []interface{}{
+					map[string]interface{}{ "SUB": []interface{}{
+						map[string]interface{}{ "COLUMN": "EndYear" }, map[string]interface{}{ "COLUMN": "Year" } } },
+					int64(2) } }, int64(-1) } },
+			} }, scan } } },
+		{ "SELECT CASE WHEN Year < 2000 THEN 'old' ELSE 'new' END AS Age FROM movies",
+			&Node{ "PROJECTION", []interface{}{
+				map[string]interface{}{ "as": "Age", "expression": map[string]interface{}{ "CASE": map[string]interface{}{
+					"when": []interface{}{ map[string]interface{}{
+						"condition": map[string]interface{}{ "LT": []interface{}{ "Year", int64(2000) } }, "then": "old" } },
+					"else": "new" } } },
+			}, scan } },
+		{ "SELECT Name, SUM(Rating) / COUNT(*) AS Mean FROM movies GROUP BY Name",
+			&Node{ "PROJECTION", []interface{}{ "Name",
+				map[string]interface{}{ "as": "Mean", "expression": map[string]interface{}{ "DIV": []interface{}{
+					map[string]interface{}{ "COLUMN": "SUM(Rating)" }, map[string]interface{}{ "COLUMN": "Count" } } } },
+			}, &Node{ "AGGREGATE", map[string]interface{}{
+				"group": []interface{}{ "Name" },
+				"aggregates": []interface{}{
+					map[string]interface{}{ "function": "SUM", "column": "Rating" },
+					map[string]interface{}{ "function": "COUNT", "column": "*" },
+				},
+			}, scan } } },
+		{ "SELECT lower(Name), CAST(Year AS INT) FROM movies WHERE UPPER(Name) = 'A'",
+			&Node{ "PROJECTION", []interface{}{
+				map[string]interface{}{ "as": "LOWER(Name)", "expression": map[string]interface{}{
+					"CALL": []interface{}{ "LOWER", map[string]interface{}{ "COLUMN": "Name" } } } },
+				map[string]interface{}{ "as": "CAST(Year AS INT)", "expression": map[string]interface{}{
+					"CALL": []interface{}{ "CAST", map[string]interface{}{ "COLUMN": "Year" }, "INT" } } },
+			}, &Node{ "SELECTION", map[string]interface{}{ "EQ": []interface{}{
+				map[string]interface{}{ "CALL": []interface{}{ "UPPER", map[string]interface{}{ "COLUMN": "Name" } } },
+				"A" } }, scan } } },
+		{ "SELECT * FROM movies ORDER BY Year DESC, Name ASC NULLS LAST",
+			&Node{ "SORT", []interface{}{ "Year:DESC", "Name:ASC:NULLS_LAST" }, scan } },
+		{ "SELECT Year, COUNT(Name) FROM movies GROUP BY Year ORDER BY Year NULLS FIRST",
+			&Node{ "PROJECTION", []interface{}{ "Year", "COUNT(Name)" },
+				&Node{ "SORT", []interface{}{ "Year:ASC:NULLS_FIRST" },
+					&Node{ "AGGREGATE", map[string]interface{}{
+						"group": []interface{}{ "Year" },
+						"aggregates": []interface{}{ map[string]interface{}{ "function": "COUNT", "column": "Name" } },
+					}, scan } } } },
+		{ "SELECT Name, SUM(Rating) AS Total, COUNT(DISTINCT Year) FROM movies GROUP BY Name " +
+			"HAVING COUNT(*) > 1 AND Total >= 5.5 ORDER BY Total DESC",
+			&Node{ "PROJECTION", []interface{}{ "Name", "Total", "COUNT(DISTINCT Year)" },
+				&Node{ "SORT", []interface{}{ "Total:DESC" },
+					&Node{ "AGGREGATE", map[string]interface{}{
+						"group": []interface{}{ "Name" },
+						"aggregates": []interface{}{
+							map[string]interface{}{ "function": "SUM", "column": "Rating", "as": "Total" },
+							map[string]interface{}{ "function": "COUNT_DISTINCT", "column": "Year" },
+							map[string]interface{}{ "function": "COUNT", "column": "*" },
+						},
+						"having": map[string]interface{}{ "AND": []interface{}{
+							map[string]interface{}{ "GT": []interface{}{ "Count", int64(1) } },
+							map[string]interface{}{ "GT_E": []interface{}{ "Total", 5.5 } },
+						} },
+					}, scan } } } },
+	}
+	for _, c := range(cases) {
+		actual, err := parseSQL(c.query)
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.expected, actual.Head) {
+			t.Errorf("%s: Expected %v. Actual %v", c.query, c.expected, actual.Head)
+		}
+	}
+}
+
+func TestParseSQLErrors(t *testing.T) {
+	cases := []struct {
+		query string
+		message string
+	}{
+		{ "SELECT * FORM movies", `at position 10 near "FORM": expected FROM` },
+		{ "SELECT Name FROM movies WHERE Name", "at end of query: expected a comparison operator" },
+		{ "SELECT * FROM movies WHERE Id # 1", "at position 31: unexpected character '#'" },
+		{ "SELECT * FROM movies WHERE 1 = 2", `at position 28 near "1": expected a comparison with a column` },
+		{ "SELECT * FROM movies WHERE (Id = 1 OR Id = 3", "at end of query: expected )" },
+		{ "SELECT * FROM movies WHERE NOT", "at end of query: expected a column or a value" },
+		{ "SELECT * FROM movies WHERE (Id + 1 > 2", "at end of query: expected )" },
+		{ "SELECT CASE WHEN Id = 1 THEN 2 FROM movies", `at position 32 near "FROM": expected END` },
+		{ "SELECT Year + 1 FROM movies GROUP BY Name", "column Year must be in GROUP BY" },
+		{ "SELECT * FROM movies WHERE Id IN ()", `at position 35 near ")": expected a value` },
+		{ "SELECT * FROM movies WHERE Id BETWEEN 1 OR 2", `at position 41 near "OR": expected AND` },
+		{ "SELECT * FROM movies WHERE Name NOT REGEXP 'a'", `at position 37 near "REGEXP": expected IN, BETWEEN or LIKE` },
+		{ "SELECT * FROM movies WHERE Name REGEXP '('", "missing closing )" },
+		{ "SELECT * FROM movies LIMIT ten", `at position 28 near "ten": expected a number` },
+		{ "SELECT * FROM movies ORDER BY Name DESC NULLS", "at end of query: expected FIRST or LAST" },
+		{ "SELECT Name, COUNT(*) FROM movies GROUP BY Year", "column Name must be in GROUP BY" },
+		{ "SELECT Name FROM movies WHERE COUNT(*) > 1", `at position 25 near "WHERE": aggregates are not allowed` },
+		{ "SELECT FOO(Name) FROM movies", `at position 8 near "FOO": unknown function FOO` },
+		{ "SELECT UPPER() FROM movies", `at position 8 near "UPPER": UPPER does not take 0 arguments` },
+		{ "SELECT CAST(Id AS DECIMAL) FROM movies", `at position 19 near "DECIMAL": unknown type DECIMAL` },
+		{ "SELECT Name AS FROM movies", `at position 16 near "FROM": expected a column name` },
+		{ "SELECT SUM(*) FROM movies", `at position 12 near "*": expected a column name` },
+		{ "SELECT * FROM movies WHERE Name = 'Movie", "at position 35: unterminated '" },
+		{ "SELECT * FROM movies LIMIT 1 2", `at position 30 near "2": expected end of query` },
+	}
+	for _, c := range(cases) {
+		_, err := parseSQL(c.query)
+		if !errors.Is(err, ErrSyntax) || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: Expected %s. Actual %v", c.query, c.message, err)
+		}
+	}
+}
+
+func TestSQLQuery(t *testing.T) {
+	const dir = "db_sql_test"
+	records := make([]Record, 0)
+	for i := 1; i <= 5; i++ {
+		k := fmt.Sprintf("%d", i)
+		year := "2000"
+		if i % 2 == 0 { year = "2001" }
+		records = append(records, makeRecord(k, "Movie " + k, k, year))
+	}
+	writeMovies(t, dir, records)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		query string
+		expected []string
+	}{
+		{ "SELECT * FROM db_sql_test WHERE _key >= 2 AND Year = '2001'", []string{ "2", "4" } },
+		{ "SELECT * FROM db_sql_test WHERE Id = 1 OR Id = 5", []string{ "1", "5" } },
+		{ "SELECT * FROM db_sql_test ORDER BY Year LIMIT 3", []string{ "1", "3", "5" } },
+	}
+	for _, c := range(cases) {
+		a_t, err := parseSQL(c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		actual := queryKeys(t, a_t)
+		slices.Sort(actual)
+		if !slices.Equal(c.expected, actual) {
+			t.Errorf("%s: Expected %v. Actual %v", c.query, c.expected, actual)
+		}
+	}
+
+	a_t, _ := parseSQL("SELECT Year, COUNT(*) FROM db_sql_test GROUP BY Year ORDER BY Year")
+	it, err := transformToQueryTree(a_t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]string, 0)
+	for _, r := range(collectRecords(t, it)) {
+		actual = append(actual, r.values["Year"].String() + ":" + r.values["Count"].String())
+	}
+	if expected := []string{ "2000:3", "2001:2" }; !slices.Equal(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+}
@@ -2,23 +2,157 @@ package db
 
 import (
 	"os"
+	"path/filepath"
+	"errors"
 	"fmt"
-	"log"
 	"bytes"
 	"encoding/binary"
 	"io"
 	"strings"
 	"strconv"
+	"slices"
 )
 
 const default_storage_write_mode = os.O_CREATE | os.O_RDWR
 const permission = 0750
 const default_file_size uint32 = 1024
+const default_page_size uint32 = 1024
 const default_index_key_space_size = 3
+// "TDB" followed by the version of the file format
+const file_magic uint32 = 0x54444200
+// version 2 files tag the values of their rows with their type, see value.go.
+// Values of older files are strings.
+const file_version uint32 = 2
+const file_header_size uint32 = 20
+const legacy_file_header_size uint32 = 4
+
+// flags byte stored right after the length of every row
+const row_live byte = 0
+const row_deleted byte = 1
+
+/*
+StorageOptions controls the layout of the files of a table. They are persisted
+in the header of every data and index file, so a table is always read back with
+the options it was written with.
+
+page_size: rows never straddle a page boundary; a row that does not fit in the
+rest of the current page starts at the next one.
+max_file_size: size of each data_N and index_N file before rolling over.
+index_fan_out: order m of the B-tree loaded from the index file.
+wal_sync: when the write-ahead log is synced, it is not persisted.
+*/
+type StorageOptions struct {
+	page_size uint32
+	max_file_size uint32
+	index_fan_out int
+	wal_sync WalSyncPolicy
+}
+
+func defaultStorageOptions() *StorageOptions {
+	return &StorageOptions{ default_page_size, default_file_size,
+		default_index_key_space_size, WAL_SYNC_ALWAYS }
+}
+
+func initStorageOptions(page_size uint32, max_file_size uint32, index_fan_out int) *StorageOptions {
+	return &StorageOptions{ page_size, max_file_size, index_fan_out, WAL_SYNC_ALWAYS }
+}
+
+func (o *StorageOptions) validate() error {
+	if o.page_size == 0 || o.max_file_size <= file_header_size {
+		return fmt.Errorf("%w: page size %d, file size %d", ErrInvalidOptions,
+			o.page_size, o.max_file_size)
+	}
+	if o.index_fan_out < 3 {
+		return fmt.Errorf("%w: index fan out %d is below 3", ErrInvalidOptions,
+			o.index_fan_out)
+	}
+	return nil
+}
+
+/*
+File header:
+
+[ magic (3 bytes) + version (1 byte) ]
+[ page_size (4 bytes) ]
+[ max_file_size (4 bytes) ]
+[ index_fan_out (4 bytes) ]
+[ free space (4 bytes) ]
+
+Files written before the header existed only carry the free space and are read
+with the options given to the reader.
+*/
+type fileHeader struct {
+	version uint32
+	page_size uint32
+	max_file_size uint32
+	index_fan_out uint32
+	size uint32
+}
+
+func newFileHeader(opts *StorageOptions) *fileHeader {
+	return &fileHeader{ file_version, opts.page_size, opts.max_file_size,
+		uint32(opts.index_fan_out), file_header_size }
+}
+
+func readFileHeader(f *os.File, opts *StorageOptions) (*fileHeader, error) {
+	buf := make([]byte, file_header_size)
+	_, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	magic := binary.BigEndian.Uint32(buf[0:4])
+	if magic &^ 0xff != file_magic {
+		return &fileHeader{ 0, opts.max_file_size, opts.max_file_size,
+			uint32(opts.index_fan_out), legacy_file_header_size }, nil
+	}
+	h := &fileHeader{
+		magic & 0xff,
+		binary.BigEndian.Uint32(buf[4:8]),
+		binary.BigEndian.Uint32(buf[8:12]),
+		binary.BigEndian.Uint32(buf[12:16]),
+		file_header_size,
+	}
+	if h.page_size == 0 || h.max_file_size <= file_header_size || h.index_fan_out < 3 {
+		return nil, fmt.Errorf("%w: invalid header in %s", ErrCorruptFile, f.Name())
+	}
+	if h.version == 0 || h.version > file_version {
+		return nil, fmt.Errorf("%w: unsupported version %d of %s", ErrCorruptFile,
+			h.version, f.Name())
+	}
+	return h, nil
+}
+
+func (h *fileHeader) bytes(free_space uint32) []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range([]uint32{ file_magic | h.version, h.page_size, h.max_file_size,
+		h.index_fan_out, free_space }) {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// typed reports whether the values of the rows of the file are tagged with
+// their type.
+func (h *fileHeader) typed() bool {
+	return h.version >= 2
+}
+
+func (h *fileHeader) freeSpaceOffset() int64 {
+	return int64(h.size - 4)
+}
+
+// padding returns the number of bytes to skip so that n bytes written at offset
+// do not cross a page boundary.
+func (h *fileHeader) padding(offset uint32, n uint32) uint32 {
+	if n == 0 || offset / h.page_size == (offset + n - 1) / h.page_size {
+		return 0
+	}
+	return h.page_size - offset % h.page_size
+}
 
 type Column struct {
 	name string
-	col string
+	col Value
 }
 
 func (c Column) String() string {
@@ -31,29 +165,57 @@ type Data struct {
 	size uint32
 }
 
+// newData returns the row of key and cols. Its size is the length of the key,
+// the column names and the value payloads.
+func newData(key string, cols []Column) *Data {
+	size := len(key)
+	for _, c := range(cols) {
+		size += len(c.name) + len(c.col.payload())
+	}
+	return &Data{ key, cols, uint32(size) }
+}
+
 type Writer interface {
-	Write(data *Data) bool
-	WriteIndexFile(data *Data, free_space uint32) bool
-	Flush() bool
+	Write(data *Data) error
+	Update(data *Data) error
+	Delete(key string) error
+	Flush() error
 }
 
 type Reader interface {
-	Read(s string) *Data
-	Close() bool
+	Read(s string) (*Data, error)
+	Close() error
 }
 
 type StorageWriter struct {
-	file *os.File
-	index_file *os.File
-	index TreeNode
+	dir string
+	segments []*segment
 	use_index bool
+	opts *StorageOptions
+	wal *wal
+	// changes of the write in progress, applied together by commit
+	pending []walOp
+	// segment of each live key, loaded by the first write that looks a key up
+	keys map[string]*segment
 }
 
 type StorageReader struct {
+	segments []*segment
+	use_index bool
+}
+
+/*
+A segment is a single data_N file together with its index_N file. A table is
+made of one or more segments, listed in order in the manifest of its
+directory. Writes always go to the last segment.
+*/
+type segment struct {
+	file_number int
 	file *os.File
 	index_file *os.File
 	index TreeNode
-	use_index bool
+	index_size uint32
+	header *fileHeader
 }
 
 type DataIndex struct {
@@ -62,150 +224,351 @@ type DataIndex struct {
 	file_path string
 }
 
-func initStorageReader(dir string, file_number int, use_index bool) *StorageReader {
-	file_path := fmt.Sprintf("./%s/data_%d", dir, file_number)
+// initStorageReader opens every segment of the table in dir starting at
+// file_number. opts are only used for files written without a header; nil
+// means the default options.
+func initStorageReader(dir string, file_number int, use_index bool, opts *StorageOptions) (*StorageReader, error) {
+	if opts == nil {
+		opts = defaultStorageOptions()
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	// the log of an open writer is its own to replay, its writes are already in
+	// the files
+	if !isWalOpen(dir) {
+		if err := recoverWal(dir); err != nil {
+			return nil, err
+		}
+	}
+	file_numbers, err := readManifest(dir, file_number)
+	if err != nil {
+		return nil, err
+	}
+	r := &StorageReader{ make([]*segment, 0), use_index }
+	for _, n := range(file_numbers) {
+		if n < file_number { continue }
+		seg, err := openSegment(dir, n, opts)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.segments = append(r.segments, seg)
+	}
+	return r, nil
+}
+
+func openSegment(dir string, file_number int, opts *StorageOptions) (*segment, error) {
+	file_path := dataPath(dir, file_number)
 	f, err := os.Open(file_path)
 	if err != nil {
-		panic("Failed to create a storage reader")
+		return nil, err
 	}
-	index_file_path := fmt.Sprintf("./%s/index_%d", dir, file_number)
+	index_file_path := indexPath(dir, file_number)
 	index_f, err := os.Open(index_file_path)
 	if err != nil {
-		panic("Failed to read index file for creating storage reader")
+		f.Close()
+		return nil, err
+	}
+	seg := &segment{ file_number, f, index_f, nil, 0, nil }
+	if seg.header, err = readFileHeader(f, opts); err != nil {
+		seg.close()
+		return nil, err
+	}
+	if seg.index, err = readIndexFile(index_f, opts); err != nil {
+		seg.close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func dataPath(dir string, file_number int) string {
+	return filepath.Join(dir, fmt.Sprintf("data_%d", file_number))
+}
+
+func indexPath(dir string, file_number int) string {
+	return filepath.Join(dir, fmt.Sprintf("index_%d", file_number))
+}
+
+func findOffset(r TreeNode, k string) (int64, error) {
+	v, err := r.Find(k)
+	if err != nil {
+		return 0, err
 	}
-	root := readIndexFile(index_f)
-	return &StorageReader{ f, index_f, root, use_index }
+	return parseIndexValue(v)
 }
 
-func findOffset(r TreeNode, k string) string {
-	v, _ := r.Find(k)
-	// TODO: incorporate file name into reading
-	splits := strings.Split(v, "-")
-	return splits[1]
+// parseIndexValue returns the offset of an index value, which has the form
+// "<data file path>-<offset>".
+func parseIndexValue(v string) (int64, error) {
+	i := strings.LastIndex(v, "-")
+	o, err := strconv.Atoi(v[i+1:])
+	if err != nil {
+		return 0, fmt.Errorf("%w: index value %q", ErrCorruptFile, v)
+	}
+	return int64(o), nil
 }
 
-func (r *StorageReader) ReadRow(offset int64) (*Data, int64) {
+func readFreeSpace(f *os.File, h *fileHeader) (uint32, error) {
 	var free_space uint32 = 0
 	file_size := make([]byte, 4)
-	_, err := r.file.ReadAt(file_size, 0)
-	if err == io.EOF { return nil, offset }
+	_, err := f.ReadAt(file_size, h.freeSpaceOffset())
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	for i := 0; i < len(file_size); i++ {
 		free_space = free_space << 8
 		free_space |= uint32(file_size[i])
 	}
+	return free_space, nil
+}
 
-	occupied_sz := default_file_size - free_space
-	rd_offset := offset + 4
-	if rd_offset >= int64(occupied_sz) {
-		return nil, offset
+// ReadRow reads the row at offset in the first segment of the table.
+func (r *StorageReader) ReadRow(offset int64) (*Data, int64, error) {
+	if len(r.segments) == 0 { return nil, offset, nil }
+	return r.segments[0].readRow(offset)
+}
+
+// ReadSegmentRow reads the row at offset in the i-th segment of the table.
+func (r *StorageReader) ReadSegmentRow(i int, offset int64) (*Data, int64, error) {
+	if i >= len(r.segments) { return nil, offset, nil }
+	return r.segments[i].readRow(offset)
+}
+
+func (r *StorageReader) Segments() int {
+	return len(r.segments)
+}
+
+func (seg *segment) freeSpace() (uint32, error) {
+	return readFreeSpace(seg.file, seg.header)
+}
+
+// readRow reads the first live row at or after offset, relative to the end of
+// the file header. Zero bytes are padding left at the end of a page and
+// tombstoned rows are deleted ones; both are skipped.
+func (seg *segment) readRow(offset int64) (*Data, int64, error) {
+	for {
+		d, _, next, deleted, err := seg.readRowAt(offset)
+		if err != nil {
+			return nil, offset, err
+		}
+		if d == nil || !deleted {
+			return d, next, nil
+		}
+		offset = next
 	}
-	_, err = r.file.Seek(rd_offset, 0)
+}
+
+// readRowAt reads the row at or after offset whether it is deleted or not. It
+// returns the row, the offset it starts at, the offset of the next row and
+// whether the row is a tombstone. A nil row without an error means there are
+// no more rows.
+func (seg *segment) readRowAt(offset int64) (*Data, int64, int64, bool, error) {
+	free_space, err := seg.freeSpace()
+	if err == io.EOF { return nil, offset, offset, false, nil }
 	if err != nil {
-		log.Fatal(err)
+		return nil, offset, offset, false, err
 	}
+
+	occupied_sz := seg.header.max_file_size - free_space
+	var payload_size, p_n int
+	for payload_size == 0 {
+		rd_offset := offset + int64(seg.header.size)
+		if rd_offset >= int64(occupied_sz) {
+			return nil, offset, offset, false, nil
+		}
+		_, err = seg.file.Seek(rd_offset, 0)
+		if err != nil {
+			return nil, offset, offset, false, err
+		}
+		var varint_err error
+		payload_size, p_n, varint_err = parseVarInts(seg.file)
+		if varint_err == io.EOF {
+			return nil, offset, offset, false, nil
+		}
+		if varint_err != nil {
+			return nil, offset, offset, false, varint_err
+		}
+		if payload_size == 0 {
+			offset += int64(p_n)
+		}
+	}
+	start := offset
 	d := &Data{}
 	d.cols = make([]Column, 0)
-	payload_size, p_n, varint_err := parseVarInts(r.file)
 	offset += int64(payload_size) + int64(p_n)
-	if varint_err == io.EOF {
-		return nil, offset
+	flags := make([]byte, 1)
+	if _, err := seg.file.Read(flags); err != nil {
+		return nil, start, offset, false, corruptRow(seg, start, err)
 	}
-	key_size, k_n, varint_err := parseVarInts(r.file)
+	if flags[0] != row_live && flags[0] != row_deleted {
+		return nil, start, offset, false, corruptRow(seg, start, nil)
+	}
+	payload_size -= 1
+	deleted := flags[0] == row_deleted
+	key_size, k_n, varint_err := parseVarInts(seg.file)
 	payload_size -= k_n
-	if varint_err == io.EOF {
-		return nil, offset
+	if varint_err != nil {
+		return nil, start, offset, false, corruptRow(seg, start, varint_err)
 	}
-	key, string_err := parseString(r.file, key_size)
-	if string_err == io.EOF {
-		return nil, offset
+	key, string_err := parseString(seg.file, key_size)
+	if string_err != nil {
+		return nil, start, offset, false, corruptRow(seg, start, string_err)
 	}
 	max_cols_size := payload_size - key_size
 	current_cols_size := 0
 	d.row_key = key
+	d.size = uint32(key_size)
 	for current_cols_size < max_cols_size {
-		column_name_sz, cname_n, varint_err := parseVarInts(r.file)
+		column_name_sz, cname_n, varint_err := parseVarInts(seg.file)
 		payload_size -= cname_n
-		if varint_err == io.EOF { break }
-		column_name, string_err := parseString(r.file, column_name_sz)
-		if string_err == io.EOF { break }
+		if varint_err != nil {
+			return nil, start, offset, false, corruptRow(seg, start, varint_err)
+		}
+		column_name, string_err := parseString(seg.file, column_name_sz)
+		if string_err != nil {
+			return nil, start, offset, false, corruptRow(seg, start, string_err)
+		}
 
-		col_sz, c_n, varint_err := parseVarInts(r.file)
+		col_sz, c_n, varint_err := parseVarInts(seg.file)
 		payload_size -= c_n
-		if varint_err == io.EOF { break }
-		col_val, string_err := parseString(r.file, col_sz)
-		if string_err == io.EOF { break }
-		d.cols = append(d.cols, Column { column_name, col_val })
+		if varint_err != nil {
+			return nil, start, offset, false, corruptRow(seg, start, varint_err)
+		}
+		col_val, string_err := parseString(seg.file, col_sz)
+		if string_err != nil {
+			return nil, start, offset, false, corruptRow(seg, start, string_err)
+		}
+		value := StringValue(col_val)
+		if seg.header.typed() {
+			value, err = decodeValue([]byte(col_val))
+			if err != nil {
+				return nil, start, offset, false, fmt.Errorf("%w at offset %d of %s",
+					err, start, seg.file.Name())
+			}
+		}
+		d.cols = append(d.cols, Column { column_name, value })
+		d.size += uint32(len(column_name) + len(value.payload()))
 		current_cols_size += cname_n + len(column_name) + c_n + len(col_val)
 	}
-	d.size = uint32(payload_size)
-	return d, offset
+	return d, start, offset, deleted, nil
 }
 
+func corruptRow(seg *segment, start int64, err error) error {
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return fmt.Errorf("%w: truncated row at offset %d of %s", ErrCorruptFile,
+		start, seg.file.Name())
+}
+
+// Read looks up the row with key s in every segment of the table, in order.
+// It returns ErrKeyNotFound if there is no such row.
+func (r *StorageReader) Read(s string) (*Data, error) {
+	for _, seg := range(r.segments) {
+		var d *Data
+		var err error
+		if r.use_index && seg.index != nil {
+			d, err = seg.lookup(s)
+		} else {
+			_, d, err = seg.find(s)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, s)
+}
 
-func (r *StorageReader) Read(s string) *Data {
-	if r.index != nil {
-		offset := findOffset(r.index, s)
-		o, _ := strconv.Atoi(offset)
-		d, _ := r.ReadRow(int64(o - 4))
-		return d
+func (seg *segment) lookup(s string) (*Data, error) {
+	o, err := findOffset(seg.index, s)
+	if errors.Is(err, ErrCorruptFile) {
+		return nil, err
 	}
-	_, err := r.file.Seek(0, 0)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil
 	}
-	buf := make([]byte, 4)
-	_, err = r.file.Read(buf)
+	d, _, _, deleted, err := seg.readRowAt(o - int64(seg.header.size))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	var free_space uint32 = 0
-	for i := 0; i < len(buf); i++ {
-		free_space = free_space << 8
-		free_space |= uint32(buf[i])
+	if d == nil || deleted || d.row_key != s {
+		return nil, nil
 	}
-	max_size_to_read := default_file_size - free_space
-	var current_size uint32 = 4
-	d := &Data{}
-	d.cols = make([]Column, 0)
-	for current_size < max_size_to_read {
-		payload_size, p_n, varint_err := parseVarInts(r.file)
-		current_size += uint32(payload_size) + uint32(p_n)
-		if varint_err == io.EOF { break }
-		key_size, k_n, varint_err := parseVarInts(r.file)
-		if varint_err == io.EOF { break }
-		key, string_err := parseString(r.file, key_size)
-		if string_err == io.EOF { break }
-		if key == s {
-			max_cols_size := payload_size - (key_size + k_n)
-			payload_size -= k_n
-			current_cols_size := 0
-			d.row_key = key
-			for current_cols_size < max_cols_size {
-				column_name_sz, cname_n, varint_err := parseVarInts(r.file)
-				if varint_err == io.EOF { break }
-				col_name, string_err := parseString(r.file, column_name_sz)
-				if string_err == io.EOF { break }
-
-				col_size, c_n, varint_err := parseVarInts(r.file)
-				if varint_err == io.EOF { break }
-				col_val, string_err := parseString(r.file, col_size)
-				if string_err == io.EOF { break }
-				d.cols = append(d.cols, Column { col_name, col_val })
-				current_cols_size += cname_n + col_size + c_n + column_name_sz
-				payload_size = payload_size - cname_n - c_n
-			}
-			d.size = uint32(payload_size)
-		} else {
-			if _, err := r.file.Seek(int64(current_size), 0); err != nil {
-				log.Fatal(err)
+	return d, nil
+}
+
+// find returns the offset of the live row with key s, relative to the end of
+// the file header, by scanning the segment.
+func (seg *segment) find(s string) (int64, *Data, error) {
+	var offset int64 = 0
+	for {
+		d, start, next, deleted, err := seg.readRowAt(offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		if d == nil {
+			return 0, nil, nil
+		}
+		if !deleted && d.row_key == s {
+			return start, d, nil
+		}
+		offset = next
+	}
+}
+
+// rowPointer locates a row of the table through the index of its segment.
+type rowPointer struct {
+	key string
+	segment int
+	offset int64
+}
+
+// Range returns pointers to the rows with lo <= key < hi, in key order,
+// looked up in the index of every segment. Empty bounds are open.
+func (r *StorageReader) Range(lo string, hi string) ([]rowPointer, error) {
+	pointers := make([]rowPointer, 0)
+	for i, seg := range(r.segments) {
+		if seg.index == nil { continue }
+		for k, v := range seg.index.Range(lo, hi) {
+			o, err := parseIndexValue(v)
+			if err != nil {
+				return nil, err
 			}
+			pointers = append(pointers, rowPointer{ k, i, o - int64(seg.header.size) })
 		}
 	}
-	if d.size == 0 { return nil }
-	return d
+	slices.SortStableFunc(pointers, func(a, b rowPointer) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return pointers, nil
+}
+
+// ReadPointer reads the row p points to, or nil if it has since been deleted.
+func (r *StorageReader) ReadPointer(p rowPointer) (*Data, error) {
+	d, _, _, deleted, err := r.segments[p.segment].readRowAt(p.offset)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil || deleted || d.row_key != p.key {
+		return nil, nil
+	}
+	return d, nil
+}
+
+func (r *StorageReader) Close() error {
+	var errs []error
+	for _, seg := range(r.segments) {
+		errs = append(errs, seg.close())
+	}
+	return errors.Join(errs...)
+}
+
+func (seg *segment) close() error {
+	return errors.Join(seg.file.Close(), seg.index_file.Close())
 }
 
 func parseString(f *os.File, str_length int) (string, error) {
@@ -214,8 +577,8 @@ func parseString(f *os.File, str_length int) (string, error) {
 	for i := 0; i < str_length; i++ {
 		b := make([]byte, 1)
 		_, err = f.Read(b)
-		if err != nil && err != io.EOF {
-			log.Fatal(err)
+		if err != nil {
+			return string(result[:i]), err
 		}
 		result[i] = b[0]
 	}
@@ -244,40 +607,271 @@ func parseVarInts(f *os.File) (int, int, error) {
 
 
 
-func initStorageWriter(dir string, file_number int, use_index bool) *StorageWriter {
-	file_path := fmt.Sprintf("./%s/data_%d", dir, file_number)
-	f, err := os.OpenFile(file_path, default_storage_write_mode, permission)
+// initStorageWriter creates a new table in dir whose first segment is
+// file_number. nil opts means the default options.
+func initStorageWriter(dir string, file_number int, use_index bool, opts *StorageOptions) (*StorageWriter, error) {
+	if opts == nil {
+		opts = defaultStorageOptions()
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	// replay what a crashed writer left so it is not replayed over the new table
+	if err := recoverWal(dir); err != nil {
+		return nil, err
+	}
+	w, err := openWal(dir, opts.wal_sync)
 	if err != nil {
-		panic("Failed to create a storage writer")
+		return nil, err
 	}
-	buf := new(bytes.Buffer)
-	fsize := default_file_size - 4
-	err = binary.Write(buf, binary.BigEndian, fsize)
+	s := &StorageWriter{ dir, []*segment{}, use_index, opts, w, nil, map[string]*segment{} }
+	seg, err := s.createSegment(file_number)
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+	s.segments = append(s.segments, seg)
+	s.writeManifest()
+	if err := s.commit(); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStorageWriter reopens the table in dir to write to it, after recovering
+// from the write-ahead log. A table is created if there is none in dir yet.
+func openStorageWriter(dir string, use_index bool, opts *StorageOptions) (*StorageWriter, error) {
+	if opts == nil {
+		opts = defaultStorageOptions()
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(manifestPath(dir)); os.IsNotExist(err) {
+		return initStorageWriter(dir, 0, use_index, opts)
+	}
+	if err := recoverWal(dir); err != nil {
+		return nil, err
+	}
+	file_numbers, err := readManifest(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openWal(dir, opts.wal_sync)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	_, err = f.Write(buf.Bytes())
+	s := &StorageWriter{ dir, []*segment{}, use_index, opts, w, nil, nil }
+	for _, n := range(file_numbers) {
+		seg, err := openSegmentForWrite(dir, n, opts)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	return s, nil
+}
+
+func openSegmentForWrite(dir string, file_number int, opts *StorageOptions) (*segment, error) {
+	f, err := os.OpenFile(dataPath(dir, file_number), os.O_RDWR, permission)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	err = f.Truncate(int64(default_file_size))
+	index_file, err := os.OpenFile(indexPath(dir, file_number), os.O_RDWR, permission)
 	if err != nil {
-		log.Fatal(err)
+		f.Close()
+		return nil, err
+	}
+	seg := &segment{ file_number, f, index_file, nil, 0, nil }
+	if seg.header, err = readFileHeader(f, opts); err != nil {
+		seg.close()
+		return nil, err
 	}
-	index_file_name := fmt.Sprintf("./%s/index_%d", dir, file_number)
+	index_free_space, err := readFreeSpace(index_file, seg.header)
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	seg.index_size = seg.header.max_file_size - index_free_space - seg.header.size
+	return seg, nil
+}
+
+func (s *StorageWriter) createSegment(file_number int) (*segment, error) {
+	header := newFileHeader(s.opts)
+	header_bytes := header.bytes(s.opts.max_file_size - header.size)
+	file_path := dataPath(s.dir, file_number)
+	f, err := os.OpenFile(file_path, default_storage_write_mode, permission)
+	if err != nil {
+		return nil, err
+	}
+	s.initFile(f.Name(), header_bytes, s.opts.max_file_size)
+	index_file_name := indexPath(s.dir, file_number)
 	index_file, err := os.OpenFile(index_file_name, default_storage_write_mode, permission)
 	if err != nil {
-		panic("Failed to read index file")
+		f.Close()
+		return nil, err
+	}
+	s.initFile(index_file.Name(), header_bytes, s.opts.max_file_size)
+	return &segment{ file_number, f, index_file, nil, 0, header }, nil
+}
+
+func (s *StorageWriter) initFile(path string, header []byte, size uint32) {
+	// drop whatever a previous table left behind so padding reads back as zeros
+	s.truncateAt(path, 0)
+	s.writeAt(path, header, 0)
+	s.truncateAt(path, int64(size))
+}
+
+func (s *StorageWriter) writeAt(path string, data []byte, offset int64) {
+	s.pending = append(s.pending, walOp{ wal_op_write, path, offset, data })
+}
+
+func (s *StorageWriter) truncateAt(path string, size int64) {
+	s.pending = append(s.pending, walOp{ wal_op_truncate, path, size, nil })
+}
+
+// commit logs the pending changes as a single entry of the write-ahead log and
+// then applies them to the files of the table, checkpointing once the log has
+// grown past wal_checkpoint_files data files.
+// Once an entry is logged, the changes survive a failure to apply them: the
+// log is replayed the next time the table is opened.
+func (s *StorageWriter) commit() (err error) {
+	// the keys may now point to rows that were not written
+	defer func() { if err != nil { s.keys = nil } }()
+	if len(s.pending) == 0 { return nil }
+	ops := s.pending
+	s.pending = nil
+	if err := s.wal.append(ops); err != nil {
+		return err
+	}
+	for _, op := range(ops) {
+		f, err := s.fileFor(op.path)
+		if err != nil {
+			return err
+		}
+		err = applyWalOp(f, op)
+		if !s.isSegmentFile(f) {
+			f.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s.wal.size > wal_checkpoint_files * int64(s.opts.max_file_size) {
+		return s.checkpoint()
+	}
+	return nil
+}
+
+func (s *StorageWriter) fileFor(path string) (*os.File, error) {
+	for _, seg := range(s.segments) {
+		if seg.file.Name() == path { return seg.file, nil }
+		if seg.index_file.Name() == path { return seg.index_file, nil }
+	}
+	return os.OpenFile(path, default_storage_write_mode, permission)
+}
+
+func (s *StorageWriter) isSegmentFile(f *os.File) bool {
+	for _, seg := range(s.segments) {
+		if seg.file == f || seg.index_file == f { return true }
+	}
+	return false
+}
+
+// checkpoint syncs every file of the table and empties the write-ahead log.
+func (s *StorageWriter) checkpoint() error {
+	for _, seg := range(s.segments) {
+		if err := seg.sync(); err != nil {
+			return err
+		}
+	}
+	if err := syncPath(manifestPath(s.dir)); err != nil {
+		return err
+	}
+	return s.wal.checkpoint()
+}
+
+func syncPath(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, permission)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	_, err = index_file.Write(buf.Bytes())
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	err = index_file.Truncate(int64(default_file_size))
+	defer f.Close()
+	return f.Sync()
+}
+
+/*
+Manifest file format:
+
+[ len(file_number) ]
+[ file_number ]
+[ ... ]
+
+One entry per segment of the table, in the order they were created.
+*/
+func manifestPath(dir string) string {
+	return filepath.Join(dir, "manifest")
+}
+
+func (s *StorageWriter) writeManifest() {
+	output := make([]byte, 0)
+	for _, seg := range(s.segments) {
+		output = append(output, ToBytesForString(strconv.Itoa(seg.file_number))...)
+	}
+	s.truncateAt(manifestPath(s.dir), 0)
+	s.writeAt(manifestPath(s.dir), output, 0)
+}
+
+// readManifest returns the segments of the table in dir. Tables written
+// before the manifest existed are made of the single data file file_number.
+func readManifest(dir string, file_number int) ([]int, error) {
+	f, err := os.Open(manifestPath(dir))
+	if os.IsNotExist(err) {
+		return []int{ file_number }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file_numbers := make([]int, 0)
+	for {
+		sz, _, varint_err := parseVarInts(f)
+		if varint_err == io.EOF { break }
+		v, string_err := parseString(f, sz)
+		if string_err == io.EOF { break }
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: manifest entry %q", ErrCorruptFile, v)
+		}
+		file_numbers = append(file_numbers, n)
+	}
+	return file_numbers, nil
+}
+
+func (s *StorageWriter) current() *segment {
+	return s.segments[len(s.segments) - 1]
+}
+
+// rollover syncs the current segment and starts writing to the next
+// data_{N+1}/index_{N+1} pair. Earlier segments stay open so their rows can
+// still be deleted.
+func (s *StorageWriter) rollover() error {
+	seg := s.current()
+	next, err := s.createSegment(seg.file_number + 1)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	return &StorageWriter{ f, index_file, nil, use_index }
+	s.segments = append(s.segments, next)
+	s.writeManifest()
+	if err := s.commit(); err != nil {
+		return err
+	}
+	return s.checkpoint()
 }
 
 func ToVarInts [T ~uint32| ~uint64 | ~int32 | ~int64 | ~int] (i T) []byte {
@@ -299,141 +893,389 @@ func ToVarInts [T ~uint32| ~uint64 | ~int32 | ~int64 | ~int] (i T) []byte {
 /**
 Data file_format:
 
-file_offset = file_size - current file size
+file_offset = max_file_size - free space
 
-[ current file size (4 bytes) ]
+[ file header (20 bytes) ]
 [ len(record) ]
+[ flags (1 byte): 0 live, 1 deleted ]
 [ len(key) ]
 [ key ]
 [ len(column) ]
 [ column ]
 [ ....]
+[ zero padding up to the page boundary ]
+[ len(record) ]
+[ ....]
 
 index file format:
 
-[ current_file_size ]
-[ len(min_key) ]
-[ min_key ]
-[ len(max_key) ]
-[ max_key ]
-[ len(file_name) ]
-[ file_name ]
+[ file header (20 bytes) ]
+[ len(key,file_name-offset) ]
+[ key,file_name-offset ]
+[ ....]
 
 
 **/
-func (s *StorageWriter) Write(p *Data) bool {
+func (s *StorageWriter) Write(p *Data) error {
 	/*
 	1. (Advanced) Read the index file -> binary search based on the key. This will return a
 	set of files for overlapping ranges. Choose first one that fits
 	2. Read the size of the file -> no more size, go to next until we have to
 	create a new file
 	3. Write the row record into the last offset.
-	4. Return true if the file accepts the writes
+	4. Return ErrNoSpace if the row does not fit even in an empty file
+
+	Writing a key that is already in the table updates its row instead.
 	*/
-	var fsize uint32 = 0
-	file_size := make([]byte, 4)
-	_, err := s.file.ReadAt(file_size, 0)
-	if err == io.EOF { return false }
+	_, _, ok, err := s.locate(p.row_key)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	for i := 0; i < len(file_size); i++ {
-		fsize = fsize << 8
-		fsize |= uint32(file_size[i])
+	if ok {
+		return s.Update(p)
 	}
-	if p.size > fsize {
-		fmt.Printf("Data size is %d compared to available size %d", p.size, fsize)
-		return false
+	if err := s.append(p); err != nil {
+		s.abort()
+		return err
 	}
-	offset := default_file_size - fsize
-	data := ToBytes(p)
-	_, err = s.file.WriteAt(data, int64(offset))
+	return s.commit()
+}
+
+// append writes the row at the end of the current segment, rolling over to a
+// new segment when it does not fit.
+func (s *StorageWriter) append(p *Data) error {
+	data := ToBytes(p, s.current().header.typed())
+	fsize, err := s.current().freeSpace()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	buf := new(bytes.Buffer)
-	new_file_size := fsize - uint32(len(data))
-	err = binary.Write(buf, binary.BigEndian, new_file_size)
-	_, err = s.file.WriteAt(buf.Bytes(), 0)
-	if err != nil {
-		log.Fatal(err)
+	offset, ok := s.reserve(p, data, fsize)
+	if !ok {
+		if s.current().isEmpty(fsize) {
+			return fmt.Errorf("%w: row %s of %d bytes, %d bytes available", ErrNoSpace,
+				p.row_key, len(data), fsize)
+		}
+		if err := s.rollover(); err != nil {
+			return err
+		}
+		fsize, err = s.current().freeSpace()
+		if err != nil {
+			return err
+		}
+		offset, ok = s.reserve(p, data, fsize)
+		if !ok {
+			return fmt.Errorf("%w: row %s of %d bytes, %d bytes available", ErrNoSpace,
+				p.row_key, len(data), fsize)
+		}
 	}
+	seg := s.current()
+	padding := offset - (seg.header.max_file_size - fsize)
+	s.writeAt(seg.file.Name(), append(make([]byte, padding), data...),
+		int64(offset - padding))
+	buf := new(bytes.Buffer)
+	new_file_size := fsize - padding - uint32(len(data))
+	binary.Write(buf, binary.BigEndian, new_file_size)
+	s.writeAt(seg.file.Name(), buf.Bytes(), seg.header.freeSpaceOffset())
 	
 	if s.use_index {
-		index_written := s.writeIndexFile(p, offset)
-		return index_written
+		if err := s.writeIndexFile(p, offset); err != nil {
+			return err
+		}
+	}
+	if s.keys != nil {
+		s.keys[p.row_key] = seg
 	}
-	return true
+	return nil
 }
 
-func (s *StorageWriter) writeIndexFile(p *Data, offset uint32) bool {
-	if s.index == nil {
-		s.index = readIndexFile(s.index_file)
+// reserve returns the offset the encoded row would be written at in the
+// current segment, once padded to the next page if needed, and whether the row
+// and its index entry still fit in the segment.
+func (s *StorageWriter) reserve(p *Data, data []byte, fsize uint32) (uint32, bool) {
+	seg := s.current()
+	h := seg.header
+	if uint32(len(data)) > h.page_size {
+		return 0, false
+	}
+	offset := h.max_file_size - fsize
+	padding := h.padding(offset, uint32(len(data)))
+	if padding + uint32(len(data)) > fsize {
+		return 0, false
+	}
+	offset += padding
+	if !s.use_index {
+		return offset, true
 	}
-	s.index.Insert(p.row_key, fmt.Sprintf("%s-%d", s.file.Name(), offset))
-	s.index_file.Seek(4, io.SeekStart)
+	record := indexRecordBytes(p.row_key, indexValue(seg, offset))
+	return offset, seg.index_size + uint32(len(record)) + h.size <= h.max_file_size
+}
+
+func (seg *segment) isEmpty(fsize uint32) bool {
+	return fsize == seg.header.max_file_size - seg.header.size
+}
+
+func indexValue(seg *segment, offset uint32) string {
+	return fmt.Sprintf("%s-%d", seg.file.Name(), offset)
+}
+
+func indexRecordBytes(k string, v string) []byte {
+	return ToBytesForString(fmt.Sprintf("%s,%s", k, v))
+}
+
+func (s *StorageWriter) writeIndexFile(p *Data, offset uint32) error {
+	seg := s.current()
+	index, err := s.loadIndex(seg)
+	if err != nil {
+		return err
+	}
+	index.Insert(p.row_key, indexValue(seg, offset))
+	return s.writeIndex(seg)
+}
+
+func (s *StorageWriter) loadIndex(seg *segment) (TreeNode, error) {
+	if seg.index == nil {
+		index, err := readIndexFile(seg.index_file, s.opts)
+		if err != nil {
+			return nil, err
+		}
+		seg.index = index
+	}
+	return seg.index, nil
+}
+
+// writeIndex rewrites the whole index file from the in-memory B-tree.
+func (s *StorageWriter) writeIndex(seg *segment) error {
+	buf := new(bytes.Buffer)
 	var sz uint32 = 0
-	for n := range s.index.All() {
+	for n := range seg.index.All() {
 		for _, record := range n.GetIndexRecord() {
-			sz += writeSingleIndexRecord(s, record, sz)
+			n, err := writeSingleIndexRecord(seg, buf, record, sz)
+			if err != nil {
+				return err
+			}
+			sz += n
 		}
 	}
-	index_free_space := default_file_size - (sz + 4)
+	s.writeAt(seg.index_file.Name(), buf.Bytes(), int64(seg.header.size))
+	seg.index_size = sz
+	index_free_space := seg.header.max_file_size - (sz + seg.header.size)
 	index_buf := new(bytes.Buffer)
-	err := binary.Write(index_buf, binary.BigEndian, index_free_space)
-	_, err = s.index_file.WriteAt(index_buf.Bytes(), 0)
+	binary.Write(index_buf, binary.BigEndian, index_free_space)
+	s.writeAt(seg.index_file.Name(), index_buf.Bytes(), seg.header.freeSpaceOffset())
+	return nil
+}
+
+/*
+Update replaces the row with the same key. The new row is written over the old
+one when its encoding fits in the space of the old row, the rest of which is
+zero-padded. Otherwise the old row is tombstoned, the new one is appended to
+the current segment and the index entry points to it. Returns ErrKeyNotFound
+if there is no such row.
+*/
+func (s *StorageWriter) Update(p *Data) error {
+	if err := s.update(p); err != nil {
+		s.abort()
+		return err
+	}
+	return s.commit()
+}
+
+func (s *StorageWriter) update(p *Data) error {
+	seg, start, ok, err := s.locate(p.row_key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, p.row_key)
+	}
+	_, _, next, _, err := seg.readRowAt(start)
+	if err != nil {
+		return err
+	}
+	data := ToBytes(p, seg.header.typed())
+	slot := next - start
+	if int64(len(data)) <= slot {
+		padded := append(data, make([]byte, slot - int64(len(data)))...)
+		s.writeAt(seg.file.Name(), padded, start + int64(seg.header.size))
+		return nil
+	}
+	if err := s.append(p); err != nil {
+		return err
+	}
+	if err := s.markDeleted(seg, start); err != nil {
+		return err
+	}
+	if s.use_index && seg != s.current() {
+		return s.deleteIndexEntry(seg, p.row_key)
+	}
+	return nil
+}
+
+/*
+Delete tombstones the row with the given key by flipping the flags byte of
+the row in place, and removes the key from the index of its segment. The
+space of the row is not reclaimed. Returns ErrKeyNotFound if there is no such
+row.
+*/
+func (s *StorageWriter) Delete(key string) error {
+	seg, start, ok, err := s.locate(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	err = s.markDeleted(seg, start)
+	if err == nil && s.use_index {
+		err = s.deleteIndexEntry(seg, key)
+	}
+	if err != nil {
+		s.abort()
+		return err
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	delete(s.keys, key)
+	return nil
+}
+
+func (s *StorageWriter) deleteIndexEntry(seg *segment, key string) error {
+	index, err := s.loadIndex(seg)
+	if err != nil {
+		return err
+	}
+	index.Delete(key)
+	return s.writeIndex(seg)
+}
+
+// locate returns the segment and the offset, relative to the end of the file
+// header, of the live row with the given key. Only the segment the keys map
+// the key to is read, so a write does not search every segment.
+func (s *StorageWriter) locate(key string) (*segment, int64, bool, error) {
+	if err := s.loadKeys(); err != nil {
+		return nil, 0, false, err
+	}
+	seg, ok := s.keys[key]
+	if !ok {
+		return nil, 0, false, nil
+	}
+	if s.use_index {
+		index, err := s.loadIndex(seg)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		o, err := findOffset(index, key)
+		if errors.Is(err, ErrCorruptFile) {
+			return nil, 0, false, err
+		}
+		if err != nil {
+			return nil, 0, false, nil
+		}
+		start := o - int64(seg.header.size)
+		d, _, _, deleted, err := seg.readRowAt(start)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if d != nil && !deleted && d.row_key == key {
+			return seg, start, true, nil
+		}
+		return nil, 0, false, nil
+	}
+	start, d, err := seg.find(key)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, false, err
+	}
+	return seg, start, d != nil, nil
+}
+
+// loadKeys reads the live rows of every segment into the keys map, unless it
+// is already loaded.
+func (s *StorageWriter) loadKeys() error {
+	if s.keys != nil {
+		return nil
+	}
+	keys := make(map[string]*segment)
+	for _, seg := range(s.segments) {
+		for offset := int64(0); ; {
+			d, _, next, deleted, err := seg.readRowAt(offset)
+			if err != nil {
+				return err
+			}
+			if d == nil { break }
+			if !deleted {
+				keys[d.row_key] = seg
+			}
+			offset = next
+		}
 	}
-	s.index_file.Seek(0, io.SeekStart)
-	return true
+	s.keys = keys
+	return nil
+}
+
+// abort drops the changes of a failed write.
+func (s *StorageWriter) abort() {
+	s.pending = nil
+	s.keys = nil
 }
 
-func writeSingleIndexRecord(s *StorageWriter, record *IndexRecord,
-	sz uint32) uint32 {
-	data := ToBytesForString(fmt.Sprintf("%s,%s", (*record).k, (*record).v))
-	if (sz + uint32(len(data))) > default_file_size {
-		log.Fatal("No more space for index file")
+func (s *StorageWriter) markDeleted(seg *segment, start int64) error {
+	pos := start + int64(seg.header.size)
+	if _, err := seg.file.Seek(pos, io.SeekStart); err != nil {
+		return err
 	}
-	_, err := s.index_file.Write(data)
+	_, p_n, err := parseVarInts(seg.file)
 	if err != nil {
-			log.Fatal(err)
+		return err
 	}
-	return uint32(len(data))
+	s.writeAt(seg.file.Name(), []byte{ row_deleted }, pos + int64(p_n))
+	return nil
 }
 
-func readIndexFile(index_file *os.File) TreeNode {
-	_, err := index_file.Seek(0, 0)
+func writeSingleIndexRecord(seg *segment, buf *bytes.Buffer, record *IndexRecord,
+	sz uint32) (uint32, error) {
+	data := indexRecordBytes((*record).k, (*record).v)
+	if (sz + uint32(len(data)) + seg.header.size) > seg.header.max_file_size {
+		return 0, fmt.Errorf("%w: index file %s is full", ErrNoSpace, seg.index_file.Name())
+	}
+	buf.Write(data)
+	return uint32(len(data)), nil
+}
+
+func readIndexFile(index_file *os.File, opts *StorageOptions) (TreeNode, error) {
+	header, err := readFileHeader(index_file, opts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	buf := make([]byte, 4)
-	_, err = index_file.Read(buf)
+	free_space, err := readFreeSpace(index_file, header)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	var free_space uint32 = 0
-	for i := 0; i < len(buf); i++ {
-		free_space = free_space << 8
-		free_space |= uint32(buf[i])
+	_, err = index_file.Seek(int64(header.size), 0)
+	if err != nil {
+		return nil, err
 	}
-	max_size_to_read := int(default_file_size - free_space - 4)
+	max_size_to_read := int(header.max_file_size - free_space - header.size)
 	current_size := 0
-	root := newRootNode(default_index_key_space_size)
+	root := newRootNode(int(header.index_fan_out))
 	for current_size < max_size_to_read {
 		payload_size, p_n, varint_err := parseVarInts(index_file)
 		if varint_err == io.EOF { break }
 		value, string_err := parseString(index_file, payload_size)
 		if string_err == io.EOF { break }
 		current_size += payload_size + p_n
-		splits := strings.Split(value, ",")
+		splits := strings.SplitN(value, ",", 2)
+		if len(splits) != 2 {
+			return nil, fmt.Errorf("%w: index record %q in %s", ErrCorruptFile,
+				value, index_file.Name())
+		}
 		root.Insert(splits[0], splits[1])
 	}
 	_, err = index_file.Seek(0, 0)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return root
+	return root, nil
 }
 
 func ToBytesForString(p string) []byte {
@@ -446,51 +1288,60 @@ func ToBytesForString(p string) []byte {
 	return output
 }
 
-func ToBytes(p *Data) []byte {
+// ToBytes encodes the row p. Values are tagged with their type when typed,
+// otherwise written as strings and NULL columns are left out.
+func ToBytes(p *Data, typed bool) []byte {
 	output := make([]byte, 0)
-	key_size := len((*p).row_key)
-	payload_sz := (*p).size
-	key_length := ToVarInts(key_size)
-	payload_sz += uint32(len(key_length))
-	output = append(output, key_length...)
-	for i := 0; i < key_size; i++{
-		output = append(output, byte((*p).row_key[i]))
-	}
+	output = append(output, row_live)
+	output = append(output, ToBytesForString((*p).row_key)...)
 	for _,v := range p.cols {
-		name := v.name
-		name_sz := ToVarInts(len(name))
-		payload_sz += uint32(len(name_sz))
-		output = append(output, name_sz...)
-		for _, c := range name {
-			output = append(output, byte(c))
+		if !typed && v.col.IsNull() {
+			continue
 		}
-
-		col := v.col
-		col_sz := ToVarInts(len(col))
-		output = append(output, col_sz...)
-		payload_sz += uint32(len(col_sz))
-		for _, c := range col {
-			output = append(output, byte(c))
+		output = append(output, ToBytesForString(v.name)...)
+		col := []byte(v.col.String())
+		if typed {
+			col = v.col.encode()
 		}
+		output = append(output, ToVarInts(len(col))...)
+		output = append(output, col...)
 	}
-	payload_length := ToVarInts(payload_sz)
+	payload_length := ToVarInts(uint32(len(output)))
 	return append(payload_length, output...)
 }
 
-func (s *StorageWriter) Flush() {
+func (s *StorageWriter) Flush() error {
 	// flush any pending writes
-	defer func() {
-		if err := s.file.Close(); err != nil {
-			log.Fatal(err)
-		}
-		if err := s.index_file.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	if err := s.file.Sync(); err != nil {
-		log.Fatal(err)
+	err := s.commit()
+	if err == nil {
+		err = s.checkpoint()
+	}
+	return errors.Join(err, s.close())
+}
+
+// close closes the files of the table without syncing them.
+func (s *StorageWriter) close() error {
+	var errs []error
+	for _, seg := range(s.segments) {
+		errs = append(errs, seg.flush())
+	}
+	errs = append(errs, s.wal.close())
+	return errors.Join(errs...)
+}
+
+func (seg *segment) sync() error {
+	if err := seg.file.Sync(); err != nil {
+		return err
 	}
-	if err := s.index_file.Sync(); err != nil {
-		log.Fatal(err)
+	return seg.index_file.Sync()
+}
+
+func (seg *segment) flush() error {
+	var errs []error
+	for _, f := range([]*os.File{ seg.file, seg.index_file }) {
+		if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
 }
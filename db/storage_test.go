@@ -3,6 +3,7 @@ package db
 import (
 	"testing"
 	"fmt"
+	"errors"
 	"log"
 	"reflect"
 	"os"
@@ -45,23 +46,22 @@ func generateRandomData(st_size int, cols_length int) *Data {
 		for i := range col {
 			col[i] = letters[rand.Intn(len(letters))]
 		}
-		cols[j] = Column { string(col), string(col) }
+		cols[j] = Column { string(col), StringValue(string(col)) }
 	}
 	return &Data{ key, cols, uint32(st_size + st_size * cols_length * 2) }
 }
 
 func TestWrite(t *testing.T) {
 	file_number := 0
-	wr := initStorageWriter(dir, file_number, true)
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
 	expected_data := generateRandomData(2, 2)
-	succeeded := wr.Write(expected_data)
-	if !succeeded {
+	if err := wr.Write(expected_data); err != nil {
 		t.Errorf("Failed to write data")
 	}
 	wr.Flush()
 
-	r := initStorageReader(dir, file_number, true)
-	actual_data, _ := r.ReadRow(0)
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	actual_data, _, _ := r.ReadRow(0)
 	if !reflect.DeepEqual(expected_data, actual_data) {
 		t.Errorf("Expected %v. Actual %v", expected_data, actual_data)
 	}
@@ -69,22 +69,20 @@ func TestWrite(t *testing.T) {
 
 func TestWriteMultipleRecordsReadSingleRecord(t *testing.T) {
 	file_number := 0
-	wr := initStorageWriter(dir, file_number, true)
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
 	d1 := generateRandomData(2, 2)
 	d2 := generateRandomData(2, 2)
-	succeeded := wr.Write(d1)
-	if !succeeded {
+	if err := wr.Write(d1); err != nil {
 		t.Errorf("Failed to write data")
 	}
-	succeeded = wr.Write(d2)
-	if !succeeded {
+	if err := wr.Write(d2); err != nil {
 		t.Errorf("Failed to write data")
 	}
 
 	wr.Flush()
 
-	r := initStorageReader(dir, file_number, true)
-	actual_data := r.Read(d1.row_key)
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	actual_data, _ := r.Read(d1.row_key)
 	if !reflect.DeepEqual(d1, actual_data) {
 		t.Errorf("Expected %v. Actual %v", d1, actual_data)
 	}
@@ -92,29 +90,325 @@ func TestWriteMultipleRecordsReadSingleRecord(t *testing.T) {
 
 func TestWriteMultipleRecordsReadRows(t *testing.T) {
 	file_number := 0
-	wr := initStorageWriter(dir, file_number, true)
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
 	d1 := generateRandomData(2, 2)
 	d2 := generateRandomData(2, 2)
-	succeeded := wr.Write(d1)
-	if !succeeded {
+	if err := wr.Write(d1); err != nil {
 		t.Errorf("Failed to write data")
 	}
-	succeeded = wr.Write(d2)
-	if !succeeded {
+	if err := wr.Write(d2); err != nil {
 		t.Errorf("Failed to write data")
 	}
 
 	wr.Flush()
 
-	r := initStorageReader(dir, file_number, true)
-	r1, offset_1 := r.ReadRow(0)
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	r1, offset_1, _ := r.ReadRow(0)
 	if !reflect.DeepEqual(d1, r1) {
 		t.Errorf("Expected %v. Actual %v", d1, r1)
 	}
 
-	r2, _ := r.ReadRow(offset_1)
+	r2, _, _ := r.ReadRow(offset_1)
 	if !reflect.DeepEqual(d2, r2) {
 		t.Errorf("Expected %v. Actual %v", d2, r2)
 	}
 }
 
+func generateKeyedData(key string, cols_length int) *Data {
+	d := generateRandomData(len(key), cols_length)
+	d.row_key = key
+	return d
+}
+
+func TestWriteSpillsToNewSegment(t *testing.T) {
+	file_number := 0
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
+	records := make([]*Data, 0)
+	for i := 0; i < 100; i++ {
+		d := generateKeyedData(fmt.Sprintf("%03d", i), 2)
+		if err := wr.Write(d); err != nil {
+			t.Fatalf("Failed to write data %d", i)
+		}
+		records = append(records, d)
+	}
+	wr.Flush()
+
+	segments, _ := readManifest(dir, file_number)
+	if len(segments) < 2 {
+		t.Errorf("Expected more than 1 segment. Actual %v", segments)
+	}
+
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	for _, expected := range(records) {
+		actual, _ := r.Read(expected.row_key)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected %v. Actual %v", expected, actual)
+		}
+	}
+
+	unindexed, _ := initStorageReader(dir, file_number, false, nil)
+	defer unindexed.Close()
+	last := records[len(records) - 1]
+	if actual, _ := unindexed.Read(last.row_key); !reflect.DeepEqual(last, actual) {
+		t.Errorf("Expected %v. Actual %v", last, actual)
+	}
+}
+
+func TestWriteWithStorageOptions(t *testing.T) {
+	file_number := 0
+	opts := initStorageOptions(64, 4096, 4)
+	wr, _ := initStorageWriter(dir, file_number, true, opts)
+	records := make([]*Data, 0)
+	for i := 0; i < 20; i++ {
+		d := generateKeyedData(fmt.Sprintf("%03d", i), 3)
+		if err := wr.Write(d); err != nil {
+			t.Fatalf("Failed to write data %d", i)
+		}
+		records = append(records, d)
+	}
+	wr.Flush()
+
+	// the reader picks the layout up from the file header
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	for _, seg := range(r.segments) {
+		if seg.header.page_size != 64 || seg.header.max_file_size != 4096 {
+			t.Errorf("Expected page size 64 and file size 4096. Actual %v", seg.header)
+		}
+	}
+	for _, expected := range(records) {
+		if actual, _ := r.Read(expected.row_key); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected %v. Actual %v", expected, actual)
+		}
+	}
+
+	var offset int64 = 0
+	for i := 0; i < len(records); i++ {
+		actual, next, _ := r.ReadRow(offset)
+		if !reflect.DeepEqual(records[i], actual) {
+			t.Errorf("Expected %v. Actual %v", records[i], actual)
+		}
+		end := next + int64(file_header_size)
+		start := end - int64(len(ToBytes(records[i], true)))
+		if start / 64 != (end - 1) / 64 {
+			t.Errorf("Row %d crosses a page boundary", i)
+		}
+		offset = next
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for _, use_index := range([]bool{ true, false }) {
+		file_number := 0
+		wr, _ := initStorageWriter(dir, file_number, use_index, nil)
+		d1 := generateKeyedData("a", 2)
+		d2 := generateKeyedData("b", 2)
+		d3 := generateKeyedData("c", 2)
+		for _, d := range([]*Data{ d1, d2, d3 }) {
+			if err := wr.Write(d); err != nil {
+				t.Fatalf("Failed to write data")
+			}
+		}
+		if err := wr.Delete(d2.row_key); err != nil {
+			t.Errorf("Failed to delete %s", d2.row_key)
+		}
+		if err := wr.Delete(d2.row_key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected deleting %s twice to fail", d2.row_key)
+		}
+		wr.Flush()
+
+		r, _ := initStorageReader(dir, file_number, use_index, nil)
+		if actual, err := r.Read(d2.row_key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected %v. Actual %v, %v", ErrKeyNotFound, actual, err)
+		}
+		if actual, _ := r.Read(d3.row_key); !reflect.DeepEqual(d3, actual) {
+			t.Errorf("Expected %v. Actual %v", d3, actual)
+		}
+		if use_index {
+			if _, err := r.segments[0].index.Find(d2.row_key); err == nil {
+				t.Errorf("Expected %s to be removed from the index", d2.row_key)
+			}
+		}
+
+		r1, offset, _ := r.ReadRow(0)
+		if !reflect.DeepEqual(d1, r1) {
+			t.Errorf("Expected %v. Actual %v", d1, r1)
+		}
+		r2, _, _ := r.ReadRow(offset)
+		if !reflect.DeepEqual(d3, r2) {
+			t.Errorf("Expected %v. Actual %v", d3, r2)
+		}
+		r.Close()
+	}
+}
+
+func readAllRows(r *StorageReader) []*Data {
+	rows := make([]*Data, 0)
+	for i := 0; i < r.Segments(); i++ {
+		var offset int64 = 0
+		for d, next, _ := r.ReadSegmentRow(i, offset); d != nil; d, next, _ = r.ReadSegmentRow(i, offset) {
+			rows = append(rows, d)
+			offset = next
+		}
+	}
+	return rows
+}
+
+func TestUpdate(t *testing.T) {
+	for _, use_index := range([]bool{ true, false }) {
+		file_number := 0
+		wr, _ := initStorageWriter(dir, file_number, use_index, nil)
+		d1 := generateKeyedData("a", 2)
+		d2 := generateKeyedData("b", 2)
+		for _, d := range([]*Data{ d1, d2 }) {
+			if err := wr.Write(d); err != nil {
+				t.Fatalf("Failed to write data")
+			}
+		}
+		// fits in the space of the old row
+		in_place := generateKeyedData("a", 1)
+		if err := wr.Update(in_place); err != nil {
+			t.Errorf("Failed to update %s", in_place.row_key)
+		}
+		// does not fit and has to be moved
+		moved := generateKeyedData("b", 4)
+		if err := wr.Write(moved); err != nil {
+			t.Errorf("Failed to update %s", moved.row_key)
+		}
+		if err := wr.Update(generateKeyedData("c", 1)); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected updating a missing key to fail")
+		}
+		wr.Flush()
+
+		r, _ := initStorageReader(dir, file_number, use_index, nil)
+		if actual, _ := r.Read("a"); !reflect.DeepEqual(in_place, actual) {
+			t.Errorf("Expected %v. Actual %v", in_place, actual)
+		}
+		if actual, _ := r.Read("b"); !reflect.DeepEqual(moved, actual) {
+			t.Errorf("Expected %v. Actual %v", moved, actual)
+		}
+		expected := []*Data{ in_place, moved }
+		if actual := readAllRows(r); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected %v. Actual %v", expected, actual)
+		}
+		r.Close()
+	}
+}
+
+func TestUpdateAcrossSegments(t *testing.T) {
+	file_number := 0
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
+	for i := 0; i < 60; i++ {
+		if err := wr.Write(generateKeyedData(fmt.Sprintf("%03d", i), 2)); err != nil {
+			t.Fatalf("Failed to write data %d", i)
+		}
+	}
+	moved := generateKeyedData("000", 6)
+	if err := wr.Write(moved); err != nil {
+		t.Fatalf("Failed to update %s", moved.row_key)
+	}
+	wr.Flush()
+
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	if actual, _ := r.Read("000"); !reflect.DeepEqual(moved, actual) {
+		t.Errorf("Expected %v. Actual %v", moved, actual)
+	}
+	if _, err := r.segments[0].index.Find("000"); err == nil {
+		t.Errorf("Expected 000 to be removed from the index of the first segment")
+	}
+	count := 0
+	for _, d := range(readAllRows(r)) {
+		if d.row_key == "000" { count++ }
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 version of 000. Actual %d", count)
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	file_number := 0
+	if _, err := initStorageWriter(dir, file_number, true, initStorageOptions(0, 1024, 3)); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Expected %v. Actual %v", ErrInvalidOptions, err)
+	}
+	wr, err := initStorageWriter(dir, file_number, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wr.Write(generateKeyedData("big", 200)); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Expected %v. Actual %v", ErrNoSpace, err)
+	}
+	d := generateKeyedData("a", 2)
+	if err := wr.Write(d); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := wr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip the flags byte of the only row to an invalid value
+	f, err := os.OpenFile(fmt.Sprintf("%s/data_%d", dir, file_number), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{ 7 }, int64(file_header_size) + 1)
+	f.Close()
+
+	r, err := initStorageReader(dir, file_number, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Read(d.row_key); !errors.Is(err, ErrCorruptFile) {
+		t.Errorf("Expected %v. Actual %v", ErrCorruptFile, err)
+	}
+	if _, _, err := r.ReadRow(0); !errors.Is(err, ErrCorruptFile) {
+		t.Errorf("Expected %v. Actual %v", ErrCorruptFile, err)
+	}
+}
+
+func TestWriteReadsOnlyTheSegmentOfTheKey(t *testing.T) {
+	table := t.TempDir()
+	wr, err := initStorageWriter(table, 0, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := wr.Write(generateKeyedData(fmt.Sprintf("%03d", i), 2)); err != nil {
+			t.Fatalf("Failed to write data %d", i)
+		}
+	}
+	wr.close()
+
+	// the keys of a reopened table are loaded from its rows
+	wr, err = openStorageWriter(table, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wr.close()
+	if len(wr.segments) < 3 {
+		t.Fatalf("Expected more than 2 segments. Actual %d", len(wr.segments))
+	}
+	moved := generateKeyedData("000", 6)
+	if err := wr.Write(moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := wr.Delete("001"); err != nil {
+		t.Fatal(err)
+	}
+	if len(wr.keys) != 99 || wr.keys["000"] != wr.current() {
+		t.Errorf("Expected 99 keys with 000 in the last segment. Actual %d %v", len(wr.keys), wr.keys["000"])
+	}
+
+	// new keys are written without reading the other segments
+	for _, seg := range(wr.segments[:len(wr.segments) - 1]) {
+		seg.file.Close()
+	}
+	if err := wr.Write(generateKeyedData("100", 2)); err != nil {
+		t.Errorf("Expected no error. Actual %v", err)
+	}
+	if err := wr.Write(generateKeyedData("000", 2)); err != nil {
+		t.Errorf("Expected no error. Actual %v", err)
+	}
+}
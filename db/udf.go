@@ -0,0 +1,165 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+A UserFunction is a scalar function written in Go, taking an argument of each
+type of Args and returning a value of type Returns. Arguments are coerced to
+their type, as in comparisons, before Call, and its result to Returns. As for
+every function, Call is only called with values that are not NULL.
+*/
+type UserFunction struct {
+	Args []ValueType
+	Returns ValueType
+	Call func(args []Value) (Value, error)
+}
+
+/*
+A UserAggregate is an aggregate function of a column written in Go, aggregating
+the values of type Arg of a group into a value of type Returns. Init returns the
+state of an empty group, Step adds a value to a state, Merge combines the states
+of two parts of a group and Final returns the result of a state. An AGGREGATE
+reads its input once and steps a single state through a group, so it does not
+call Merge yet. NULLs are skipped, as by the other aggregates, so a group
+without values is Final(Init()). Values are coerced to Arg before Step and
+results to Returns.
+*/
+type UserAggregate struct {
+	Arg ValueType
+	Returns ValueType
+	Init func() any
+	Step func(state any, v Value) (any, error)
+	Merge func(a any, b any) (any, error)
+	Final func(state any) (Value, error)
+}
+
+// UserAggregates are the aggregates registered with RegisterAggregate, by name.
+var UserAggregates = map[string]UserAggregate {}
+
+// functions_mutex guards Functions and UserAggregates, so functions can be
+// registered while other goroutines run queries.
+var functions_mutex sync.RWMutex
+
+/*
+RegisterFunction adds f to Functions under the upper case of name, so plans call
+it with CALL and SQL queries by name in any case:
+
+	db.RegisterFunction("REVERSE", db.UserFunction{ []db.ValueType{ db.TYPE_STRING },
+		db.TYPE_STRING, reverse })
+
+It returns an ErrInvalidFunction if f has no Call, an unknown type, or the name
+of another function, aggregate or SQL keyword.
+*/
+func RegisterFunction(name string, f UserFunction) error {
+	functions_mutex.Lock()
+	defer functions_mutex.Unlock()
+	name, err := checkFunctionName(name)
+	if err != nil {
+		return err
+	}
+	if err := checkFunctionTypes(name, append([]ValueType{ f.Returns }, f.Args...)); err != nil {
+		return err
+	}
+	if f.Call == nil {
+		return fmt.Errorf("%w: %s has no Call", ErrInvalidFunction, name)
+	}
+	Functions[name] = Function{ len(f.Args), len(f.Args), func(args []Value) (Value, error) {
+		coerced := make([]Value, len(args))
+		for i, arg := range(args) {
+			var err error
+			if coerced[i], err = coerceValue(arg, f.Args[i]); err != nil {
+				return Value{}, fmt.Errorf("%s argument %d: %w", name, i + 1, err)
+			}
+		}
+		v, err := f.Call(coerced)
+		if err == nil {
+			v, err = coerceValue(v, f.Returns)
+		}
+		if err != nil {
+			return Value{}, fmt.Errorf("%s: %w", name, err)
+		}
+		return v, nil
+	} }
+	return nil
+}
+
+/*
+RegisterAggregate adds a to UserAggregates under the upper case of name, so
+AGGREGATE nodes compute it as their other functions and SQL queries call it by
+name in any case, MEDIAN(Rating) for instance.
+
+It returns an ErrInvalidFunction if a lacks one of its functions, has an unknown
+type, or the name of another function, aggregate or SQL keyword.
+*/
+func RegisterAggregate(name string, a UserAggregate) error {
+	functions_mutex.Lock()
+	defer functions_mutex.Unlock()
+	name, err := checkFunctionName(name)
+	if err != nil {
+		return err
+	}
+	if err := checkFunctionTypes(name, []ValueType{ a.Arg, a.Returns }); err != nil {
+		return err
+	}
+	if a.Init == nil || a.Step == nil || a.Merge == nil || a.Final == nil {
+		return fmt.Errorf("%w: %s needs Init, Step, Merge and Final", ErrInvalidFunction, name)
+	}
+	UserAggregates[name] = a
+	return nil
+}
+
+// checkFunctionName returns name in upper case, or an ErrInvalidFunction if it
+// is not an identifier or is taken. functions_mutex must be held.
+func checkFunctionName(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if name == "" || !isIdentStart(name[0]) || strings.ContainsFunc(name, func(c rune) bool {
+		return c > 0x7f || !(isIdentStart(byte(c)) || isDigit(byte(c)))
+	}) {
+		return "", fmt.Errorf("%w: %q is not an identifier", ErrInvalidFunction, name)
+	}
+	_, function := Functions[name]
+	_, aggregate := UserAggregates[name]
+	_, builtin := parseAggregateFunction(name)
+	if function || aggregate || builtin || slices.Contains(sql_keywords, name) {
+		return "", fmt.Errorf("%w: %s is already defined", ErrInvalidFunction, name)
+	}
+	return name, nil
+}
+
+// lookupUserAggregate returns the aggregate of UserAggregates called name.
+func lookupUserAggregate(name string) (UserAggregate, bool) {
+	functions_mutex.RLock()
+	defer functions_mutex.RUnlock()
+	u, ok := UserAggregates[name]
+	return u, ok
+}
+
+func checkFunctionTypes(name string, types []ValueType) error {
+	for _, typ := range(types) {
+		if _, ok := value_type_names[typ]; !ok || typ == TYPE_NULL {
+			return fmt.Errorf("%w: %s has unknown type %v", ErrInvalidFunction, name, typ)
+		}
+	}
+	return nil
+}
+
+func (u *UserAggregate) step(state any, v Value) (any, error) {
+	v, err := coerceValue(v, u.Arg)
+	if err != nil {
+		return nil, err
+	}
+	return u.Step(state, v)
+}
+
+func (u *UserAggregate) final(state any) (Value, error) {
+	v, err := u.Final(state)
+	if err != nil {
+		return Value{}, err
+	}
+	return coerceValue(v, u.Returns)
+}
@@ -0,0 +1,215 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"reflect"
+	"sort"
+	"fmt"
+	"sync"
+)
+
+var median = UserAggregate{ TYPE_FLOAT, TYPE_FLOAT,
+	func() any { return []float64{} },
+	func(state any, v Value) (any, error) { return append(state.([]float64), v.f), nil },
+	func(a any, b any) (any, error) { return append(a.([]float64), b.([]float64)...), nil },
+	func(state any) (Value, error) {
+		values := state.([]float64)
+		if len(values) == 0 {
+			return NullValue(), nil
+		}
+		sort.Float64s(values)
+		n := len(values)
+		return FloatValue((values[(n - 1) / 2] + values[n / 2]) / 2), nil
+	},
+}
+
+var initial = UserFunction{ []ValueType{ TYPE_STRING }, TYPE_STRING, func(args []Value) (Value, error) {
+	return StringValue(args[0].s[:1]), nil
+} }
+
+func TestRegisterFunction(t *testing.T) {
+	twice := UserFunction{ []ValueType{ TYPE_INT }, TYPE_FLOAT, func(args []Value) (Value, error) {
+		return IntValue(args[0].i * 2), nil
+	} }
+	if err := RegisterFunction("twice", twice); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(Functions, "TWICE")
+
+	// the argument is parsed as an int and the result coerced to a float
+	for _, c := range([]struct {
+		arg Value
+		expected Value
+	}{
+		{ StringValue("21"), FloatValue(42) },
+		{ IntValue(-1), FloatValue(-2) },
+		{ NullValue(), NullValue() },
+	}) {
+		if actual, err := call(t, "TWICE", c.arg); err != nil || actual != c.expected {
+			t.Errorf("TWICE(%v): Expected %v. Actual %v %v", c.arg, c.expected, actual, err)
+		}
+	}
+	if _, err := call(t, "TWICE", FloatValue(1.5)); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected %v. Actual %v", ErrTypeMismatch, err)
+	}
+	if _, err := parseExpression(map[string]interface{}{ "CALL": []interface{}{ "TWICE", 1.0, 2.0 } });
+		!errors.Is(err, ErrInvalidPlan) {
+		t.Errorf("Expected %v. Actual %v", ErrInvalidPlan, err)
+	}
+
+	for name, f := range(map[string]UserFunction{
+		"Twice": twice,
+		"upper": twice,
+		"sum": twice,
+		"select": twice,
+		"two words": twice,
+		"2x": twice,
+		"": twice,
+		"NONE": { []ValueType{ TYPE_INT }, TYPE_INT, nil },
+		"UNTYPED": { []ValueType{ TYPE_NULL }, TYPE_INT, twice.Call },
+	}) {
+		if err := RegisterFunction(name, f); !errors.Is(err, ErrInvalidFunction) {
+			t.Errorf("%q: Expected %v. Actual %v", name, ErrInvalidFunction, err)
+		}
+	}
+	if err := RegisterAggregate("twice", median); !errors.Is(err, ErrInvalidFunction) {
+		t.Errorf("Expected %v. Actual %v", ErrInvalidFunction, err)
+	}
+	for _, a := range([]UserAggregate{
+		{ TYPE_INT, TYPE_INT, median.Init, nil, median.Merge, median.Final },
+		{ TYPE_INT, TYPE_INT, median.Init, median.Step, nil, median.Final },
+	}) {
+		if err := RegisterAggregate("LAST", a); !errors.Is(err, ErrInvalidFunction) {
+			t.Errorf("Expected %v. Actual %v", ErrInvalidFunction, err)
+		}
+	}
+}
+
+func TestUserAggregate(t *testing.T) {
+	if err := RegisterAggregate("median", median); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(UserAggregates, "MEDIAN")
+
+	movies := []Record{
+		makeRecord("1", "a,b", "1", "2000"),
+		makeRecord("2", "a", "2", "2001"),
+		makeRecord("3", "a,b", "3", "2000"),
+		makeRecord("4", "a", "4", "2003"),
+		makeRecord("5", "a", "5", "2003"),
+	}
+	_, aggregates, _, err := parseAggregateNodeArgs(map[string]interface{}{ "aggregates": []interface{}{
+		map[string]interface{}{ "function": "MEDIAN", "column": "Id" } } })
+	if err != nil || !reflect.DeepEqual([]Aggregate{ { AGG_USER, "Id", "", "MEDIAN" } }, aggregates) {
+		t.Fatalf("Expected MEDIAN(Id). Actual %v %v", aggregates, err)
+	}
+	agg := initAggregateNode(initStaticScan(movies), []string{ "Name" }, aggregates, nil)
+	expected := []Value{ FloatValue(2), FloatValue(4) }
+	actual := make([]Value, 0)
+	for r, err := agg.Next(); r != nil || err != nil; r, err = agg.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, r.values["MEDIAN(Id)"])
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+
+	// an empty group is Final(Init())
+	agg = initAggregateNode(initStaticScan([]Record{}), nil, aggregates, nil)
+	if r, err := agg.Next(); err != nil || r == nil || !r.values["MEDIAN(Id)"].IsNull() {
+		t.Errorf("Expected a NULL median. Actual %v %v", r, err)
+	}
+
+	movies[0].values["Id"] = StringValue("one")
+	agg = initAggregateNode(initStaticScan(movies), nil, aggregates, nil)
+	if _, err := agg.Next(); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected %v. Actual %v", ErrTypeMismatch, err)
+	}
+	agg = initAggregateNode(initStaticScan(movies), nil, []Aggregate{ { AGG_USER, "Id", "", "GONE" } }, nil)
+	if _, err := agg.Next(); !errors.Is(err, ErrInvalidPlan) {
+		t.Errorf("Expected %v. Actual %v", ErrInvalidPlan, err)
+	}
+}
+
+func TestQueryUserFunctions(t *testing.T) {
+	if err := RegisterFunction("INITIAL", initial); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(Functions, "INITIAL")
+	if err := RegisterAggregate("MEDIAN", median); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(UserAggregates, "MEDIAN")
+
+	db, err := Open(t.TempDir(), &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Genre TEXT, Rating FLOAT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, genre := range([]string{ "drama", "comedy", "drama", "drama", "comedy", "horror" }) {
+		if err := db.Put("movies", map[string]any{ "Id": i, "Genre": genre, "Rating": float64(i) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.Query(`SELECT Initial(Genre) AS Letter, median(Rating) AS Middle FROM movies
+		GROUP BY Genre HAVING MEDIAN(Rating) > 2 ORDER BY Middle DESC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	expected := [][]Value{
+		{ StringValue("h"), FloatValue(5) },
+		{ StringValue("c"), FloatValue(2.5) },
+	}
+	actual := make([][]Value, 0)
+	for rows.Next() {
+		r := rows.Record()
+		row := make([]Value, 0)
+		for _, col := range([]string{ "Letter", "Middle" }) {
+			v, _ := r.Value(col)
+			row = append(row, v)
+		}
+		actual = append(actual, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v. Actual %v", expected, actual)
+	}
+
+	if _, err := db.Query("SELECT Genre FROM movies WHERE MEDIAN(Rating) > 2"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected %v. Actual %v", ErrSyntax, err)
+	}
+}
+
+func TestRegisterWhileQuerying(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := range(8) {
+		name := fmt.Sprintf("INITIAL_%d", i)
+		defer delete(Functions, name)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := RegisterFunction(name, initial); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := parseSQL("SELECT UPPER(Name) FROM movies WHERE Rating > 1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := lookupFunction("INITIAL_7", 1); err != nil {
+		t.Errorf("Expected INITIAL_7. Actual %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package db
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ValueType byte
+
+const (
+	TYPE_STRING ValueType = iota
+	TYPE_INT
+	TYPE_FLOAT
+	TYPE_BOOL
+	TYPE_TIMESTAMP
+	TYPE_BYTES
+	TYPE_NULL
+)
+
+var value_type_names = map[ValueType]string {
+	TYPE_STRING: "string",
+	TYPE_INT: "int",
+	TYPE_FLOAT: "float",
+	TYPE_BOOL: "bool",
+	TYPE_TIMESTAMP: "timestamp",
+	TYPE_BYTES: "bytes",
+	TYPE_NULL: "null",
+}
+
+func (t ValueType) String() string {
+	if name, ok := value_type_names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", byte(t))
+}
+
+func (t ValueType) MarshalText() ([]byte, error) {
+	if _, ok := value_type_names[t]; !ok {
+		return nil, fmt.Errorf("%w: %v", ErrTypeMismatch, t)
+	}
+	return []byte(t.String()), nil
+}
+
+func (t *ValueType) UnmarshalText(text []byte) error {
+	typ, ok := parseValueType(string(text))
+	if !ok {
+		return fmt.Errorf("%w: unknown type %s", ErrTypeMismatch, text)
+	}
+	*t = typ
+	return nil
+}
+
+// value_type_aliases are the other names of the types in CREATE TABLE
+var value_type_aliases = map[string]ValueType {
+	"text": TYPE_STRING,
+	"integer": TYPE_INT,
+	"real": TYPE_FLOAT,
+	"boolean": TYPE_BOOL,
+}
+
+// parseValueType returns the type of the case-insensitive name.
+func parseValueType(name string) (ValueType, bool) {
+	name = strings.ToLower(name)
+	for t, n := range(value_type_names) {
+		if n == name {
+			return t, true
+		}
+	}
+	t, ok := value_type_aliases[name]
+	return t, ok
+}
+
+// timestamps are written and parsed in this layout, a date alone is parsed too
+const timestamp_layout = time.RFC3339Nano
+const date_layout = "2006-01-02"
+
+/*
+A Value is the typed value of a column. Integers, booleans and timestamps are
+kept in i, as 0 or 1 for booleans and nanoseconds since the epoch for
+timestamps, floats in f, strings and bytes in s. NULL is the missing value of a
+column, of any type. Values are comparable with ==.
+
+Stored value format:
+
+[ type (1 byte) ]
+[ payload ]
+
+string, bytes: the bytes themselves
+int, timestamp: 8 bytes, big endian two's complement
+float: 8 bytes, big endian IEEE 754
+bool: 1 byte, 0 or 1
+null: empty
+*/
+type Value struct {
+	typ ValueType
+	i int64
+	f float64
+	s string
+}
+
+func StringValue(s string) Value {
+	return Value{ typ: TYPE_STRING, s: s }
+}
+
+func IntValue(i int64) Value {
+	return Value{ typ: TYPE_INT, i: i }
+}
+
+func FloatValue(f float64) Value {
+	return Value{ typ: TYPE_FLOAT, f: f }
+}
+
+func BoolValue(b bool) Value {
+	v := Value{ typ: TYPE_BOOL }
+	if b {
+		v.i = 1
+	}
+	return v
+}
+
+func TimestampValue(t time.Time) Value {
+	return Value{ typ: TYPE_TIMESTAMP, i: t.UnixNano() }
+}
+
+func BytesValue(b []byte) Value {
+	return Value{ typ: TYPE_BYTES, s: string(b) }
+}
+
+func NullValue() Value {
+	return Value{ typ: TYPE_NULL }
+}
+
+func (v Value) IsNull() bool {
+	return v.typ == TYPE_NULL
+}
+
+func (v Value) Type() ValueType {
+	return v.typ
+}
+
+func (v Value) Int() int64 {
+	return v.i
+}
+
+func (v Value) Float() float64 {
+	return v.f
+}
+
+func (v Value) Bool() bool {
+	return v.i != 0
+}
+
+func (v Value) Time() time.Time {
+	return time.Unix(0, v.i).UTC()
+}
+
+func (v Value) Bytes() []byte {
+	return []byte(v.s)
+}
+
+func (v Value) String() string {
+	switch v.typ {
+		case TYPE_INT:
+			return strconv.FormatInt(v.i, 10)
+		case TYPE_FLOAT:
+			return strconv.FormatFloat(v.f, 'g', -1, 64)
+		case TYPE_BOOL:
+			return strconv.FormatBool(v.Bool())
+		case TYPE_TIMESTAMP:
+			return v.Time().Format(timestamp_layout)
+		case TYPE_BYTES:
+			return fmt.Sprintf("%x", v.s)
+		case TYPE_NULL:
+			return "NULL"
+	}
+	return v.s
+}
+
+// toValue converts a Go value, as given to Put, to a Value. nil is NULL.
+func toValue(a any) (Value, error) {
+	switch v := a.(type) {
+		case nil:
+			return NullValue(), nil
+		case Value:
+			return v, nil
+		case string:
+			return StringValue(v), nil
+		case []byte:
+			return BytesValue(v), nil
+		case bool:
+			return BoolValue(v), nil
+		case int:
+			return IntValue(int64(v)), nil
+		case int32:
+			return IntValue(int64(v)), nil
+		case int64:
+			return IntValue(v), nil
+		case uint32:
+			return IntValue(int64(v)), nil
+		case float32:
+			return FloatValue(float64(v)), nil
+		case float64:
+			return FloatValue(v), nil
+		case time.Time:
+			return TimestampValue(v), nil
+	}
+	return Value{}, fmt.Errorf("%w: unsupported Go type %T", ErrTypeMismatch, a)
+}
+
+// argToValue converts a value of a plan. JSON numbers are decoded as float64,
+// those without a fraction are integers.
+func argToValue(a any) (Value, error) {
+	if f, ok := a.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1 << 53 {
+		return IntValue(int64(f)), nil
+	}
+	return toValue(a)
+}
+
+// toArg is the inverse of argToValue.
+func toArg(v Value) any {
+	switch v.typ {
+		case TYPE_INT:
+			return v.i
+		case TYPE_FLOAT:
+			return v.f
+		case TYPE_BOOL:
+			return v.Bool()
+		case TYPE_NULL:
+			return nil
+	}
+	return v.String()
+}
+
+func (v Value) payload() []byte {
+	buf := new(bytes.Buffer)
+	switch v.typ {
+		case TYPE_INT, TYPE_TIMESTAMP:
+			binary.Write(buf, binary.BigEndian, v.i)
+		case TYPE_FLOAT:
+			binary.Write(buf, binary.BigEndian, math.Float64bits(v.f))
+		case TYPE_BOOL:
+			buf.WriteByte(byte(v.i))
+		default:
+			buf.WriteString(v.s)
+	}
+	return buf.Bytes()
+}
+
+func (v Value) encode() []byte {
+	return append([]byte{ byte(v.typ) }, v.payload()...)
+}
+
+func decodeValue(b []byte) (Value, error) {
+	if len(b) == 0 {
+		return Value{}, fmt.Errorf("%w: empty value", ErrCorruptFile)
+	}
+	typ, payload := ValueType(b[0]), b[1:]
+	switch typ {
+		case TYPE_STRING:
+			return StringValue(string(payload)), nil
+		case TYPE_BYTES:
+			return BytesValue(payload), nil
+		case TYPE_INT, TYPE_TIMESTAMP, TYPE_FLOAT:
+			if len(payload) != 8 {
+				break
+			}
+			n := binary.BigEndian.Uint64(payload)
+			if typ == TYPE_FLOAT {
+				return FloatValue(math.Float64frombits(n)), nil
+			}
+			return Value{ typ: typ, i: int64(n) }, nil
+		case TYPE_BOOL:
+			if len(payload) != 1 {
+				break
+			}
+			return BoolValue(payload[0] != 0), nil
+		case TYPE_NULL:
+			if len(payload) != 0 {
+				break
+			}
+			return NullValue(), nil
+	}
+	return Value{}, fmt.Errorf("%w: invalid %v value %x", ErrCorruptFile, typ, payload)
+}
+
+// parseValue parses s as a value of type typ.
+func parseValue(s string, typ ValueType) (Value, error) {
+	var err error
+	switch typ {
+		case TYPE_STRING:
+			return StringValue(s), nil
+		case TYPE_BYTES:
+			return BytesValue([]byte(s)), nil
+		case TYPE_INT:
+			var i int64
+			if i, err = strconv.ParseInt(s, 10, 64); err == nil {
+				return IntValue(i), nil
+			}
+		case TYPE_FLOAT:
+			var f float64
+			if f, err = strconv.ParseFloat(s, 64); err == nil {
+				return FloatValue(f), nil
+			}
+		case TYPE_BOOL:
+			var b bool
+			if b, err = strconv.ParseBool(s); err == nil {
+				return BoolValue(b), nil
+			}
+		case TYPE_TIMESTAMP:
+			for _, layout := range([]string{ timestamp_layout, date_layout }) {
+				var t time.Time
+				if t, err = time.Parse(layout, s); err == nil {
+					return TimestampValue(t), nil
+				}
+			}
+	}
+	return Value{}, fmt.Errorf("%w: %q is not a %v", ErrTypeMismatch, s, typ)
+}
+
+// coerceValue converts v to the type typ: an int becomes a float and a string
+// is parsed. NULL stays NULL. Other conversions are an ErrTypeMismatch.
+func coerceValue(v Value, typ ValueType) (Value, error) {
+	switch {
+		case v.typ == typ || v.typ == TYPE_NULL:
+			return v, nil
+		case v.typ == TYPE_STRING:
+			return parseValue(v.s, typ)
+		case v.typ == TYPE_INT && typ == TYPE_FLOAT:
+			return FloatValue(float64(v.i)), nil
+	}
+	return Value{}, fmt.Errorf("%w: %v %s is not a %v", ErrTypeMismatch, v.typ, v, typ)
+}
+
+func isNumeric(t ValueType) bool {
+	return t == TYPE_INT || t == TYPE_FLOAT
+}
+
+/*
+compareValues orders a and b under these coercion rules:
+
+- values of the same type compare naturally, strings and bytes byte-wise,
+  false before true and timestamps by time
+- an int and a float compare as floats
+- a string and a value of another type compare once the string is parsed as
+  that type, so '2000' equals 2000 and '2024-01-31' is a timestamp
+
+Any other pair, or a string that does not parse, is an ErrTypeMismatch.
+Callers handle NULL, which compares with nothing, before.
+*/
+func compareValues(a Value, b Value) (int, error) {
+	if a.typ == b.typ {
+		switch a.typ {
+			case TYPE_FLOAT:
+				return cmp.Compare(a.f, b.f), nil
+			case TYPE_STRING, TYPE_BYTES:
+				return strings.Compare(a.s, b.s), nil
+		}
+		return cmp.Compare(a.i, b.i), nil
+	}
+	if isNumeric(a.typ) && isNumeric(b.typ) {
+		return cmp.Compare(a.asFloat(), b.asFloat()), nil
+	}
+	if a.typ == TYPE_STRING {
+		a_v, err := parseValue(a.s, b.typ)
+		if err != nil {
+			return 0, err
+		}
+		return compareValues(a_v, b)
+	}
+	if b.typ == TYPE_STRING {
+		c, err := compareValues(b, a)
+		return -c, err
+	}
+	return 0, fmt.Errorf("%w: cannot compare %v %s with %v %s", ErrTypeMismatch,
+		a.typ, a, b.typ, b)
+}
+
+func (v Value) asFloat() float64 {
+	if v.typ == TYPE_INT {
+		return float64(v.i)
+	}
+	return v.f
+}
+
+// compareForSort orders any two values: values that do not compare are
+// ordered by type.
+func compareForSort(a Value, b Value) int {
+	c, err := compareValues(a, b)
+	if errors.Is(err, ErrTypeMismatch) {
+		return cmp.Compare(a.typ, b.typ)
+	}
+	return c
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+func TestCompareValues(t *testing.T) {
+	ts := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		a Value
+		b Value
+		expected int
+	}{
+		{ IntValue(10), IntValue(9), 1 },
+		{ StringValue("10"), StringValue("9"), -1 },
+		{ IntValue(2), FloatValue(2.5), -1 },
+		{ FloatValue(2), IntValue(2), 0 },
+		{ StringValue("2000"), IntValue(2000), 0 },
+		{ IntValue(10), StringValue("9"), 1 },
+		{ StringValue("2.5"), FloatValue(2.25), 1 },
+		{ BoolValue(false), BoolValue(true), -1 },
+		{ StringValue("true"), BoolValue(true), 0 },
+		{ TimestampValue(ts), StringValue("2024-01-30"), 1 },
+		{ BytesValue([]byte{ 1 }), BytesValue([]byte{ 1, 0 }), -1 },
+	}
+	for _, c := range(cases) {
+		actual, err := compareValues(c.a, c.b)
+		if err != nil || actual != c.expected {
+			t.Errorf("%v %v: Expected %d. Actual %d %v", c.a, c.b, c.expected, actual, err)
+		}
+	}
+	for _, c := range([][]Value{
+		{ StringValue("ten"), IntValue(10) },
+		{ IntValue(1), BoolValue(true) },
+		{ TimestampValue(ts), FloatValue(1) },
+	}) {
+		if _, err := compareValues(c[0], c[1]); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("%v %v: Expected %v. Actual %v", c[0], c[1], ErrTypeMismatch, err)
+		}
+	}
+}
+
+func TestValueEncoding(t *testing.T) {
+	values := []Value{
+		StringValue("Movie"), StringValue(""), IntValue(-42), FloatValue(3.5),
+		BoolValue(true), TimestampValue(time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)),
+		BytesValue([]byte{ 0, 255 }), NullValue(),
+	}
+	for _, v := range(values) {
+		actual, err := decodeValue(v.encode())
+		if err != nil || actual != v {
+			t.Errorf("Expected %v. Actual %v %v", v, actual, err)
+		}
+	}
+	if _, err := decodeValue([]byte{ byte(TYPE_INT), 1 }); !errors.Is(err, ErrCorruptFile) {
+		t.Errorf("Expected %v. Actual %v", ErrCorruptFile, err)
+	}
+}
+
+func TestTypedColumns(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Year INT, Rating FLOAT, Seen BOOL, Poster BYTES)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, year := range([]int{ 9, 10, 100, 1999 }) {
+		err := db.Put("movies", map[string]any{ "Id": i, "Year": year, "Rating": float64(year) / 2,
+			"Seen": i % 2 == 0, "Poster": []byte{ byte(i) } })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("movies", map[string]any{ "Year": struct{}{} }); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected %v. Actual %v", ErrTypeMismatch, err)
+	}
+	r, err := db.Get("movies", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.Value("Year"); v != IntValue(10) {
+		t.Errorf("Expected 10. Actual %v", v)
+	}
+	if v, _ := r.Value("Rating"); v != FloatValue(5) {
+		t.Errorf("Expected 5. Actual %v", v)
+	}
+
+	cases := []struct {
+		query string
+		expected []string
+	}{
+		{ "SELECT * FROM movies WHERE Year > 9", []string{ "1", "2", "3" } },
+		{ "SELECT * FROM movies WHERE Year < '100'", []string{ "0", "1" } },
+		{ "SELECT * FROM movies WHERE Rating >= 49.5", []string{ "2", "3" } },
+		{ "SELECT * FROM movies WHERE Seen = TRUE", []string{ "0", "2" } },
+		{ "SELECT * FROM movies ORDER BY Year", []string{ "0", "1", "2", "3" } },
+		{ `{"head": { "name": "SELECTION", "args": { "AND": { "LT_E": ["Year", 10] } },
+			"child": { "name": "FILE_SCAN", "args": { "table": "movies" } } } }`,
+			[]string{ "0", "1" } },
+	}
+	for _, c := range(cases) {
+		rows, err := db.Query(c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if actual := rowKeys(t, rows); !slices.Equal(c.expected, actual) {
+			t.Errorf("%s: Expected %v. Actual %v", c.query, c.expected, actual)
+		}
+	}
+	rows, err := db.Query("SELECT * FROM movies WHERE Year = 'ten'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {}
+	if !errors.Is(rows.Err(), ErrTypeMismatch) {
+		t.Errorf("Expected %v. Actual %v", ErrTypeMismatch, rows.Err())
+	}
+}
+
+func TestNulls(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{ NoSync: true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("CREATE TABLE movies (Id INT PRIMARY KEY, Year INT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, year := range([]any{ 2000, nil, 1990, nil }) {
+		if err := db.Put("movies", map[string]any{ "Id": i, "Year": year }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := db.Get("movies", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := r.Value("Year"); !ok || !v.IsNull() {
+		t.Errorf("Expected NULL. Actual %v %v", v, ok)
+	}
+
+	cases := []struct {
+		query string
+		expected []string
+	}{
+		{ "SELECT * FROM movies WHERE Year IS NULL", []string{ "1", "3" } },
+		{ "SELECT * FROM movies WHERE Year IS NOT NULL", []string{ "0", "2" } },
+		{ "SELECT * FROM movies WHERE Year = NULL", []string{} },
+		{ "SELECT * FROM movies WHERE Year > 1995 OR Id = 1", []string{ "0", "1" } },
+		{ "SELECT * FROM movies WHERE Id = 1 AND Year > 1995", []string{} },
+		{ "SELECT * FROM movies ORDER BY Year", []string{ "2", "0", "1", "3" } },
+		{ "SELECT * FROM movies ORDER BY Year NULLS FIRST", []string{ "1", "3", "2", "0" } },
+	}
+	for _, c := range(cases) {
+		rows, err := db.Query(c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if actual := rowKeys(t, rows); !slices.Equal(c.expected, actual) {
+			t.Errorf("%s: Expected %v. Actual %v", c.query, c.expected, actual)
+		}
+	}
+
+	rows, err := db.Query("SELECT COUNT(*) FROM movies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Next()
+	if v, _ := rows.Record().Value("Count"); v.String() != "4" {
+		t.Errorf("Expected 4. Actual %v", v)
+	}
+	rows.Close()
+	rows, err = db.Query("SELECT COUNT(Year) FROM movies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Next()
+	if v, _ := rows.Record().Value("COUNT(Year)"); v.String() != "2" {
+		t.Errorf("Expected 2. Actual %v", v)
+	}
+	rows.Close()
+}
+
+func TestReadVersion1Header(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data_0")
+	opts := defaultStorageOptions()
+	h := newFileHeader(opts)
+	h.version = 1
+	if err := os.WriteFile(path, h.bytes(0), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	actual, err := readFileHeader(f, opts)
+	if err != nil || actual.typed() {
+		t.Errorf("Expected an untyped version 1 header. Actual %v %v", actual, err)
+	}
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"fmt"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+type WalSyncPolicy int
+
+const (
+	// fsync the log before applying every write
+	WAL_SYNC_ALWAYS WalSyncPolicy = iota
+	// leave flushing the log to the OS, a crash may lose the last writes
+	WAL_SYNC_NONE
+)
+
+const wal_op_write byte = 'W'
+const wal_op_truncate byte = 'T'
+
+/*
+A walOp is a single physical change to a file of the table: either data
+written at offset or, for a truncate, the file resized to offset bytes.
+Replaying an op twice leaves the file as replaying it once. The log records the
+path relative to the directory of the table, so the table can be recovered from
+any working directory.
+*/
+type walOp struct {
+	op byte
+	path string
+	offset int64
+	data []byte
+}
+
+/*
+Every write to a table goes through the write-ahead log in dir/wal. All the
+changes a single Write, Update or Delete makes are appended as one entry, which
+is synced according to the sync policy before the changes reach the data,
+index and manifest files. Entries are dropped once those files are synced,
+which a writer does whenever the log outgrows wal_checkpoint_files files of the
+table, since every write logs a whole image of the index.
+
+WAL file format:
+
+[ len(payload) (4 bytes) ]
+[ crc32(payload) (4 bytes) ]
+[ payload ]
+[ ... ]
+
+payload:
+
+[ op (1 byte) ]
+[ len(path) ]
+[ path ]
+[ offset (8 bytes) ]
+[ len(data) ]
+[ data ]
+[ ... ]
+*/
+type wal struct {
+	dir string
+	file *os.File
+	sync WalSyncPolicy
+	// bytes appended since the log was last emptied
+	size int64
+}
+
+// a writer checkpoints once its log is larger than this many data files
+const wal_checkpoint_files = 4
+
+func walPath(dir string) string {
+	return filepath.Join(dir, "wal")
+}
+
+// open_wals counts the logs writers of the process hold open, by the absolute
+// path of the directory of their table.
+var open_wals = map[string]int{}
+var open_wals_mutex sync.Mutex
+
+func walKey(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return filepath.Clean(dir)
+}
+
+// isWalOpen reports whether a writer of the process logs the writes to the
+// table in dir.
+func isWalOpen(dir string) bool {
+	open_wals_mutex.Lock()
+	defer open_wals_mutex.Unlock()
+	return open_wals[walKey(dir)] > 0
+}
+
+func openWal(dir string, sync WalSyncPolicy) (*wal, error) {
+	f, err := os.OpenFile(walPath(dir), default_storage_write_mode | os.O_APPEND, permission)
+	if err != nil {
+		return nil, err
+	}
+	open_wals_mutex.Lock()
+	open_wals[walKey(dir)] += 1
+	open_wals_mutex.Unlock()
+	return &wal{ dir, f, sync, 0 }, nil
+}
+
+func (w *wal) append(ops []walOp) error {
+	logged := make([]walOp, len(ops))
+	for i, op := range(ops) {
+		path, err := filepath.Rel(w.dir, op.path)
+		if err != nil || !filepath.IsLocal(path) {
+			return fmt.Errorf("logging %s: not a file of the table in %s", op.path, w.dir)
+		}
+		logged[i] = walOp{ op.op, path, op.offset, op.data }
+	}
+	payload := encodeWalOps(logged)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(len(payload)))
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(payload))
+	buf.Write(payload)
+	n, err := w.file.Write(buf.Bytes())
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if w.sync == WAL_SYNC_ALWAYS {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// checkpoint empties the log. Only call it once every file the logged ops
+// touched has been synced.
+func (w *wal) checkpoint() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = 0
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	open_wals_mutex.Lock()
+	key := walKey(w.dir)
+	if open_wals[key] -= 1; open_wals[key] <= 0 {
+		delete(open_wals, key)
+	}
+	open_wals_mutex.Unlock()
+	return w.file.Close()
+}
+
+func encodeWalOps(ops []walOp) []byte {
+	buf := new(bytes.Buffer)
+	for _, op := range(ops) {
+		buf.WriteByte(op.op)
+		buf.Write(ToBytesForString(op.path))
+		binary.Write(buf, binary.BigEndian, op.offset)
+		buf.Write(ToVarInts(len(op.data)))
+		buf.Write(op.data)
+	}
+	return buf.Bytes()
+}
+
+func decodeWalOps(payload []byte) ([]walOp, bool) {
+	ops := make([]walOp, 0)
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		op, err := r.ReadByte()
+		if err != nil || (op != wal_op_write && op != wal_op_truncate) {
+			return nil, false
+		}
+		path, ok := readWalBytes(r)
+		if !ok { return nil, false }
+		var offset int64
+		if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
+			return nil, false
+		}
+		data, ok := readWalBytes(r)
+		if !ok { return nil, false }
+		ops = append(ops, walOp{ op, string(path), offset, data })
+	}
+	return ops, true
+}
+
+func readWalBytes(r *bytes.Reader) ([]byte, bool) {
+	sz := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil { return nil, false }
+		sz = sz << 7 | int(b & 0x7F)
+		if b & 0x80 == 0 { break }
+	}
+	if sz > r.Len() { return nil, false }
+	data := make([]byte, sz)
+	r.Read(data)
+	return data, true
+}
+
+// readWal returns the complete entries of the log. Reading stops at the first
+// entry that is cut short or fails its checksum: the write it belongs to never
+// made it to the data files.
+func readWal(f *os.File) ([][]walOp, error) {
+	entries := make([][]walOp, 0)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		ops, ok := decodeWalOps(payload)
+		if !ok {
+			break
+		}
+		entries = append(entries, ops)
+	}
+	return entries, nil
+}
+
+/*
+recoverWal replays the complete entries left in the log of the table in dir by
+a writer that did not flush, syncs the files they touch and empties the log,
+dropping any partially written entry. An entry for a file outside dir is an
+ErrCorruptFile.
+*/
+func recoverWal(dir string) error {
+	f, err := os.OpenFile(walPath(dir), os.O_RDWR, permission)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := readWal(f)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, target := range(files) {
+			target.Close()
+		}
+	}()
+	for _, ops := range(entries) {
+		for _, op := range(ops) {
+			if !filepath.IsLocal(op.path) {
+				return fmt.Errorf("%w: log entry for %s outside %s", ErrCorruptFile, op.path, dir)
+			}
+			path := filepath.Join(dir, op.path)
+			target, ok := files[path]
+			if !ok {
+				target, err = os.OpenFile(path, default_storage_write_mode, permission)
+				if err != nil {
+					return err
+				}
+				files[path] = target
+			}
+			if err := applyWalOp(target, op); err != nil {
+				return fmt.Errorf("replaying %s: %w", path, err)
+			}
+		}
+	}
+	for _, target := range(files) {
+		if err := target.Sync(); err != nil {
+			return err
+		}
+	}
+	w := &wal{ dir, f, WAL_SYNC_ALWAYS, 0 }
+	return w.checkpoint()
+}
+
+func applyWalOp(f *os.File, op walOp) error {
+	if op.op == wal_op_truncate {
+		return f.Truncate(op.offset)
+	}
+	_, err := f.WriteAt(op.data, op.offset)
+	return err
+}
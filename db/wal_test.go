@@ -0,0 +1,272 @@
+package db
+
+import (
+	"testing"
+	"errors"
+	"reflect"
+	"os"
+	"path/filepath"
+	"encoding/binary"
+	"hash/crc32"
+	"fmt"
+)
+
+// crash leaves the writer as if the process died after logging p but before
+// p reached the data and index files.
+func crash(wr *StorageWriter, p *Data) {
+	wr.append(p)
+	wr.wal.append(wr.pending)
+	wr.pending = nil
+	for _, seg := range(wr.segments) {
+		seg.file.Close()
+		seg.index_file.Close()
+	}
+	wr.wal.close()
+}
+
+func TestRecoverReplaysLoggedWrites(t *testing.T) {
+	file_number := 0
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
+	d1 := generateKeyedData("a", 2)
+	d2 := generateKeyedData("b", 2)
+	if err := wr.Write(d1); err != nil {
+		t.Fatalf("Failed to write data")
+	}
+	crash(wr, d2)
+
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	for _, expected := range([]*Data{ d1, d2 }) {
+		if actual, _ := r.Read(expected.row_key); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected %v. Actual %v", expected, actual)
+		}
+	}
+	if info, err := os.Stat(walPath(dir)); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty log after recovery. Actual %v %v", info, err)
+	}
+}
+
+func TestRecoverDropsTornWrites(t *testing.T) {
+	file_number := 0
+	opts := defaultStorageOptions()
+	opts.wal_sync = WAL_SYNC_NONE
+	wr, _ := initStorageWriter(dir, file_number, true, opts)
+	d1 := generateKeyedData("a", 2)
+	d2 := generateKeyedData("b", 2)
+	if err := wr.Write(d1); err != nil {
+		t.Fatalf("Failed to write data")
+	}
+	crash(wr, d2)
+
+	// cut the entry of d2 short
+	info, err := os.Stat(walPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(walPath(dir), info.Size() - 3); err != nil {
+		t.Fatal(err)
+	}
+	entries := func() int {
+		f, _ := os.Open(walPath(dir))
+		defer f.Close()
+		entries, _ := readWal(f)
+		return len(entries)
+	}()
+	if entries != 2 {
+		t.Errorf("Expected 2 complete entries. Actual %d", entries)
+	}
+
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	if actual, _ := r.Read(d1.row_key); !reflect.DeepEqual(d1, actual) {
+		t.Errorf("Expected %v. Actual %v", d1, actual)
+	}
+	if actual, err := r.Read(d2.row_key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected %v. Actual %v, %v", ErrKeyNotFound, actual, err)
+	}
+	if info, err := os.Stat(walPath(dir)); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty log after recovery. Actual %v %v", info, err)
+	}
+}
+
+func TestOpenStorageWriterAppendsToExistingTable(t *testing.T) {
+	file_number := 0
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
+	records := make([]*Data, 0)
+	for i := 0; i < 30; i++ {
+		d := generateKeyedData(string(rune('a' + i % 26)) + string(rune('a' + i / 26)), 2)
+		if err := wr.Write(d); err != nil {
+			t.Fatalf("Failed to write data")
+		}
+		records = append(records, d)
+	}
+	wr.Flush()
+
+	wr, _ = openStorageWriter(dir, true, nil)
+	for i := 30; i < 60; i++ {
+		d := generateKeyedData(string(rune('a' + i % 26)) + string(rune('a' + i / 26)), 2)
+		if err := wr.Write(d); err != nil {
+			t.Fatalf("Failed to write data")
+		}
+		records = append(records, d)
+	}
+	if err := wr.Delete(records[0].row_key); err != nil {
+		t.Errorf("Failed to delete %s", records[0].row_key)
+	}
+	wr.Flush()
+
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	if actual, err := r.Read(records[0].row_key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected %v. Actual %v, %v", ErrKeyNotFound, actual, err)
+	}
+	for _, expected := range(records[1:]) {
+		if actual, _ := r.Read(expected.row_key); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected %v. Actual %v", expected, actual)
+		}
+	}
+}
+
+func TestRecoverFromAnotherDirectory(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	parent := t.TempDir()
+	if err := os.Chdir(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("movies", 0750); err != nil {
+		t.Fatal(err)
+	}
+	wr, _ := initStorageWriter("movies", 0, true, nil)
+	d1 := generateKeyedData("a", 2)
+	d2 := generateKeyedData("b", 2)
+	if err := wr.Write(d1); err != nil {
+		t.Fatalf("Failed to write data")
+	}
+	crash(wr, d2)
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := initStorageReader(filepath.Join(parent, "movies"), 0, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, expected := range([]*Data{ d1, d2 }) {
+		if actual, _ := r.Read(expected.row_key); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected %v. Actual %v", expected, actual)
+		}
+	}
+}
+
+func TestRecoverRejectsFilesOutsideTable(t *testing.T) {
+	parent := t.TempDir()
+	table := filepath.Join(parent, "movies")
+	if err := os.Mkdir(table, 0750); err != nil {
+		t.Fatal(err)
+	}
+	// ../outside is parent/outside, whether taken from the table or the working
+	// directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(table); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range([]string{ "../outside", filepath.Join(parent, "outside") }) {
+		payload := encodeWalOps([]walOp{ { wal_op_write, path, 0, []byte("x") } })
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		if err := os.WriteFile(walPath(table), append(header, payload...), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := recoverWal(table); !errors.Is(err, ErrCorruptFile) {
+			t.Errorf("%s: Expected %v. Actual %v", path, ErrCorruptFile, err)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "outside")); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected no file outside the table. Actual %v", path, err)
+		}
+	}
+
+	w, err := openWal(table, WAL_SYNC_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	if err := w.append([]walOp{ { wal_op_write, filepath.Join(parent, "outside"), 0, nil } }); err == nil {
+		t.Errorf("Expected logging a file outside the table to fail")
+	}
+}
+
+func TestReaderLeavesOpenWriterLog(t *testing.T) {
+	file_number := 0
+	wr, _ := initStorageWriter(dir, file_number, true, nil)
+	d1 := generateKeyedData("a", 2)
+	d2 := generateKeyedData("b", 2)
+	if err := wr.Write(d1); err != nil {
+		t.Fatalf("Failed to write data")
+	}
+	logged, err := os.Stat(walPath(dir))
+	if err != nil || logged.Size() == 0 {
+		t.Fatalf("Expected the write in the log. Actual %v %v", logged, err)
+	}
+
+	r, err := initStorageReader(dir, file_number, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := r.Read(d1.row_key); !reflect.DeepEqual(d1, actual) {
+		t.Errorf("Expected %v. Actual %v", d1, actual)
+	}
+	r.Close()
+	if info, err := os.Stat(walPath(dir)); err != nil || info.Size() != logged.Size() {
+		t.Errorf("Expected the log of the writer untouched. Actual %v %v", info, err)
+	}
+
+	// once the writer is gone, a reader recovers its log
+	crash(wr, d2)
+	r, _ = initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	if actual, _ := r.Read(d2.row_key); !reflect.DeepEqual(d2, actual) {
+		t.Errorf("Expected %v. Actual %v", d2, actual)
+	}
+	if info, err := os.Stat(walPath(dir)); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty log after recovery. Actual %v %v", info, err)
+	}
+}
+
+func TestWalStaysBounded(t *testing.T) {
+	file_number := 0
+	opts := initStorageOptions(1024, 1 << 16, 3)
+	opts.wal_sync = WAL_SYNC_NONE
+	wr, _ := initStorageWriter(dir, file_number, true, opts)
+	// an entry holds the index, up to a file, and the row
+	limit := (wal_checkpoint_files + 2) * int64(opts.max_file_size)
+	records := make([]*Data, 0)
+	for i := 0; i < 600; i++ {
+		d := generateKeyedData(fmt.Sprintf("%05d", i), 2)
+		if err := wr.Write(d); err != nil {
+			t.Fatalf("Failed to write data %d: %v", i, err)
+		}
+		records = append(records, d)
+		if info, err := os.Stat(walPath(dir)); err != nil || info.Size() > limit {
+			t.Fatalf("Expected a log of at most %d bytes after %d writes. Actual %v %v", limit, i, info, err)
+		}
+	}
+	crash(wr, generateKeyedData("z", 2))
+
+	r, _ := initStorageReader(dir, file_number, true, nil)
+	defer r.Close()
+	for _, expected := range(records) {
+		if actual, _ := r.Read(expected.row_key); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected %v. Actual %v", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+module bradfielddb
+
+go 1.23.1
+
+require bradfielddb/db v0.0.0
+
+replace bradfielddb/db => ./db
@@ -2,8 +2,29 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+
+	"bradfielddb/db"
 )
 
+// usage: tinydb [data directory]
 func main() {
-	fmt.Print("Hello World")
+	dir := "."
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+	history := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		history = filepath.Join(home, ".tinydb_history")
+	}
+	sh, err := db.OpenShell(dir, history, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer sh.Close()
+	if err := sh.Run(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
 }